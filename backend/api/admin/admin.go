@@ -200,7 +200,9 @@ func EditStore(c *gin.Context, db *mongo.Database) {
 	store.Status = reqBody.Status
 
 	_, err = storesCollection.UpdateOne(c, filter, bson.M{
-		"$set": store,
+		"$set": bson.M{
+			"status": store.Status,
+		},
 	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error updating store. " + err.Error()})
@@ -407,7 +409,32 @@ func GetRiders(c *gin.Context, db *mongo.Database) {
 		return
 	}
 
-	c.JSON(http.StatusOK, riders)
+	riderIds := make([]primitive.ObjectID, 0, len(riders))
+	for _, rider := range riders {
+		riderIds = append(riderIds, rider.ID)
+	}
+
+	riderRatings, err := utils.GetRiderRatings(c, db, riderIds)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error getting rider ratings. " + err.Error()})
+		return
+	}
+
+	type RiderResponse struct {
+		data.User
+		Rating *data.RiderRating `json:"rating,omitempty"`
+	}
+
+	response := make([]RiderResponse, 0, len(riders))
+	for _, rider := range riders {
+		riderResponse := RiderResponse{User: rider}
+		if riderRating, ok := riderRatings[rider.ID]; ok {
+			riderResponse.Rating = &riderRating
+		}
+		response = append(response, riderResponse)
+	}
+
+	c.JSON(http.StatusOK, response)
 
 }
 
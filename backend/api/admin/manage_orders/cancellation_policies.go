@@ -0,0 +1,87 @@
+package manage_orders
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetCancellationPolicies godoc
+// @Summary Get cancellation policies
+// @Description Get the cancellation policy in force for every order progress status and role
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Success 200 {array} data.CancellationPolicy
+// @Failure 500 {object} object{error=string}
+// @Router /admin/cancellationPolicies [get]
+// @Security BearerAuth
+func GetCancellationPolicies(c *gin.Context, db *mongo.Database) {
+
+	policies, err := utils.GetCancellationPolicies(c, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cancellation policies. " + err.Error()})
+		slog.Error("Failed to get cancellation policies", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, policies)
+
+}
+
+// UpdateCancellationPolicy godoc
+// @Summary Update a cancellation policy
+// @Description Set whether a role may cancel an order at a progress status, and how much is refunded and paid to the store and rider
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param policy body data.CancellationPolicy true "Cancellation policy"
+// @Success 200 {object} data.CancellationPolicy
+// @Failure 400 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/cancellationPolicies [patch]
+// @Security BearerAuth
+func UpdateCancellationPolicy(c *gin.Context, db *mongo.Database) {
+
+	var policy data.CancellationPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if err := policy.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+
+	var updatedPolicy data.CancellationPolicy
+	if err := db.Collection(utils.CANCELLATION_POLICY).FindOneAndUpdate(c, bson.M{
+		"progressStatus": policy.ProgressStatus,
+		"actorRole":      policy.ActorRole,
+	}, bson.M{
+		"$set": bson.M{
+			"canCancel":     policy.CanCancel,
+			"refundPercent": policy.RefundPercent,
+			"storePercent":  policy.StorePercent,
+			"riderPercent":  policy.RiderPercent,
+			"updatedAt":     now,
+		},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&updatedPolicy); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update cancellation policy. " + err.Error()})
+		slog.Error("Failed to update cancellation policy", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, updatedPolicy)
+
+}
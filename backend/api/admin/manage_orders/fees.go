@@ -0,0 +1,372 @@
+package manage_orders
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func validateDeliveryFee(deliveryFee *data.DeliveryFee) error {
+	if deliveryFee.Distance <= 0 {
+		return errors.New("distance must be more than 0")
+	}
+	if deliveryFee.Fee < 0 {
+		return errors.New("fee cannot be negative")
+	}
+	switch strings.ToLower(deliveryFee.DistanceUnit) {
+	case "km", "m", "meter", "meters", "metre", "metres":
+		return nil
+	default:
+		return errors.New("distanceUnit must be km or m")
+	}
+}
+
+func validateServiceFee(serviceFee *data.ServiceFee) error {
+	if serviceFee.Fee < 0 {
+		return errors.New("fee cannot be negative")
+	}
+	if serviceFee.Location != nil && len(strings.TrimSpace(*serviceFee.Location)) == 0 {
+		serviceFee.Location = nil
+	}
+	return nil
+}
+
+// serviceFeeLocationFilter matches the service fee for location, or the default one when it is nil.
+func serviceFeeLocationFilter(location *string) bson.M {
+	if location == nil {
+		return bson.M{"$or": []bson.M{
+			{"location": bson.M{"$exists": false}},
+			{"location": nil},
+		}}
+	}
+	return bson.M{"location": *location}
+}
+
+// GetDeliveryFees godoc
+// @Summary Get delivery fees
+// @Description Get the delivery fee bands. Checkout and errands charge the fee of the smallest band that covers the delivery distance, and refuse deliveries beyond the largest
+// @Tags Admin
+// @Produce json
+// @Success 200 {array} data.DeliveryFee
+// @Failure 500 {object} object{error=string}
+// @Router /admin/deliveryFees [get]
+// @Security BearerAuth
+func GetDeliveryFees(c *gin.Context, db *mongo.Database) {
+
+	cursor, err := db.Collection(utils.DELIVERY_FEE).Find(c, bson.M{}, options.Find().SetSort(bson.M{"distance": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get delivery fees. " + err.Error()})
+		slog.Error("Failed to get delivery fees", "error", err.Error())
+		return
+	}
+	defer cursor.Close(c)
+
+	deliveryFees := []data.DeliveryFee{}
+	if err := cursor.All(c, &deliveryFees); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode delivery fees. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveryFees)
+
+}
+
+// CreateDeliveryFee godoc
+// @Summary Add a delivery fee band
+// @Description Add a delivery fee charged for deliveries up to distance
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param deliveryFee body data.DeliveryFee true "Delivery fee"
+// @Success 201 {object} data.DeliveryFee
+// @Failure 400 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/deliveryFees [post]
+// @Security BearerAuth
+func CreateDeliveryFee(c *gin.Context, db *mongo.Database) {
+
+	var deliveryFee data.DeliveryFee
+	if err := c.ShouldBindJSON(&deliveryFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if err := validateDeliveryFee(&deliveryFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deliveryFee.ID = primitive.NewObjectID()
+	if _, err := db.Collection(utils.DELIVERY_FEE).InsertOne(c, deliveryFee); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create delivery fee. " + err.Error()})
+		slog.Error("Failed to create delivery fee", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, deliveryFee)
+
+}
+
+// UpdateDeliveryFee godoc
+// @Summary Update a delivery fee band
+// @Description Replace the distance, unit and fee of a delivery fee band
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Delivery fee ID"
+// @Param deliveryFee body data.DeliveryFee true "Delivery fee"
+// @Success 200 {object} data.DeliveryFee
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/deliveryFees/{id} [patch]
+// @Security BearerAuth
+func UpdateDeliveryFee(c *gin.Context, db *mongo.Database) {
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delivery fee id. " + err.Error()})
+		return
+	}
+
+	var deliveryFee data.DeliveryFee
+	if err := c.ShouldBindJSON(&deliveryFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if err := validateDeliveryFee(&deliveryFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var updatedDeliveryFee data.DeliveryFee
+	if err := db.Collection(utils.DELIVERY_FEE).FindOneAndUpdate(c, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"distance":     deliveryFee.Distance,
+			"distanceUnit": deliveryFee.DistanceUnit,
+			"fee":          deliveryFee.Fee,
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updatedDeliveryFee); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "delivery fee not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update delivery fee. " + err.Error()})
+		slog.Error("Failed to update delivery fee", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, updatedDeliveryFee)
+
+}
+
+// DeleteDeliveryFee godoc
+// @Summary Delete a delivery fee band
+// @Description Remove a delivery fee band. Deliveries it covered fall into the next larger band, or are refused if there is none
+// @Tags Admin
+// @Produce json
+// @Param id path string true "Delivery fee ID"
+// @Success 200 {object} object{message=string}
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/deliveryFees/{id} [delete]
+// @Security BearerAuth
+func DeleteDeliveryFee(c *gin.Context, db *mongo.Database) {
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delivery fee id. " + err.Error()})
+		return
+	}
+
+	result, err := db.Collection(utils.DELIVERY_FEE).DeleteOne(c, bson.M{"_id": id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete delivery fee. " + err.Error()})
+		slog.Error("Failed to delete delivery fee", "error", err.Error())
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery fee not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "delivery fee deleted"})
+
+}
+
+// GetServiceFees godoc
+// @Summary Get service fees
+// @Description Get the service fees. Checkout charges the fee for the store's address, or the one without a location when there is none for it
+// @Tags Admin
+// @Produce json
+// @Success 200 {array} data.ServiceFee
+// @Failure 500 {object} object{error=string}
+// @Router /admin/serviceFees [get]
+// @Security BearerAuth
+func GetServiceFees(c *gin.Context, db *mongo.Database) {
+
+	cursor, err := db.Collection(utils.SERVICE_FEE).Find(c, bson.M{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get service fees. " + err.Error()})
+		slog.Error("Failed to get service fees", "error", err.Error())
+		return
+	}
+	defer cursor.Close(c)
+
+	serviceFees := []data.ServiceFee{}
+	if err := cursor.All(c, &serviceFees); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode service fees. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, serviceFees)
+
+}
+
+// CreateServiceFee godoc
+// @Summary Add a service fee
+// @Description Add the service fee for stores at location, or the default one when location is left out
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param serviceFee body data.ServiceFee true "Service fee"
+// @Success 201 {object} data.ServiceFee
+// @Failure 400 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/serviceFees [post]
+// @Security BearerAuth
+func CreateServiceFee(c *gin.Context, db *mongo.Database) {
+
+	var serviceFee data.ServiceFee
+	if err := c.ShouldBindJSON(&serviceFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if err := validateServiceFee(&serviceFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	serviceFeeCollection := db.Collection(utils.SERVICE_FEE)
+
+	existing, err := serviceFeeCollection.CountDocuments(c, serviceFeeLocationFilter(serviceFee.Location))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check service fees. " + err.Error()})
+		return
+	}
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a service fee for this location already exists"})
+		return
+	}
+
+	serviceFee.ID = primitive.NewObjectID()
+	if _, err := serviceFeeCollection.InsertOne(c, serviceFee); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create service fee. " + err.Error()})
+		slog.Error("Failed to create service fee", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, serviceFee)
+
+}
+
+// UpdateServiceFee godoc
+// @Summary Update a service fee
+// @Description Change the amount of a service fee
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Service fee ID"
+// @Param serviceFee body data.ServiceFee true "Service fee"
+// @Success 200 {object} data.ServiceFee
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/serviceFees/{id} [patch]
+// @Security BearerAuth
+func UpdateServiceFee(c *gin.Context, db *mongo.Database) {
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid service fee id. " + err.Error()})
+		return
+	}
+
+	var serviceFee data.ServiceFee
+	if err := c.ShouldBindJSON(&serviceFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if err := validateServiceFee(&serviceFee); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var updatedServiceFee data.ServiceFee
+	if err := db.Collection(utils.SERVICE_FEE).FindOneAndUpdate(c, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"fee": serviceFee.Fee,
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updatedServiceFee); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "service fee not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update service fee. " + err.Error()})
+		slog.Error("Failed to update service fee", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, updatedServiceFee)
+
+}
+
+// DeleteServiceFee godoc
+// @Summary Delete a service fee
+// @Description Remove a service fee. Stores it covered are charged the default service fee, or none if there is no default
+// @Tags Admin
+// @Produce json
+// @Param id path string true "Service fee ID"
+// @Success 200 {object} object{message=string}
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/serviceFees/{id} [delete]
+// @Security BearerAuth
+func DeleteServiceFee(c *gin.Context, db *mongo.Database) {
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid service fee id. " + err.Error()})
+		return
+	}
+
+	result, err := db.Collection(utils.SERVICE_FEE).DeleteOne(c, bson.M{"_id": id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete service fee. " + err.Error()})
+		slog.Error("Failed to delete service fee", "error", err.Error())
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "service fee not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "service fee deleted"})
+
+}
@@ -4,14 +4,17 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
 	"useboi-boi/backend/internal/data"
 	"useboi-boi/backend/utils"
 
+	"firebase.google.com/go/messaging"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // GetAllOrders godoc
@@ -79,13 +82,14 @@ func GetAllOrders(c *gin.Context, db *mongo.Database) {
 					"deliveryInstruction": 1,
 					"deliveryLocation":    1,
 					"deliveryMapLocation": 1,
-					"code":                1,
+					"codeAttempts":        1,
 					"status":              1,
 					"orderProgressStatus": 1,
 					"price":               1,
 					"serviceCharge":       1,
 					"deliveryFee":         1,
 					"couponPrice":         1,
+					"lineItems":           1,
 					"isPaidFor":           1,
 					"orderTransactionID":  1,
 					"createdAt":           1,
@@ -239,13 +243,14 @@ func GetOrder(c *gin.Context, db *mongo.Database) {
 			"deliveryInstruction": bson.M{"$first": "$deliveryInstruction"},
 			"deliveryLocation":    bson.M{"$first": "$deliveryLocation"},
 			"deliveryMapLocation": bson.M{"$first": "$deliveryMapLocation"},
-			"code":                bson.M{"$first": "$code"},
+			"codeAttempts":        bson.M{"$first": "$codeAttempts"},
 			"status":              bson.M{"$first": "$status"},
 			"orderProgressStatus": bson.M{"$first": "$orderProgressStatus"},
 			"price":               bson.M{"$first": "$price"},
 			"serviceCharge":       bson.M{"$first": "$serviceCharge"},
 			"deliveryFee":         bson.M{"$first": "$deliveryFee"},
 			"couponPrice":         bson.M{"$first": "$couponPrice"},
+			"lineItems":           bson.M{"$first": "$lineItems"},
 			"isPaidFor":           bson.M{"$first": "$isPaidFor"},
 			"orderTransactionID":  bson.M{"$first": "$orderTransactionID"},
 			"createdAt":           bson.M{"$first": "$createdAt"},
@@ -260,13 +265,14 @@ func GetOrder(c *gin.Context, db *mongo.Database) {
 			"deliveryInstruction": 1,
 			"deliveryLocation":    1,
 			"deliveryMapLocation": 1,
-			"code":                1,
+			"codeAttempts":        1,
 			"status":              1,
 			"orderProgressStatus": 1,
 			"price":               1,
 			"serviceCharge":       1,
 			"deliveryFee":         1,
 			"couponPrice":         1,
+			"lineItems":           1,
 			"isPaidFor":           1,
 			"orderTransactionID":  1,
 			"createdAt":           1,
@@ -339,3 +345,84 @@ func GetOrder(c *gin.Context, db *mongo.Database) {
 	c.JSON(http.StatusOK, order)
 
 }
+
+// GetOrderTimeline godoc
+// @Summary Get an order's timeline
+// @Description Get every status transition recorded for an order, oldest first
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {array} data.OrderTimelineEntry
+// @Failure 400 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/orders/{id}/timeline [get]
+// @Security BearerAuth
+func GetOrderTimeline(c *gin.Context, db *mongo.Database) {
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	timeline, err := utils.GetOrderTimeline(c, db, orderId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order timeline. " + err.Error()})
+		slog.Error("Failed to get order timeline", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, timeline)
+
+}
+
+// RegenerateOrderCode godoc
+// @Summary Regenerate an order's delivery code
+// @Description Replace an ongoing order's delivery code, unlock it after too many wrong attempts and send the new code to the customer
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {object} object{message=string}
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/orders/{id}/code [post]
+// @Security BearerAuth
+func RegenerateOrderCode(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	code, err := utils.GenerateDeliveryCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate code. " + err.Error()})
+		return
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOneAndUpdate(c, bson.M{"_id": orderId, "status": data.OrderStatusOngoing}, bson.M{
+		"$set": bson.M{
+			"code":         code,
+			"codeAttempts": 0,
+			"updatedAt":    time.Now(),
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&order); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no ongoing order found with this id"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to regenerate code. " + err.Error()})
+		slog.Error("Failed to regenerate order code", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "a new delivery code has been sent to the customer"})
+
+	utils.SendDeliveryCodeToCustomer(c, db, fcm, &order)
+
+}
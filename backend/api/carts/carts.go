@@ -1,6 +1,8 @@
 package carts
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 
@@ -11,6 +13,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type CartItemData struct {
@@ -18,6 +21,475 @@ type CartItemData struct {
 	Item          data.Item `json:"item"`
 }
 
+type CartData struct {
+	data.Cart `bson:",inline"`
+	Items     []CartItemData `json:"items"`
+}
+
+type CreateCartBody struct {
+	StoreId string `json:"storeId"`
+}
+
+type AddCartItemBody struct {
+	ItemId   string `json:"itemId"`
+	Quantity int    `json:"quantity"`
+}
+
+type UpdateCartItemBody struct {
+	Quantity int `json:"quantity"`
+}
+
+// OpenCartForStore returns the user's open cart for a store, creating one if there is none. The
+// cart is upserted, and the unique open cart index turns a concurrent insert into a duplicate key
+// error, after which the cart the other request opened is returned.
+func OpenCartForStore(ctx context.Context, db *mongo.Database, userId primitive.ObjectID, storeId primitive.ObjectID) (*data.Cart, bool, error) {
+
+	cartCollection := db.Collection(utils.CART)
+
+	filter := bson.M{
+		"userId":      userId,
+		"storeId":     storeId,
+		"isCompleted": bson.M{"$ne": true},
+	}
+
+	newCartId := primitive.NewObjectID()
+
+	var cart data.Cart
+	err := cartCollection.FindOneAndUpdate(ctx, filter, bson.M{
+		"$setOnInsert": bson.M{
+			"_id":         newCartId,
+			"isCompleted": false,
+			"cartItems":   []primitive.ObjectID{},
+		},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&cart)
+	if mongo.IsDuplicateKeyError(err) {
+		if err := cartCollection.FindOne(ctx, filter).Decode(&cart); err != nil {
+			return nil, false, err
+		}
+		return &cart, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &cart, cart.ID == newCartId, nil
+}
+
+func CreateCart(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	var body CreateCartBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	storeId, err := primitive.ObjectIDFromHex(body.StoreId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId. " + err.Error()})
+		return
+	}
+
+	var store data.Store
+	if err := db.Collection(utils.STORE).FindOne(c, bson.M{"_id": storeId}).Decode(&store); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "store not found. " + err.Error()})
+		return
+	}
+
+	if store.Status != "active" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "store is not active"})
+		return
+	}
+
+	cart, created, err := OpenCartForStore(c, db, userId, storeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create cart. " + err.Error()})
+		slog.Error("Failed to create cart", "error", err.Error())
+		return
+	}
+
+	if err := setCurrentCart(c, db, userId, cart.ID); err != nil {
+		slog.Error("Failed to update current cart", "error", err.Error())
+	}
+
+	cartData, err := getCartData(c, db, cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
+		slog.Info("Failed to get cart items", "error", err)
+		return
+	}
+
+	if created {
+		c.JSON(http.StatusCreated, cartData)
+		return
+	}
+
+	c.JSON(http.StatusOK, cartData)
+
+}
+
+func GetCurrentCart(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	var user data.User
+	if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": userId}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found. " + err.Error()})
+		return
+	}
+
+	if user.CurrentCartID == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no current cart"})
+		return
+	}
+
+	var cart data.Cart
+	if err := db.Collection(utils.CART).FindOne(c, bson.M{"_id": *user.CurrentCartID}).Decode(&cart); err != nil || isCompleted(&cart) {
+		if err := clearCurrentCart(c, db, userId, *user.CurrentCartID); err != nil {
+			slog.Error("Failed to clear current cart", "error", err.Error())
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "no current cart"})
+		return
+	}
+
+	cartData, err := getCartData(c, db, &cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
+		slog.Info("Failed to get cart items", "error", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cartData)
+
+}
+
+func AddItemToCart(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	var body AddCartItemBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if body.Quantity < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quantity must be at least 1"})
+		return
+	}
+
+	itemId, err := primitive.ObjectIDFromHex(body.ItemId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid itemId. " + err.Error()})
+		return
+	}
+
+	cart, status, err := getOpenCart(c, db, c.Param("id"), userId)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartItemCollection := db.Collection(utils.CART_ITEM)
+
+	var cartItem data.CartItem
+	err = cartItemCollection.FindOne(c, bson.M{"cartId": cart.ID, "itemId": itemId}).Decode(&cartItem)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart item. " + err.Error()})
+		return
+	}
+	existing := err == nil
+
+	quantity := body.Quantity
+	if existing {
+		quantity += cartItem.Quantity
+	}
+
+	if err := validateCartItem(c, db, cart, itemId, quantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Upsert so two adds of the same item racing each other end up in one row with both quantities.
+	newCartItemId := primitive.NewObjectID()
+	upsert := func() error {
+		return cartItemCollection.FindOneAndUpdate(c, bson.M{"cartId": cart.ID, "itemId": itemId}, bson.M{
+			"$inc": bson.M{"quantity": body.Quantity},
+			"$setOnInsert": bson.M{
+				"_id":           newCartItemId,
+				"isAddedToCart": true,
+			},
+		}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&cartItem)
+	}
+
+	err = upsert()
+	if mongo.IsDuplicateKeyError(err) {
+		// Another request inserted the row first; this time the update matches it.
+		err = upsert()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add item to cart. " + err.Error()})
+		slog.Error("Failed to add item to cart", "error", err.Error())
+		return
+	}
+
+	if cartItem.ID == newCartItemId {
+		if _, err := db.Collection(utils.CART).UpdateOne(c, bson.M{"_id": cart.ID}, bson.M{
+			"$addToSet": bson.M{"cartItems": cartItem.ID},
+		}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add item to cart. " + err.Error()})
+			slog.Error("Failed to add item to cart", "error", err.Error())
+			return
+		}
+		cart.CartItems = append(cart.CartItems, cartItem.ID)
+	}
+
+	respondWithCart(c, db, cart, userId)
+
+}
+
+func UpdateCartItemQuantity(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	var body UpdateCartItemBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if body.Quantity < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quantity must be at least 1, remove the item instead"})
+		return
+	}
+
+	cartItemId, err := primitive.ObjectIDFromHex(c.Param("cartItemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cart item id. " + err.Error()})
+		return
+	}
+
+	cart, status, err := getOpenCart(c, db, c.Param("id"), userId)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartItemCollection := db.Collection(utils.CART_ITEM)
+
+	var cartItem data.CartItem
+	if err := cartItemCollection.FindOne(c, bson.M{"_id": cartItemId, "cartId": cart.ID}).Decode(&cartItem); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cart item not found. " + err.Error()})
+		return
+	}
+
+	if err := validateCartItem(c, db, cart, cartItem.ItemID, body.Quantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := cartItemCollection.UpdateOne(c, bson.M{"_id": cartItem.ID}, bson.M{
+		"$set": bson.M{"quantity": body.Quantity},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update cart item. " + err.Error()})
+		slog.Error("Failed to update cart item", "error", err.Error())
+		return
+	}
+
+	respondWithCart(c, db, cart, userId)
+
+}
+
+func RemoveItemFromCart(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	cartItemId, err := primitive.ObjectIDFromHex(c.Param("cartItemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cart item id. " + err.Error()})
+		return
+	}
+
+	cart, status, err := getOpenCart(c, db, c.Param("id"), userId)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := db.Collection(utils.CART_ITEM).DeleteOne(c, bson.M{"_id": cartItemId, "cartId": cart.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove item from cart. " + err.Error()})
+		slog.Error("Failed to remove item from cart", "error", err.Error())
+		return
+	}
+
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cart item not found"})
+		return
+	}
+
+	if _, err := db.Collection(utils.CART).UpdateOne(c, bson.M{"_id": cart.ID}, bson.M{
+		"$pull": bson.M{"cartItems": cartItemId},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove item from cart. " + err.Error()})
+		slog.Error("Failed to remove item from cart", "error", err.Error())
+		return
+	}
+
+	respondWithCart(c, db, cart, userId)
+
+}
+
+func ClearCart(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	cart, status, err := getOpenCart(c, db, c.Param("id"), userId)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := db.Collection(utils.CART_ITEM).DeleteMany(c, bson.M{"cartId": cart.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear cart. " + err.Error()})
+		slog.Error("Failed to clear cart", "error", err.Error())
+		return
+	}
+
+	if _, err := db.Collection(utils.CART).UpdateOne(c, bson.M{"_id": cart.ID}, bson.M{
+		"$set": bson.M{"cartItems": []primitive.ObjectID{}},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear cart. " + err.Error()})
+		slog.Error("Failed to clear cart", "error", err.Error())
+		return
+	}
+
+	respondWithCart(c, db, cart, userId)
+
+}
+
+// getOpenCart loads a cart by id and checks that it belongs to the user and has not been checked out.
+// The returned status is the one to respond with when the cart can't be used.
+func getOpenCart(c *gin.Context, db *mongo.Database, cartIdStr string, userId primitive.ObjectID) (*data.Cart, int, error) {
+
+	cartId, err := primitive.ObjectIDFromHex(cartIdStr)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid cart id. " + err.Error())
+	}
+
+	var cart data.Cart
+	if err := db.Collection(utils.CART).FindOne(c, bson.M{"_id": cartId}).Decode(&cart); err != nil {
+		return nil, http.StatusNotFound, fmt.Errorf("cart not found")
+	}
+
+	if cart.UserID != userId {
+		return nil, http.StatusForbidden, fmt.Errorf("cart does not belong to user")
+	}
+
+	if isCompleted(&cart) {
+		return nil, http.StatusBadRequest, fmt.Errorf("cart has already been checked out")
+	}
+
+	return &cart, http.StatusOK, nil
+}
+
+// validateCartItem checks that an item can be put in the cart at the given quantity.
+func validateCartItem(c *gin.Context, db *mongo.Database, cart *data.Cart, itemId primitive.ObjectID, quantity int) error {
+
+	var item data.Item
+	if err := db.Collection(utils.ITEM).FindOne(c, bson.M{"_id": itemId}).Decode(&item); err != nil {
+		return fmt.Errorf("item not found")
+	}
+
+	if item.Status != nil && *item.Status != "active" {
+		return fmt.Errorf("item is not available")
+	}
+
+	if item.StoreID == nil || *item.StoreID != cart.StoreID {
+		return fmt.Errorf("item does not belong to the cart's store")
+	}
+
+	if item.CurrentInventory != nil && quantity > *item.CurrentInventory {
+		return fmt.Errorf("only %d of this item left in stock", *item.CurrentInventory)
+	}
+
+	return nil
+}
+
+func respondWithCart(c *gin.Context, db *mongo.Database, cart *data.Cart, userId primitive.ObjectID) {
+
+	if err := setCurrentCart(c, db, userId, cart.ID); err != nil {
+		slog.Error("Failed to update current cart", "error", err.Error())
+	}
+
+	cartData, err := getCartData(c, db, cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
+		slog.Info("Failed to get cart items", "error", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cartData)
+}
+
+func getCartData(ctx context.Context, db *mongo.Database, cart *data.Cart) (*CartData, error) {
+
+	cartItems, err := getCartItems(ctx, db, cart.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var updatedCart data.Cart
+	if err := db.Collection(utils.CART).FindOne(ctx, bson.M{"_id": cart.ID}).Decode(&updatedCart); err != nil {
+		return nil, err
+	}
+
+	return &CartData{Cart: updatedCart, Items: cartItems}, nil
+}
+
+func setCurrentCart(ctx context.Context, db *mongo.Database, userId primitive.ObjectID, cartId primitive.ObjectID) error {
+	_, err := db.Collection(utils.USER).UpdateOne(ctx, bson.M{"_id": userId}, bson.M{
+		"$set": bson.M{"currentCartId": cartId},
+	})
+	return err
+}
+
+func clearCurrentCart(ctx context.Context, db *mongo.Database, userId primitive.ObjectID, cartId primitive.ObjectID) error {
+	_, err := db.Collection(utils.USER).UpdateOne(ctx, bson.M{"_id": userId, "currentCartId": cartId}, bson.M{
+		"$unset": bson.M{"currentCartId": ""},
+	})
+	return err
+}
+
+func isCompleted(cart *data.Cart) bool {
+	return cart.IsCompleted != nil && *cart.IsCompleted
+}
+
 func GetItemsInCart(c *gin.Context, db *mongo.Database) {
 
 	cartIdStr := c.Param("id")
@@ -28,7 +500,18 @@ func GetItemsInCart(c *gin.Context, db *mongo.Database) {
 		return
 	}
 
-	cartItemCollection := db.Collection(utils.CART_ITEM)
+	cartItems, err := getCartItems(c, db, cartId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
+		slog.Info("Failed to get cart items", "error", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cartItems)
+
+}
+
+func getCartItems(ctx context.Context, db *mongo.Database, cartId primitive.ObjectID) ([]CartItemData, error) {
 
 	pipeline := []bson.M{
 		{"$match": bson.M{"cartId": cartId}},
@@ -49,23 +532,16 @@ func GetItemsInCart(c *gin.Context, db *mongo.Database) {
 		}},
 	}
 
-	cursor, err := cartItemCollection.Aggregate(c, pipeline)
+	cursor, err := db.Collection(utils.CART_ITEM).Aggregate(ctx, pipeline)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
-		slog.Info("Failed to get cart items", "error", err)
-		return
+		return nil, err
 	}
-
-	defer cursor.Close(c)
+	defer cursor.Close(ctx)
 
 	cartItems := []CartItemData{}
-
-	if err := cursor.All(c, &cartItems); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
-		slog.Info("Failed to get cart items", "error", err)
-		return
+	if err := cursor.All(ctx, &cartItems); err != nil {
+		return nil, err
 	}
 
-	c.JSON(http.StatusOK, cartItems)
-
+	return cartItems, nil
 }
@@ -0,0 +1,343 @@
+package carts
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errOpenCartExists = errors.New("there is already an open cart for this store")
+
+// What happened to an item of the original order when it was put in the new cart.
+const (
+	ReorderUnchanged       = "unchanged"
+	ReorderPriceChanged    = "priceChanged"
+	ReorderQuantityReduced = "quantityReduced"
+	ReorderUnavailable     = "unavailable"
+	ReorderOutOfStock      = "outOfStock"
+)
+
+type ReorderChange struct {
+	ItemID            primitive.ObjectID `json:"itemId"`
+	Name              string             `json:"name"`
+	Change            string             `json:"change"`
+	PriceChanged      bool               `json:"priceChanged"` // also set when the quantity was reduced
+	PreviousQuantity  int                `json:"previousQuantity"`
+	Quantity          int                `json:"quantity"`
+	PreviousUnitPrice *float64           `json:"previousUnitPrice,omitempty"`
+	UnitPrice         *float64           `json:"unitPrice,omitempty"`
+}
+
+type ReorderResponse struct {
+	Cart          CartData        `json:"cart"`
+	Changes       []ReorderChange `json:"changes"`
+	PreviousTotal float64         `json:"previousTotal"` // what the same items cost on the original order
+	Subtotal      float64         `json:"subtotal"`      // what the new cart costs at current prices
+}
+
+// Reorder godoc
+// @Summary Reorder a past order
+// @Description Build a new cart for the order's store from the order's items. If there is already an open cart for that store it is returned with a 409 and left alone; send replace=true to throw it away and reorder anyway. Items that were deleted or are out of stock are left out, quantities are capped at current stock and everything is repriced. The changes list says what differs from the original order.
+// @Tags Orders
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param replace query bool false "Replace the open cart for the store"
+// @Success 201 {object} ReorderResponse
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string,cart=CartData}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/reorder [post]
+// @Security BearerAuth
+func Reorder(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if order.CustomerID != userId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "order does not belong to user"})
+		return
+	}
+
+	var store data.Store
+	if err := db.Collection(utils.STORE).FindOne(c, bson.M{"_id": order.StoreID}).Decode(&store); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "store not found. " + err.Error()})
+		return
+	}
+
+	if store.Status != "active" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "store is not active"})
+		return
+	}
+
+	lineItems, err := orderedItems(c, db, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order items. " + err.Error()})
+		slog.Error("Failed to get order items", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	if len(lineItems) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has no items to reorder"})
+		return
+	}
+
+	itemIds := make([]primitive.ObjectID, 0, len(lineItems))
+	for _, lineItem := range lineItems {
+		itemIds = append(itemIds, lineItem.ItemID)
+	}
+
+	cursor, err := db.Collection(utils.ITEM).Find(c, bson.M{"_id": bson.M{"$in": itemIds}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get items. " + err.Error()})
+		return
+	}
+	defer cursor.Close(c)
+
+	var items []data.Item
+	if err := cursor.All(c, &items); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode items. " + err.Error()})
+		return
+	}
+
+	currentItems := make(map[primitive.ObjectID]data.Item, len(items))
+	for _, item := range items {
+		currentItems[item.ID] = item
+	}
+
+	isCompleted := false
+	cart := data.Cart{
+		ID:          primitive.NewObjectID(),
+		IsCompleted: &isCompleted,
+		CartItems:   []primitive.ObjectID{},
+		UserID:      userId,
+		StoreID:     order.StoreID,
+	}
+
+	response := ReorderResponse{Changes: []ReorderChange{}}
+	var cartItems []interface{}
+
+	for _, lineItem := range lineItems {
+		change := diffOrderedItem(lineItem, currentItems, order.StoreID)
+		response.Changes = append(response.Changes, change)
+
+		if lineItem.UnitPrice != nil {
+			response.PreviousTotal += *lineItem.UnitPrice * float64(lineItem.Quantity)
+		}
+
+		if change.Quantity == 0 {
+			continue
+		}
+
+		response.Subtotal += *change.UnitPrice * float64(change.Quantity)
+
+		cartItem := data.CartItem{
+			ID:            primitive.NewObjectID(),
+			CartID:        cart.ID,
+			ItemID:        lineItem.ItemID,
+			Quantity:      change.Quantity,
+			IsAddedToCart: true,
+		}
+		cartItems = append(cartItems, cartItem)
+		cart.CartItems = append(cart.CartItems, cartItem.ID)
+	}
+
+	if len(cartItems) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "none of the items in this order are available anymore", "changes": response.Changes})
+		return
+	}
+
+	replace := c.Query("replace") == "true"
+
+	var openCart data.Cart
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start db transaction session. " + err.Error()})
+		return
+	}
+	defer session.EndSession(c)
+
+	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		// A customer only has one open cart per store, so the reorder only replaces it once they confirm.
+		var openCarts []data.Cart
+		openCursor, err := db.Collection(utils.CART).Find(sessCtx, bson.M{
+			"userId":      userId,
+			"storeId":     order.StoreID,
+			"isCompleted": bson.M{"$ne": true},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := openCursor.All(sessCtx, &openCarts); err != nil {
+			return nil, err
+		}
+
+		if len(openCarts) > 0 && !replace {
+			openCart = openCarts[0]
+			return nil, errOpenCartExists
+		}
+
+		for _, openCart := range openCarts {
+			if _, err := db.Collection(utils.CART_ITEM).DeleteMany(sessCtx, bson.M{"cartId": openCart.ID}); err != nil {
+				return nil, err
+			}
+			if _, err := db.Collection(utils.CART).DeleteOne(sessCtx, bson.M{"_id": openCart.ID}); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err := db.Collection(utils.CART).InsertOne(sessCtx, cart); err != nil {
+			return nil, err
+		}
+
+		if _, err := db.Collection(utils.CART_ITEM).InsertMany(sessCtx, cartItems); err != nil {
+			return nil, err
+		}
+
+		return nil, setCurrentCart(sessCtx, db, userId, cart.ID)
+	})
+	if errors.Is(err, errOpenCartExists) {
+		openCartData, err := getCartData(c, db, &openCart)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": errOpenCartExists.Error() + ". reorder with replace=true to replace it", "cart": openCartData})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create cart. " + err.Error()})
+		slog.Error("Failed to create cart for reorder", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	cartData, err := getCartData(c, db, &cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items. " + err.Error()})
+		slog.Info("Failed to get cart items", "error", err)
+		return
+	}
+	response.Cart = *cartData
+
+	c.JSON(http.StatusCreated, response)
+
+}
+
+// orderedItem is an item of a past order with the price it was bought at, when known.
+type orderedItem struct {
+	ItemID    primitive.ObjectID
+	Name      string
+	Quantity  int
+	UnitPrice *float64
+}
+
+// orderedItems returns what was bought on an order. Orders placed before line items were recorded
+// fall back to the items of the cart they were checked out from, without prices.
+func orderedItems(c *gin.Context, db *mongo.Database, order *data.Order) ([]orderedItem, error) {
+
+	var items []orderedItem
+
+	if len(order.LineItems) > 0 {
+		for _, lineItem := range order.LineItems {
+			unitPrice := lineItem.UnitPrice
+			items = append(items, orderedItem{
+				ItemID:    lineItem.ItemID,
+				Name:      lineItem.Name,
+				Quantity:  lineItem.Quantity,
+				UnitPrice: &unitPrice,
+			})
+		}
+		return items, nil
+	}
+
+	cartItems, err := getCartItems(c, db, order.CartID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cartItem := range cartItems {
+		name := ""
+		if cartItem.Item.Name != nil {
+			name = *cartItem.Item.Name
+		}
+		items = append(items, orderedItem{
+			ItemID:   cartItem.ItemID,
+			Name:     name,
+			Quantity: cartItem.Quantity,
+		})
+	}
+
+	return items, nil
+}
+
+// diffOrderedItem works out how much of an ordered item can go in the new cart and at what price.
+// A Quantity of 0 means the item is left out.
+func diffOrderedItem(ordered orderedItem, currentItems map[primitive.ObjectID]data.Item, storeId primitive.ObjectID) ReorderChange {
+
+	change := ReorderChange{
+		ItemID:            ordered.ItemID,
+		Name:              ordered.Name,
+		PreviousQuantity:  ordered.Quantity,
+		PreviousUnitPrice: ordered.UnitPrice,
+	}
+
+	item, ok := currentItems[ordered.ItemID]
+	if !ok || (item.Status != nil && *item.Status != "active") || item.Price == nil || item.StoreID == nil || *item.StoreID != storeId {
+		change.Change = ReorderUnavailable
+		return change
+	}
+
+	if item.Name != nil {
+		change.Name = *item.Name
+	}
+	change.UnitPrice = item.Price
+
+	if item.CurrentInventory != nil && *item.CurrentInventory <= 0 {
+		change.Change = ReorderOutOfStock
+		return change
+	}
+
+	change.PriceChanged = ordered.UnitPrice != nil && *ordered.UnitPrice != *item.Price
+
+	change.Quantity = ordered.Quantity
+	if item.CurrentInventory != nil && *item.CurrentInventory < ordered.Quantity {
+		change.Quantity = *item.CurrentInventory
+		change.Change = ReorderQuantityReduced
+		return change
+	}
+
+	if change.PriceChanged {
+		change.Change = ReorderPriceChanged
+		return change
+	}
+
+	change.Change = ReorderUnchanged
+	return change
+}
@@ -0,0 +1,352 @@
+package conversations
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"firebase.google.com/go/messaging"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const maxMessageLength = 1000
+
+type ConversationResponse struct {
+	data.Conversation `bson:",inline"`
+	UnreadCount       int64 `json:"unreadCount"`
+}
+
+type MessageBody struct {
+	Type  data.MessageType `json:"type"`  // text or image
+	Text  string           `json:"text"`  // the message, or an optional caption for images
+	Image string           `json:"image"` // base64 encoded, image messages only
+}
+
+// GetConversation godoc
+// @Summary Get an order's conversation
+// @Description Get the chat thread between the customer, the rider and the store of an order, with how many messages the user has not read. The thread is locked once the order is completed or cancelled.
+// @Tags Conversations
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {object} ConversationResponse
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/conversation [get]
+// @Security BearerAuth
+func GetConversation(c *gin.Context, db *mongo.Database) {
+
+	order, _, userId, ok := getOrderParticipant(c, db)
+	if !ok {
+		return
+	}
+
+	conversation, err := utils.GetOrderConversation(c, db, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get conversation. " + err.Error()})
+		slog.Error("Failed to get conversation", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	unreadCount, err := db.Collection(utils.MESSAGE).CountDocuments(c, unreadFilter(conversation.ID, userId))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count unread messages. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, ConversationResponse{Conversation: *conversation, UnreadCount: unreadCount})
+
+}
+
+// GetMessages godoc
+// @Summary Get an order's messages
+// @Description Get the messages of an order's conversation, newest first, 20 per page
+// @Tags Conversations
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param page query int false "Page number, starting at 1"
+// @Success 200 {object} object{data=[]data.Message,page=int,pageSize=int,totalCount=int}
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/messages [get]
+// @Security BearerAuth
+func GetMessages(c *gin.Context, db *mongo.Database) {
+
+	order, _, _, ok := getOrderParticipant(c, db)
+	if !ok {
+		return
+	}
+
+	conversation, err := utils.GetOrderConversation(c, db, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get conversation. " + err.Error()})
+		slog.Error("Failed to get conversation", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	const pageSize int64 = 20
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	skip := (page - 1) * pageSize
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"conversationId": conversation.ID}},
+		{"$sort": bson.M{"createdAt": -1}},
+		{"$facet": bson.M{
+			"data": []bson.M{
+				{"$skip": skip},
+				{"$limit": pageSize},
+			},
+			"totalCount": []bson.M{
+				{"$count": "count"},
+			},
+		}},
+	}
+
+	cursor, err := db.Collection(utils.MESSAGE).Aggregate(c, pipeline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get messages. " + err.Error()})
+		slog.Error("Failed to get messages", "error", err.Error())
+		return
+	}
+	defer cursor.Close(c)
+
+	var result struct {
+		Data       []data.Message `bson:"data"`
+		TotalCount []struct {
+			Count int64 `bson:"count"`
+		} `bson:"totalCount"`
+	}
+
+	if cursor.Next(c) {
+		if err := cursor.Decode(&result); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode messages. " + err.Error()})
+			slog.Error("Failed to decode messages", "error", err.Error())
+			return
+		}
+	}
+
+	if result.Data == nil {
+		result.Data = []data.Message{}
+	}
+
+	var total int64
+	if len(result.TotalCount) > 0 {
+		total = result.TotalCount[0].Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": result.Data, "page": page, "pageSize": pageSize, "totalCount": total})
+
+}
+
+// SendMessage godoc
+// @Summary Send a message on an order
+// @Description Send a text or image message to the other participants of an order. They are notified by push and on the order's live stream. Messages can't be sent once the order is completed or cancelled.
+// @Tags Conversations
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param message body MessageBody true "Message"
+// @Success 201 {object} data.Message
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/messages [post]
+// @Security BearerAuth
+func SendMessage(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	var body MessageBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	body.Text = strings.TrimSpace(body.Text)
+
+	if !body.Type.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be text or image"})
+		return
+	}
+
+	if body.Type == data.MessageText && body.Text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "text cannot be empty"})
+		return
+	}
+
+	if body.Type == data.MessageImage && body.Image == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image cannot be empty"})
+		return
+	}
+
+	if utf8.RuneCountInString(body.Text) > maxMessageLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "text cannot be longer than " + strconv.Itoa(maxMessageLength) + " characters"})
+		return
+	}
+
+	order, actorRole, userId, ok := getOrderParticipant(c, db)
+	if !ok {
+		return
+	}
+
+	conversation, err := utils.GetOrderConversation(c, db, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get conversation. " + err.Error()})
+		slog.Error("Failed to get conversation", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	if conversation.IsLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "conversation is closed because the order is no longer ongoing"})
+		return
+	}
+
+	message := data.Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: conversation.ID,
+		OrderID:        order.ID,
+		SenderID:       userId,
+		SenderRole:     actorRole,
+		Type:           body.Type,
+		ReadBy:         []data.MessageReceipt{},
+		CreatedAt:      time.Now(),
+	}
+
+	if body.Text != "" {
+		message.Text = &body.Text
+	}
+
+	if body.Type == data.MessageImage {
+		imageUrl, err := utils.UploadImage(body.Image)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upload image. " + err.Error()})
+			return
+		}
+		message.ImageURL = &imageUrl
+	}
+
+	if _, err := db.Collection(utils.MESSAGE).InsertOne(c, message); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send message. " + err.Error()})
+		slog.Error("Failed to send message", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	if _, err := db.Collection(utils.CONVERSATION).UpdateOne(c, bson.M{"_id": conversation.ID}, bson.M{"$set": bson.M{
+		"lastMessage":   message,
+		"lastMessageAt": message.CreatedAt,
+		"updatedAt":     message.CreatedAt,
+	}}); err != nil {
+		slog.Error("Failed to update conversation's last message", "conversationId", conversation.ID.Hex(), "error", err.Error())
+	}
+
+	utils.OrderEvents.Publish(utils.OrderEvent{
+		Type:    utils.OrderEventMessage,
+		OrderID: order.ID,
+		Message: &message,
+		At:      message.CreatedAt,
+	})
+
+	utils.SendNewMessageNotification(c, db, fcm, conversation, &message)
+
+	c.JSON(http.StatusCreated, message)
+
+}
+
+// MarkMessagesAsRead godoc
+// @Summary Mark an order's messages as read
+// @Description Record that the user has read every message sent to them on the order's conversation. The other participants see it on the order's live stream.
+// @Tags Conversations
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {object} object{message=string,count=int}
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/messages/read [patch]
+// @Security BearerAuth
+func MarkMessagesAsRead(c *gin.Context, db *mongo.Database) {
+
+	order, _, userId, ok := getOrderParticipant(c, db)
+	if !ok {
+		return
+	}
+
+	conversation, err := utils.GetOrderConversation(c, db, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get conversation. " + err.Error()})
+		slog.Error("Failed to get conversation", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	now := time.Now()
+	result, err := db.Collection(utils.MESSAGE).UpdateMany(c, unreadFilter(conversation.ID, userId), bson.M{
+		"$push": bson.M{"readBy": data.MessageReceipt{UserID: userId, ReadAt: now}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mark messages as read. " + err.Error()})
+		slog.Error("Failed to mark messages as read", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	if result.ModifiedCount > 0 {
+		utils.OrderEvents.Publish(utils.OrderEvent{
+			Type:    utils.OrderEventMessagesRead,
+			OrderID: order.ID,
+			Read:    &utils.MessagesReadEvent{UserID: userId, ReadAt: now},
+			At:      now,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "successfully marked messages as read", "count": result.ModifiedCount})
+
+}
+
+// getOrderParticipant loads the order in the path and checks the user is on its conversation:
+// the customer, a merchant of the store or the rider assigned to it.
+func getOrderParticipant(c *gin.Context, db *mongo.Database) (*data.Order, data.ActorRole, primitive.ObjectID, bool) {
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return nil, "", primitive.NilObjectID, false
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return nil, "", primitive.NilObjectID, false
+	}
+
+	actorRole, actorId, err := utils.ResolveOrderActor(c, db, c.GetString("userId"), &order)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return nil, "", primitive.NilObjectID, false
+	}
+
+	return &order, actorRole, *actorId, true
+}
+
+// unreadFilter matches the messages of a conversation sent to the user that they haven't read yet.
+func unreadFilter(conversationId primitive.ObjectID, userId primitive.ObjectID) bson.M {
+	return bson.M{
+		"conversationId": conversationId,
+		"senderId":       bson.M{"$ne": userId},
+		"readBy.userId":  bson.M{"$ne": userId},
+	}
+}
@@ -0,0 +1,552 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"firebase.google.com/go/messaging"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrNoActiveOffer     = errors.New("order has not been offered to you or the offer has expired")
+	ErrDispatchExhausted = errors.New("order has been offered in every wave without a rider accepting it")
+)
+
+type Settings struct {
+	WaveSize     int
+	OfferWindow  time.Duration
+	RadiusKm     float64
+	RadiusStepKm float64
+	MaxRadiusKm  float64
+	MaxWaves     int
+}
+
+// LoadSettings reads the dispatch settings from the environment.
+func LoadSettings() Settings {
+	return Settings{
+		WaveSize:     utils.GetEnvInt("DISPATCH_WAVE_SIZE", 3),
+		OfferWindow:  time.Duration(utils.GetEnvInt("DISPATCH_OFFER_WINDOW_SECONDS", 60)) * time.Second,
+		RadiusKm:     float64(utils.GetEnvInt("DISPATCH_RADIUS_KM", 3)),
+		RadiusStepKm: float64(utils.GetEnvInt("DISPATCH_RADIUS_STEP_KM", 2)),
+		MaxRadiusKm:  float64(utils.GetEnvInt("DISPATCH_MAX_RADIUS_KM", 10)),
+		MaxWaves:     utils.GetEnvInt("DISPATCH_MAX_WAVES", 10),
+	}
+}
+
+// radiusForWave widens the search a step with every wave, up to the maximum radius.
+func (s Settings) radiusForWave(wave int) float64 {
+	return math.Min(s.RadiusKm+float64(wave-1)*s.RadiusStepKm, s.MaxRadiusKm)
+}
+
+type Candidate struct {
+	Rider      data.User
+	DistanceKm float64
+}
+
+// FindCandidateRiders returns the active, online riders of active delivery services that are
+// within radiusKm of the store and not already carrying an order, nearest first.
+func FindCandidateRiders(ctx context.Context, db *mongo.Database, store *data.Store, radiusKm float64) ([]Candidate, error) {
+
+	if store.MapLocation == nil {
+		return nil, fmt.Errorf("store has no map location")
+	}
+
+	storeCoordinates, err := utils.ParseMapLocation(*store.MapLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	return FindRidersNear(ctx, db, *storeCoordinates, radiusKm)
+}
+
+// FindRidersNear returns the active, online riders of active delivery services that are within
+// radiusKm of a location and not already carrying an order or errand, nearest first.
+func FindRidersNear(ctx context.Context, db *mongo.Database, location utils.Coordinates, radiusKm float64) ([]Candidate, error) {
+
+	activeDeliveryServiceIds, err := db.Collection(utils.DELIVERY_SERVICE).Distinct(ctx, "_id", bson.M{"status": "active"})
+	if err != nil {
+		return nil, err
+	}
+
+	busyRiderIds, err := db.Collection(utils.ORDER).Distinct(ctx, "riderId", bson.M{
+		"status":  data.OrderStatusOngoing,
+		"riderId": bson.M{"$ne": nil},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	busyErrandRiderIds, err := db.Collection(utils.ERRAND).Distinct(ctx, "riderId", bson.M{
+		"status":  data.OrderStatusOngoing,
+		"riderId": bson.M{"$ne": nil},
+	})
+	if err != nil {
+		return nil, err
+	}
+	busyRiderIds = append(busyRiderIds, busyErrandRiderIds...)
+
+	cursor, err := db.Collection(utils.USER).Find(ctx, bson.M{
+		"type":              "rider",
+		"status":            "active",
+		"isOnline":          true,
+		"lastKnownLocation": bson.M{"$exists": true},
+		"deliveryService":   bson.M{"$in": activeDeliveryServiceIds},
+		"_id":               bson.M{"$nin": busyRiderIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var riders []data.User
+	if err := cursor.All(ctx, &riders); err != nil {
+		return nil, err
+	}
+
+	candidates := []Candidate{}
+	for _, rider := range riders {
+		riderCoordinates, err := utils.ParseMapLocation(*rider.LastKnownLocation)
+		if err != nil {
+			continue
+		}
+
+		distance := utils.DistanceInKm(location, *riderCoordinates)
+		if distance <= radiusKm {
+			candidates = append(candidates, Candidate{Rider: rider, DistanceKm: distance})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].DistanceKm < candidates[j].DistanceKm
+	})
+
+	return candidates, nil
+}
+
+// DispatchNextWave offers an order to the next group of riders once the previous wave's window
+// has passed. Riders who were already offered the order are skipped while there are fresh ones
+// to ask; riders who declined are never asked again. It returns ErrDispatchExhausted once the last
+// of DISPATCH_MAX_WAVES has run out, so the order can be escalated instead of offered forever.
+func DispatchNextWave(ctx context.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order) error {
+
+	settings := LoadSettings()
+	if order.DispatchWave >= settings.MaxWaves {
+		return ErrDispatchExhausted
+	}
+
+	orderCollection := db.Collection(utils.ORDER)
+	offerCollection := db.Collection(utils.DISPATCH_OFFER)
+
+	now := time.Now()
+	wave := order.DispatchWave + 1
+	waveExpiresAt := now.Add(settings.OfferWindow)
+
+	// Claim the wave so the worker and a request thread can't both send it.
+	claimFilter := bson.M{
+		"_id":                 order.ID,
+		"status":              data.OrderStatusOngoing,
+		"orderProgressStatus": data.OrderReceivedByVendor,
+		"riderId":             nil,
+		"$or": []bson.M{
+			{"dispatchWaveExpiresAt": bson.M{"$exists": false}},
+			{"dispatchWaveExpiresAt": bson.M{"$lte": now}},
+		},
+	}
+	if order.DispatchWave == 0 {
+		claimFilter["dispatchWave"] = bson.M{"$exists": false}
+	} else {
+		claimFilter["dispatchWave"] = order.DispatchWave
+	}
+
+	result, err := orderCollection.UpdateOne(ctx, claimFilter, bson.M{"$set": bson.M{
+		"dispatchWave":          wave,
+		"dispatchWaveExpiresAt": waveExpiresAt,
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return nil
+	}
+
+	order.DispatchWave = wave
+	order.DispatchWaveExpiresAt = &waveExpiresAt
+
+	if _, err := offerCollection.UpdateMany(ctx, bson.M{
+		"orderId":   order.ID,
+		"status":    "pending",
+		"expiresAt": bson.M{"$lte": now},
+	}, bson.M{"$set": bson.M{"status": "expired"}}); err != nil {
+		return err
+	}
+
+	var store data.Store
+	if err := db.Collection(utils.STORE).FindOne(ctx, bson.M{"_id": order.StoreID}).Decode(&store); err != nil {
+		return err
+	}
+
+	candidates, err := FindCandidateRiders(ctx, db, &store, settings.radiusForWave(wave))
+	if err != nil {
+		return err
+	}
+
+	cursor, err := offerCollection.Find(ctx, bson.M{"orderId": order.ID})
+	if err != nil {
+		return err
+	}
+	var previousOffers []data.DispatchOffer
+	if err := cursor.All(ctx, &previousOffers); err != nil {
+		return err
+	}
+
+	previousStatus := map[primitive.ObjectID]string{}
+	for _, offer := range previousOffers {
+		if previousStatus[offer.RiderID] != "declined" {
+			previousStatus[offer.RiderID] = offer.Status
+		}
+	}
+
+	var fresh, retry []Candidate
+	for _, candidate := range candidates {
+		switch previousStatus[candidate.Rider.ID] {
+		case "":
+			fresh = append(fresh, candidate)
+		case "expired":
+			retry = append(retry, candidate)
+		}
+	}
+
+	selected := fresh
+	if len(selected) == 0 {
+		selected = retry
+	}
+	if len(selected) > settings.WaveSize {
+		selected = selected[:settings.WaveSize]
+	}
+
+	if len(selected) == 0 {
+		slog.Info("No riders available for order", "orderId", order.ID.Hex(), "wave", wave)
+		return nil
+	}
+
+	for _, candidate := range selected {
+		offer := data.DispatchOffer{
+			ID:         primitive.NewObjectID(),
+			OrderID:    order.ID,
+			RiderID:    candidate.Rider.ID,
+			Wave:       wave,
+			DistanceKm: utils.RoundToKobo(candidate.DistanceKm),
+			Status:     "pending",
+			OfferedAt:  now,
+			ExpiresAt:  waveExpiresAt,
+		}
+
+		if _, err := offerCollection.InsertOne(ctx, offer); err != nil {
+			return err
+		}
+
+		utils.SendDispatchOfferNotificationToRider(ctx, db, fcm, candidate.Rider.ID, &offer)
+	}
+
+	slog.Info("Dispatched order to riders", "orderId", order.ID.Hex(), "wave", wave, "riders", len(selected))
+
+	return nil
+}
+
+// ProcessPendingDispatches sends the next wave for every order still waiting for a rider whose
+// current wave has run out. It returns the orders that have used up every wave without a rider.
+func ProcessPendingDispatches(ctx context.Context, db *mongo.Database, fcm *messaging.Client) []data.Order {
+
+	cursor, err := db.Collection(utils.ORDER).Find(ctx, bson.M{
+		"status":              data.OrderStatusOngoing,
+		"orderProgressStatus": data.OrderReceivedByVendor,
+		"riderId":             nil,
+		"$or": []bson.M{
+			{"dispatchWaveExpiresAt": bson.M{"$exists": false}},
+			{"dispatchWaveExpiresAt": bson.M{"$lte": time.Now()}},
+		},
+	})
+	if err != nil {
+		slog.Error("Failed to get orders awaiting riders", "error", err.Error())
+		return nil
+	}
+
+	var orders []data.Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		slog.Error("Failed to decode orders awaiting riders", "error", err.Error())
+		return nil
+	}
+
+	var exhausted []data.Order
+	for _, order := range orders {
+		err := DispatchNextWave(ctx, db, fcm, &order)
+		if err == ErrDispatchExhausted {
+			exhausted = append(exhausted, order)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to dispatch order", "orderId", order.ID.Hex(), "error", err.Error())
+		}
+	}
+
+	return exhausted
+}
+
+// FindActiveOffer returns the rider's pending, unexpired offer for an order.
+func FindActiveOffer(ctx context.Context, db *mongo.Database, orderId primitive.ObjectID, riderId primitive.ObjectID) (*data.DispatchOffer, error) {
+
+	var offer data.DispatchOffer
+	err := db.Collection(utils.DISPATCH_OFFER).FindOne(ctx, bson.M{
+		"orderId":   orderId,
+		"riderId":   riderId,
+		"status":    "pending",
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&offer)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNoActiveOffer
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &offer, nil
+}
+
+// CloseOffers marks the winning rider's offer as accepted and withdraws the rest.
+func CloseOffers(ctx context.Context, db *mongo.Database, orderId primitive.ObjectID, acceptedRiderId primitive.ObjectID) error {
+
+	offerCollection := db.Collection(utils.DISPATCH_OFFER)
+	now := time.Now()
+
+	if _, err := offerCollection.UpdateMany(ctx, bson.M{
+		"orderId": orderId,
+		"riderId": acceptedRiderId,
+		"status":  "pending",
+	}, bson.M{"$set": bson.M{"status": "accepted", "respondedAt": now}}); err != nil {
+		return err
+	}
+
+	_, err := offerCollection.UpdateMany(ctx, bson.M{
+		"orderId": orderId,
+		"status":  "pending",
+	}, bson.M{"$set": bson.M{"status": "withdrawn"}})
+
+	return err
+}
+
+type AvailabilityBody struct {
+	IsOnline *bool   `json:"isOnline"`
+	Location *string `json:"location"` // "lat,lng"
+}
+
+// UpdateRiderAvailability lets a rider go on or off duty and report where they are.
+func UpdateRiderAvailability(c *gin.Context, db *mongo.Database) {
+
+	var body AvailabilityBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	rider, ok := getRider(c, db)
+	if !ok {
+		return
+	}
+
+	update := bson.M{"lastSeenAt": time.Now()}
+
+	if body.IsOnline != nil {
+		update["isOnline"] = *body.IsOnline
+	}
+
+	if body.Location != nil {
+		if _, err := utils.ParseMapLocation(*body.Location); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		update["lastKnownLocation"] = *body.Location
+	}
+
+	if body.IsOnline != nil && *body.IsOnline && body.Location == nil && rider.LastKnownLocation == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "location is required to go online"})
+		return
+	}
+
+	if _, err := db.Collection(utils.USER).UpdateOne(c, bson.M{"_id": rider.ID}, bson.M{"$set": update}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update availability. " + err.Error()})
+		slog.Error("Failed to update rider availability", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "successfully updated availability"})
+
+}
+
+// GetMyOffers returns the rider's pending offers.
+func GetMyOffers(c *gin.Context, db *mongo.Database) {
+
+	rider, ok := getRider(c, db)
+	if !ok {
+		return
+	}
+
+	cursor, err := db.Collection(utils.DISPATCH_OFFER).Find(c, bson.M{
+		"riderId":   rider.ID,
+		"status":    "pending",
+		"expiresAt": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get offers. " + err.Error()})
+		return
+	}
+	defer cursor.Close(c)
+
+	offers := []data.DispatchOffer{}
+	if err := cursor.All(c, &offers); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode offers. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, offers)
+
+}
+
+// DeclineOffer lets a rider turn down an order they were offered.
+func DeclineOffer(c *gin.Context, db *mongo.Database) {
+
+	offerId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offer id. " + err.Error()})
+		return
+	}
+
+	rider, ok := getRider(c, db)
+	if !ok {
+		return
+	}
+
+	result, err := db.Collection(utils.DISPATCH_OFFER).UpdateOne(c, bson.M{
+		"_id":     offerId,
+		"riderId": rider.ID,
+		"status":  "pending",
+	}, bson.M{"$set": bson.M{"status": "declined", "respondedAt": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decline offer. " + err.Error()})
+		slog.Error("Failed to decline offer", "error", err.Error())
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no pending offer found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "successfully declined offer"})
+
+}
+
+type AcceptanceRate struct {
+	RiderID        primitive.ObjectID `bson:"_id" json:"riderId"`
+	Offered        int                `bson:"offered" json:"offered"`
+	Accepted       int                `bson:"accepted" json:"accepted"`
+	Declined       int                `bson:"declined" json:"declined"`
+	Expired        int                `bson:"expired" json:"expired"`
+	AcceptanceRate float64            `bson:"acceptanceRate" json:"acceptanceRate"`
+}
+
+// GetAcceptanceRates godoc
+// @Summary Get rider acceptance rates
+// @Description Get, per rider, how many dispatch offers were made and how they were answered. Withdrawn offers are left out.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param riderId query string false "Only this rider"
+// @Success 200 {array} AcceptanceRate
+// @Failure 400 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/dispatch/acceptanceRates [get]
+// @Security BearerAuth
+func GetAcceptanceRates(c *gin.Context, db *mongo.Database) {
+
+	match := bson.M{"status": bson.M{"$in": []string{"accepted", "declined", "expired"}}}
+
+	if riderIdStr := c.Query("riderId"); len(riderIdStr) > 0 {
+		riderId, err := primitive.ObjectIDFromHex(riderIdStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid riderId. " + err.Error()})
+			return
+		}
+		match["riderId"] = riderId
+	}
+
+	countOf := func(status string) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []string{"$status", status}}, 1, 0}}}
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id":      "$riderId",
+			"offered":  bson.M{"$sum": 1},
+			"accepted": countOf("accepted"),
+			"declined": countOf("declined"),
+			"expired":  countOf("expired"),
+		}},
+		{"$addFields": bson.M{
+			"acceptanceRate": bson.M{"$divide": []string{"$accepted", "$offered"}},
+		}},
+		{"$sort": bson.M{"acceptanceRate": -1}},
+	}
+
+	cursor, err := db.Collection(utils.DISPATCH_OFFER).Aggregate(c, pipeline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to aggregate offers. " + err.Error()})
+		slog.Error("Failed to aggregate offers", "error", err.Error())
+		return
+	}
+	defer cursor.Close(c)
+
+	rates := []AcceptanceRate{}
+	if err := cursor.All(c, &rates); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode acceptance rates. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rates)
+
+}
+
+func getRider(c *gin.Context, db *mongo.Database) (*data.User, bool) {
+
+	riderId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return nil, false
+	}
+
+	var rider data.User
+	if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": riderId}).Decode(&rider); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found. " + err.Error()})
+		return nil, false
+	}
+
+	if rider.Type != "rider" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only riders can do this"})
+		return nil, false
+	}
+
+	return &rider, true
+}
@@ -0,0 +1,151 @@
+package dispatch
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxClockSkew is how far in the future a fix's timestamp may be, to allow for phone clocks that run fast.
+const maxClockSkew = time.Minute
+
+type RiderLocationBody struct {
+	Latitude   *float64   `json:"latitude" binding:"required"`
+	Longitude  *float64   `json:"longitude" binding:"required"`
+	Accuracy   *float64   `json:"accuracy"` // metres
+	Speed      *float64   `json:"speed"`    // metres per second
+	Heading    *float64   `json:"heading"`  // degrees from north
+	RecordedAt *time.Time `json:"recordedAt"`
+}
+
+// RecordRiderLocation stores a GPS fix from a rider's app. The fix becomes the rider's last known
+// location and, when the rider is carrying an order, is pushed to anyone tracking that order.
+func RecordRiderLocation(c *gin.Context, db *mongo.Database) {
+
+	var body RiderLocationBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if *body.Latitude < -90 || *body.Latitude > 90 || *body.Longitude < -180 || *body.Longitude > 180 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "latitude must be between -90 and 90 and longitude between -180 and 180"})
+		return
+	}
+
+	if (body.Accuracy != nil && *body.Accuracy < 0) || (body.Speed != nil && *body.Speed < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "accuracy and speed cannot be negative"})
+		return
+	}
+
+	if body.Heading != nil && (*body.Heading < 0 || *body.Heading >= 360) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "heading must be between 0 and 360"})
+		return
+	}
+
+	now := time.Now()
+	recordedAt := now
+	if body.RecordedAt != nil {
+		recordedAt = *body.RecordedAt
+	}
+
+	if recordedAt.After(now.Add(maxClockSkew)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recordedAt cannot be in the future"})
+		return
+	}
+
+	if recordedAt.Before(now.Add(-utils.RiderLocationHistory())) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recordedAt is too old to be recorded"})
+		return
+	}
+
+	rider, ok := getRider(c, db)
+	if !ok {
+		return
+	}
+
+	var order *data.Order
+	var ongoing data.Order
+	err := db.Collection(utils.ORDER).FindOne(c, bson.M{
+		"riderId": rider.ID,
+		"status":  data.OrderStatusOngoing,
+	}).Decode(&ongoing)
+	if err == nil {
+		order = &ongoing
+	} else if err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get rider's order. " + err.Error()})
+		return
+	}
+
+	location := data.RiderLocation{
+		ID:         primitive.NewObjectID(),
+		RiderID:    rider.ID,
+		Location:   data.NewGeoPoint(*body.Latitude, *body.Longitude),
+		Accuracy:   body.Accuracy,
+		Speed:      body.Speed,
+		Heading:    body.Heading,
+		RecordedAt: recordedAt,
+		CreatedAt:  now,
+	}
+	if order != nil {
+		location.OrderID = &order.ID
+	}
+
+	if _, err := db.Collection(utils.RIDER_LOCATION).InsertOne(c, location); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record location. " + err.Error()})
+		slog.Error("Failed to record rider location", "riderId", rider.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	// Fixes can arrive out of order when a rider's app catches up after losing signal, so only a
+	// newer fix moves the rider's last known location.
+	if _, err := db.Collection(utils.USER).UpdateOne(c, bson.M{
+		"_id": rider.ID,
+		"$or": bson.A{
+			bson.M{"lastSeenAt": bson.M{"$exists": false}},
+			bson.M{"lastSeenAt": bson.M{"$lte": recordedAt}},
+		},
+	}, bson.M{"$set": bson.M{
+		"lastKnownLocation": formatMapLocation(*body.Latitude, *body.Longitude),
+		"lastSeenAt":        recordedAt,
+	}}); err != nil {
+		slog.Error("Failed to update rider's last known location", "riderId", rider.ID.Hex(), "error", err.Error())
+	}
+
+	if order != nil && utils.OrderEvents.HasSubscribers(order.ID) {
+		event := utils.RiderLocationEvent{
+			RiderID:   rider.ID,
+			Latitude:  *body.Latitude,
+			Longitude: *body.Longitude,
+		}
+
+		eta, err := utils.EstimateOrderETA(c, db, order, &location)
+		if err != nil {
+			slog.Error("Failed to estimate order ETA", "orderId", order.ID.Hex(), "error", err.Error())
+		}
+		event.ETA = eta
+
+		utils.OrderEvents.Publish(utils.OrderEvent{
+			Type:     utils.OrderEventRiderLocation,
+			OrderID:  order.ID,
+			Location: &event,
+			At:       recordedAt,
+		})
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "successfully recorded location"})
+
+}
+
+func formatMapLocation(lat float64, lng float64) string {
+	return strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lng, 'f', -1, 64)
+}
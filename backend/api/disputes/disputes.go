@@ -0,0 +1,630 @@
+package disputes
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"firebase.google.com/go/messaging"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxDisputeEvidence = 3
+
+var (
+	errAlreadyDisputed = errors.New("a complaint has already been raised on this order")
+	errDisputeNotOpen  = errors.New("dispute has already been resolved")
+)
+
+// How an admin settles a dispute.
+const (
+	ResolutionFullRefund    = "fullRefund"
+	ResolutionPartialRefund = "partialRefund"
+	ResolutionReject        = "reject"
+)
+
+type DisputedItemBody struct {
+	ItemID   primitive.ObjectID `json:"itemId"`
+	Quantity int                `json:"quantity"`
+}
+
+type OpenDisputeBody struct {
+	Reason      data.DisputeReason `json:"reason"` // missingItem, wrongItem, damagedItem, qualityIssue, other
+	Description string             `json:"description"`
+	Evidence    []string           `json:"evidence"` // base64 encoded images
+	Items       []DisputedItemBody `json:"items"`    // the affected line items and how many of each
+}
+
+type ResolveDisputeBody struct {
+	Resolution string   `json:"resolution"` // fullRefund, partialRefund, reject
+	Amount     *float64 `json:"amount"`     // partialRefund only, defaults to what the disputed items cost
+	Note       *string  `json:"note"`
+}
+
+type DisputeData struct {
+	data.Dispute `bson:",inline"`
+	Store        struct {
+		Name string `bson:"name" json:"name"`
+	} `bson:"store" json:"store"`
+	Customer struct {
+		FirstName   string `bson:"firstName" json:"firstName"`
+		PhoneNumber string `bson:"phoneNumber" json:"phoneNumber"`
+	} `bson:"customer" json:"customer"`
+}
+
+type DisputeDetails struct {
+	data.Dispute
+	Order data.Order `json:"order"`
+}
+
+// disputeWindow is how long after delivery a customer can complain about an order, set with DISPUTE_WINDOW_HOURS.
+func disputeWindow() time.Duration {
+	return time.Duration(utils.GetEnvInt("DISPUTE_WINDOW_HOURS", 48)) * time.Hour
+}
+
+// OpenDispute godoc
+// @Summary Complain about an order
+// @Description Raise a complaint about a completed order, such as a missing or wrong item, with photos and the affected line items. An order can have one complaint, raised within DISPUTE_WINDOW_HOURS of delivery
+// @Tags Disputes
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param dispute body OpenDisputeBody true "Complaint"
+// @Success 201 {object} data.Dispute
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/dispute [post]
+// @Security BearerAuth
+func OpenDispute(c *gin.Context, db *mongo.Database) {
+
+	var body OpenDisputeBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	body.Description = strings.TrimSpace(body.Description)
+
+	if !body.Reason.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be one of missingItem, wrongItem, damagedItem, qualityIssue or other"})
+		return
+	}
+
+	if body.Description == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "description cannot be empty"})
+		return
+	}
+
+	if len(body.Evidence) == 0 || len(body.Evidence) > maxDisputeEvidence {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "between 1 and " + strconv.Itoa(maxDisputeEvidence) + " photos are required as evidence"})
+		return
+	}
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	order, ok := getCustomerOrder(c, db, userId)
+	if !ok {
+		return
+	}
+
+	if order.CurrentStatus() != data.OrderStatusCompleted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only completed orders can be disputed"})
+		return
+	}
+
+	completedAt, err := orderCompletedAt(c, db, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order timeline. " + err.Error()})
+		return
+	}
+
+	if time.Since(completedAt) > disputeWindow() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "complaints can only be raised within " + strconv.Itoa(int(disputeWindow().Hours())) + " hours of delivery"})
+		return
+	}
+
+	items, claimedAmount, err := disputedItems(order, body.Items)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	disputeCollection := db.Collection(utils.DISPUTE)
+
+	// Checked up front as well so no photos are uploaded for a complaint that would be refused.
+	if count, err := disputeCollection.CountDocuments(c, bson.M{"orderId": order.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check for existing complaint. " + err.Error()})
+		return
+	} else if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": errAlreadyDisputed.Error()})
+		return
+	}
+
+	evidence := make([]string, 0, len(body.Evidence))
+	for _, image := range body.Evidence {
+		imageUrl, err := utils.UploadImage(image)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upload evidence. " + err.Error()})
+			return
+		}
+		evidence = append(evidence, imageUrl)
+	}
+
+	now := time.Now()
+	dispute := data.Dispute{
+		ID:            primitive.NewObjectID(),
+		OrderID:       order.ID,
+		CustomerID:    order.CustomerID,
+		StoreID:       order.StoreID,
+		Reason:        body.Reason,
+		Description:   body.Description,
+		Evidence:      evidence,
+		Items:         items,
+		ClaimedAmount: claimedAmount,
+		Status:        data.DisputeOpen,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	result, err := disputeCollection.UpdateOne(c, bson.M{"orderId": order.ID}, bson.M{"$setOnInsert": dispute}, options.Update().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to raise complaint. " + err.Error()})
+		slog.Error("Failed to raise complaint", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	if result.UpsertedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": errAlreadyDisputed.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, dispute)
+
+}
+
+// GetOrderDispute godoc
+// @Summary Get the complaint on an order
+// @Description Get the complaint the customer raised on their order and how it was resolved
+// @Tags Disputes
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {object} data.Dispute
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Router /orders/{id}/dispute [get]
+// @Security BearerAuth
+func GetOrderDispute(c *gin.Context, db *mongo.Database) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	order, ok := getCustomerOrder(c, db, userId)
+	if !ok {
+		return
+	}
+
+	var dispute data.Dispute
+	if err := db.Collection(utils.DISPUTE).FindOne(c, bson.M{"orderId": order.ID}).Decode(&dispute); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no complaint has been raised on this order. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, dispute)
+
+}
+
+// GetDisputes godoc
+// @Summary Get disputes
+// @Description Get customer complaints, 20 per page, optionally filtered by status. Open disputes come oldest first so they can be worked through as a queue; the rest newest first
+// @Tags Admin
+// @Produce json
+// @Param status query string false "open, resolved or rejected"
+// @Param page query int false "Page number, starting at 1"
+// @Success 200 {object} object{data=[]DisputeData,page=int,pageSize=int,totalCount=int}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/disputes [get]
+// @Security BearerAuth
+func GetDisputes(c *gin.Context, db *mongo.Database) {
+
+	const pageSize int64 = 20
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	skip := (page - 1) * pageSize
+
+	match := bson.M{}
+	sortOrder := -1
+	if status := c.Query("status"); len(status) > 0 {
+		match["status"] = status
+		if data.DisputeStatus(status) == data.DisputeOpen {
+			sortOrder = 1
+		}
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$sort": bson.M{"createdAt": sortOrder}},
+		{"$facet": bson.M{
+			"data": []bson.M{
+				{"$skip": skip},
+				{"$limit": pageSize},
+				{"$lookup": bson.M{
+					"from":         utils.STORE,
+					"localField":   "storeId",
+					"foreignField": "_id",
+					"as":           "store",
+				}},
+				{"$unwind": bson.M{"path": "$store", "preserveNullAndEmptyArrays": true}},
+				{"$lookup": bson.M{
+					"from":         utils.USER,
+					"localField":   "customerId",
+					"foreignField": "_id",
+					"as":           "customer",
+				}},
+				{"$unwind": bson.M{"path": "$customer", "preserveNullAndEmptyArrays": true}},
+				{"$addFields": bson.M{
+					"store": bson.M{
+						"name": "$store.name",
+					},
+					"customer": bson.M{
+						"firstName":   "$customer.firstName",
+						"phoneNumber": "$customer.phoneNumber",
+					},
+				}},
+			},
+			"totalCount": []bson.M{
+				{"$count": "count"},
+			},
+		}},
+	}
+
+	cursor, err := db.Collection(utils.DISPUTE).Aggregate(c, pipeline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get disputes. " + err.Error()})
+		slog.Error("Failed to get disputes", "error", err.Error())
+		return
+	}
+	defer cursor.Close(c)
+
+	var result struct {
+		Data       []DisputeData `bson:"data"`
+		TotalCount []struct {
+			Count int64 `bson:"count"`
+		} `bson:"totalCount"`
+	}
+
+	if cursor.Next(c) {
+		if err := cursor.Decode(&result); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode disputes. " + err.Error()})
+			slog.Error("Failed to decode disputes", "error", err.Error())
+			return
+		}
+	}
+
+	if result.Data == nil {
+		result.Data = []DisputeData{}
+	}
+
+	var total int64
+	if len(result.TotalCount) > 0 {
+		total = result.TotalCount[0].Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": result.Data, "page": page, "pageSize": pageSize, "totalCount": total})
+
+}
+
+// GetDispute godoc
+// @Summary Get a dispute
+// @Description Get a customer complaint with the order it is about
+// @Tags Admin
+// @Produce json
+// @Param id path string true "Dispute ID"
+// @Success 200 {object} DisputeDetails
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Router /admin/disputes/{id} [get]
+// @Security BearerAuth
+func GetDispute(c *gin.Context, db *mongo.Database) {
+
+	dispute, ok := getDispute(c, db)
+	if !ok {
+		return
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": dispute.OrderID}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, DisputeDetails{Dispute: *dispute, Order: order})
+
+}
+
+// ResolveDispute godoc
+// @Summary Resolve a dispute
+// @Description Settle a customer complaint. A full or partial refund is paid into the customer's wallet and taken out of the store's share of the order; anything beyond the store's share, such as the delivery fee on a full refund, is covered by Boiboi. Rejecting closes the complaint without a refund
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Dispute ID"
+// @Param resolution body ResolveDisputeBody true "Resolution"
+// @Success 200 {object} data.Dispute
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/disputes/{id}/resolve [patch]
+// @Security BearerAuth
+func ResolveDispute(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	var body ResolveDisputeBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if body.Resolution != ResolutionFullRefund && body.Resolution != ResolutionPartialRefund && body.Resolution != ResolutionReject {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resolution must be fullRefund, partialRefund or reject"})
+		return
+	}
+
+	dispute, ok := getDispute(c, db)
+	if !ok {
+		return
+	}
+
+	if dispute.Status != data.DisputeOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": errDisputeNotOpen.Error()})
+		return
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": dispute.OrderID}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	// The rider's tip was earned on the delivery, so it is never part of a refund.
+	refundable := utils.RoundToKobo(order.Price - order.CheckoutTip())
+
+	status := data.DisputeRejected
+	refundAmount := 0.0
+	switch body.Resolution {
+	case ResolutionFullRefund:
+		status = data.DisputeResolved
+		refundAmount = refundable
+	case ResolutionPartialRefund:
+		status = data.DisputeResolved
+		refundAmount = dispute.ClaimedAmount
+		if body.Amount != nil {
+			refundAmount = utils.RoundToKobo(*body.Amount)
+		}
+		if refundAmount <= 0 || refundAmount > refundable {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be more than 0 and no more than the order's price of " + strconv.FormatFloat(refundable, 'f', 2, 64)})
+			return
+		}
+	}
+
+	storeShare, _, _ := utils.OrderPayoutSplit(&order)
+	storeDebit := utils.RoundToKobo(math.Min(refundAmount, storeShare))
+	platformDebit := utils.RoundToKobo(refundAmount - storeDebit)
+
+	now := time.Now()
+	set := bson.M{
+		"status":     status,
+		"resolvedAt": now,
+		"updatedAt":  now,
+	}
+	if body.Note != nil {
+		set["resolutionNote"] = strings.TrimSpace(*body.Note)
+	}
+	if refundAmount > 0 {
+		set["refundAmount"] = refundAmount
+		set["storeDebit"] = storeDebit
+	}
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start db transaction session. " + err.Error()})
+		return
+	}
+	defer session.EndSession(c)
+
+	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		result, err := db.Collection(utils.DISPUTE).UpdateOne(sessCtx, bson.M{"_id": dispute.ID, "status": data.DisputeOpen}, bson.M{"$set": set})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, errDisputeNotOpen
+		}
+
+		if refundAmount == 0 {
+			return nil, nil
+		}
+
+		if err := utils.CreditCustomerWallet(sessCtx, db, order.CustomerID, order.ID, refundAmount, "order complaint refund"); err != nil {
+			return nil, err
+		}
+
+		if storeDebit > 0 {
+			if err := utils.DebitStore(sessCtx, db, order.StoreID, order.ID, storeDebit, "order complaint refund"); err != nil {
+				return nil, err
+			}
+		}
+
+		if platformDebit > 0 {
+			if err := utils.CreditPlatform(sessCtx, db, -platformDebit); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+	if errors.Is(err, errDisputeNotOpen) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve dispute. " + err.Error()})
+		slog.Error("Failed to resolve dispute", "disputeId", dispute.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	dispute.Status = status
+	dispute.ResolvedAt = &now
+	dispute.UpdatedAt = now
+	if note, ok := set["resolutionNote"].(string); ok {
+		dispute.ResolutionNote = &note
+	}
+	if refundAmount > 0 {
+		dispute.RefundAmount = &refundAmount
+		dispute.StoreDebit = &storeDebit
+	}
+
+	utils.SendDisputeResolvedNotificationToCustomer(c, db, fcm, dispute)
+
+	c.JSON(http.StatusOK, dispute)
+
+}
+
+// getCustomerOrder loads the order in the path and checks it was placed by the user.
+func getCustomerOrder(c *gin.Context, db *mongo.Database, userId primitive.ObjectID) (*data.Order, bool) {
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return nil, false
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return nil, false
+	}
+
+	if order.CustomerID != userId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "order does not belong to user"})
+		return nil, false
+	}
+
+	return &order, true
+}
+
+func getDispute(c *gin.Context, db *mongo.Database) (*data.Dispute, bool) {
+
+	disputeId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dispute id. " + err.Error()})
+		return nil, false
+	}
+
+	var dispute data.Dispute
+	if err := db.Collection(utils.DISPUTE).FindOne(c, bson.M{"_id": disputeId}).Decode(&dispute); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dispute not found. " + err.Error()})
+		return nil, false
+	}
+
+	return &dispute, true
+}
+
+// orderCompletedAt returns when the order was delivered, from its timeline. Orders completed before
+// the timeline was recorded fall back to when they were last updated or created.
+func orderCompletedAt(c *gin.Context, db *mongo.Database, order *data.Order) (time.Time, error) {
+
+	var entry data.OrderTimelineEntry
+	err := db.Collection(utils.ORDER_TIMELINE).FindOne(c, bson.M{
+		"orderId": order.ID,
+		"status":  data.OrderStatusCompleted,
+	}).Decode(&entry)
+	if err == nil {
+		return entry.CreatedAt, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return time.Time{}, err
+	}
+
+	if order.UpdatedAt != nil {
+		return *order.UpdatedAt, nil
+	}
+	if order.CreatedAt != nil {
+		return *order.CreatedAt, nil
+	}
+	return time.Now(), nil
+}
+
+// disputedItems checks the items a customer is complaining about against the order's line items
+// and works out what they cost. Orders placed before line items were recorded can't name items.
+func disputedItems(order *data.Order, body []DisputedItemBody) ([]data.DisputedItem, float64, error) {
+
+	items := []data.DisputedItem{}
+
+	if len(order.LineItems) == 0 {
+		if len(body) > 0 {
+			return nil, 0, errors.New("items can't be picked on this order, describe the problem instead")
+		}
+		return items, 0, nil
+	}
+
+	if len(body) == 0 {
+		return nil, 0, errors.New("at least one affected item is required")
+	}
+
+	lineItems := make(map[primitive.ObjectID]data.OrderLineItem, len(order.LineItems))
+	for _, lineItem := range order.LineItems {
+		lineItems[lineItem.ItemID] = lineItem
+	}
+
+	claimedAmount := 0.0
+	seen := map[primitive.ObjectID]bool{}
+	for _, disputed := range body {
+		lineItem, ok := lineItems[disputed.ItemID]
+		if !ok {
+			return nil, 0, errors.New("item " + disputed.ItemID.Hex() + " is not part of this order")
+		}
+		if seen[disputed.ItemID] {
+			return nil, 0, errors.New("item " + disputed.ItemID.Hex() + " is listed more than once")
+		}
+		seen[disputed.ItemID] = true
+
+		if disputed.Quantity < 1 || disputed.Quantity > lineItem.Quantity {
+			return nil, 0, errors.New("quantity of " + lineItem.Name + " must be between 1 and " + strconv.Itoa(lineItem.Quantity))
+		}
+
+		items = append(items, data.DisputedItem{
+			ItemID:    lineItem.ItemID,
+			Name:      lineItem.Name,
+			UnitPrice: lineItem.UnitPrice,
+			Quantity:  disputed.Quantity,
+		})
+		claimedAmount += lineItem.UnitPrice * float64(disputed.Quantity)
+	}
+
+	return items, utils.RoundToKobo(claimedAmount), nil
+}
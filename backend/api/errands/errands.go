@@ -1,16 +1,20 @@
 package errands
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"math"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"useboi-boi/backend/api/dispatch"
+	"useboi-boi/backend/api/orders"
+	"useboi-boi/backend/api/payments"
 	"useboi-boi/backend/internal/data"
 	"useboi-boi/backend/utils"
 
@@ -21,628 +25,911 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// priceTolerance is how far the client's total may drift from ours before we reject it.
+const priceTolerance = 0.01
+
+var (
+	ErrErrandNotOngoing = errors.New("errand is no longer ongoing")
+	ErrErrandClaimed    = errors.New("errand has already been accepted by a rider")
+)
+
 type ErrandCheckoutBody struct {
-	TotalPrice          float64  `json:"totalPrice"`
-	CartId              string   `json:"cartId"`
-	StoreId             string   `json:"storeId"`
-	IsErrand            bool     `json:"isErrand"`
-	DeliveryLocation    *string  `json:"deliveryLocation"`
-	DeliveryFee         float64  `json:"deliveryFee"`
-	Code                int      `json:"code"`
-	CouponPrice         *float64 `json:"couponPrice"`
-	DeliveryMapLocation *string  `json:"deliveryMapLocation"`
-	DeliveryInstruction *string  `json:"deliveryInstruction"`
-	CheckoutType        string   `json:"checkoutType"` // card, wallet
-	CardId              *float64 `json:"cardId"`
+	PickupAddress      string   `json:"pickupAddress"`
+	PickupMapLocation  string   `json:"pickupMapLocation"`
+	DropoffAddress     string   `json:"dropoffAddress"`
+	DropoffMapLocation string   `json:"dropoffMapLocation"`
+	Tasks              []string `json:"tasks"`
+	Instructions       *string  `json:"instructions"`
+	EstimatedBudget    float64  `json:"estimatedBudget"`
+	TotalPrice         float64  `json:"totalPrice"`
+	CheckoutType       string   `json:"checkoutType"` // card, wallet
+	CardId             *float64 `json:"cardId"`
+}
+
+type ErrandProgressBody struct {
+	ProgressStatus data.ErrandProgressStatus `json:"progressStatus"`
 }
 
+type ErrandSpendBody struct {
+	ActualSpend  *float64 `json:"actualSpend"`
+	ReceiptImage string   `json:"receiptImage"` // base64 encoded
+}
+
+// Checkout godoc
+// @Summary Request an errand
+// @Description Pay for an errand up front: the estimated budget plus the delivery fee between the pickup and drop-off locations
+// @Tags Errands
+// @Accept json
+// @Produce json
+// @Param errand body ErrandCheckoutBody true "Errand details"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /errands/checkout [post]
+// @Security BearerAuth
 func Checkout(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
 	var checkoutBody ErrandCheckoutBody
 	if err := c.ShouldBindJSON(&checkoutBody); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad request " + err.Error()})
 		return
 	}
 
-	if len(checkoutBody.CartId) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "cartId cannot be empty"})
-		return
-	}
-
-	if len(checkoutBody.StoreId) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "cartId cannot be empty"})
-		return
-	}
-
-	if checkoutBody.IsErrand {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order expected, errand payload sent"})
-		return
-	}
-
-	if checkoutBody.CheckoutType == "card" {
-		CheckoutFromCard(c, db, &checkoutBody, fcm)
-	} else if checkoutBody.CheckoutType == "wallet" {
-		CheckoutFromWallet(c, db, &checkoutBody, fcm)
-	} else {
+	if checkoutBody.CheckoutType != "card" && checkoutBody.CheckoutType != "wallet" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad request. invalid checkout type"})
 		return
 	}
 
-}
-
-func CheckoutFromWallet(c *gin.Context, db *mongo.Database, checkoutBody *ErrandCheckoutBody, fcm *messaging.Client) {
-
-	userId, ok := c.Get("userId")
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "userId not found"})
+	userObjectId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "cannot create objectId from userId " + err.Error()})
 		return
 	}
 
-	userObjectId, err := primitive.ObjectIDFromHex(userId.(string))
+	errand, err := newErrand(c, db, &checkoutBody, userObjectId)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "cannot create objectId from userId " + err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	userCollection := db.Collection(utils.USER)
-	walletTransactionCollection := db.Collection(utils.WALLET_TRANSACTIONS)
-
-	var user data.User
-	result := userCollection.FindOne(c, bson.M{"_id": userObjectId})
-	result.Decode(&user)
-
-	if user.ID.IsZero() {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "empty user object"})
+	if math.Abs(errand.Price-checkoutBody.TotalPrice) > priceTolerance {
+		c.JSON(http.StatusConflict, gin.H{"error": "price has changed, please review your errand", "totalPrice": errand.Price, "deliveryFee": errand.DeliveryFee})
 		return
 	}
 
-	if user.VirtualBankAccount == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no wallet created for user"})
+	var user data.User
+	if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": userObjectId}).Decode(&user); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "failed to decode user object"})
 		return
 	}
 
-	walletBalance := user.VirtualBankAccount.Balance
+	if checkoutBody.CheckoutType == "wallet" {
+		if user.VirtualBankAccount == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no wallet created for user"})
+			return
+		}
 
-	if walletBalance-checkoutBody.TotalPrice < 100 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient amount in wallet. Wallet balance cannot be less than 100 after checkout"})
-		return
-	}
+		if user.VirtualBankAccount.Balance-errand.Price < 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient amount in wallet. Wallet balance cannot be less than 100 after checkout"})
+			return
+		}
 
-	paymentReference := utils.GeneratePaymentReference()
-	order, err := CreateOrder(c, db, checkoutBody, &paymentReference)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order " + err.Error()})
-		return
-	}
+		paymentReference := utils.GeneratePaymentReference()
+		errand.PaymentReference = &paymentReference
 
-	transaction := data.WalletTransactions{
-		ID:                   primitive.NewObjectID(),
-		PaymentTransactionId: paymentReference,
-		UserId:               userObjectId,
-		Amount:               checkoutBody.TotalPrice,
-		Type:                 "debit",
-		CreatedAt:            time.Now(),
-	}
+		if err := createErrand(c, db, errand); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create errand " + err.Error()})
+			return
+		}
+	} else {
+		if checkoutBody.CardId == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cardId cannot be empty"})
+			return
+		}
 
-	_, err = walletTransactionCollection.InsertOne(c, transaction)
-	if err != nil {
-		slog.Info("unable to create transaction", "error", err.Error())
+		var selectedCard *data.Card
+		for _, card := range user.Cards {
+			if card.ID == *checkoutBody.CardId {
+				selectedCard = &card
+				break
+			}
+		}
+
+		if selectedCard == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "selected card doesn't exist"})
+			return
+		}
+
+		reference, err := payments.ChargeAuthorization(user.Email, selectedCard.AuthorizationCode, errand.Price)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed checkout payment. " + err.Error()})
+			return
+		}
+		errand.PaymentReference = &reference
+
+		if err := createErrand(c, db, errand); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create errand " + err.Error()})
+
+			refund := payments.NewCardRefund(userObjectId, nil, reference, errand.Price)
+			if _, err := db.Collection(utils.REFUND).InsertOne(c, refund); err != nil {
+				slog.Error("Failed to record refund for failed errand checkout", "reference", reference, "error", err.Error())
+				return
+			}
+			if err := payments.RequestRefund(c, db, &refund); err != nil {
+				slog.Error("Failed to refund failed errand checkout", "reference", reference, "refundId", refund.ID.Hex(), "error", err.Error())
+			}
+			return
+		}
 	}
 
-	c.JSON(http.StatusOK, *order)
+	c.JSON(http.StatusOK, *errand)
 
 	utils.SendSuccessfulOrderNotificationToCustomer(c, db, fcm, &user)
-	utils.SendNewOrderNotificationToRiders(c, db, fcm)
-	utils.SendNewOrderNotificationToMerchant(c, db, fcm, order)
+	notifyNearbyRiders(c, db, fcm, errand)
 
 }
 
-func CheckoutFromCard(c *gin.Context, db *mongo.Database, checkoutBody *ErrandCheckoutBody, fcm *messaging.Client) {
+// notifyNearbyRiders tells the riders dispatch would offer a store order to, the idle online riders
+// of active delivery services within DISPATCH_MAX_RADIUS_KM of the pickup, about a new errand.
+func notifyNearbyRiders(ctx context.Context, db *mongo.Database, fcm *messaging.Client, errand *data.Errand) {
 
-	if checkoutBody.CardId == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "cardId cannot be empty"})
-		return
-	}
-
-	userId, ok := c.Get("userId")
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "userId not found"})
+	pickupCoordinates, err := utils.ParseMapLocation(errand.PickupMapLocation)
+	if err != nil {
+		slog.Error("Failed to parse errand pickup location", "errandId", errand.ID.Hex(), "error", err.Error())
 		return
 	}
 
-	userObjectId, err := primitive.ObjectIDFromHex(userId.(string))
+	candidates, err := dispatch.FindRidersNear(ctx, db, *pickupCoordinates, dispatch.LoadSettings().MaxRadiusKm)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "userId not found"})
+		slog.Error("Failed to find riders for errand", "errandId", errand.ID.Hex(), "error", err.Error())
 		return
 	}
 
-	userCollection := db.Collection(utils.USER)
-
-	var user data.User
-	result := userCollection.FindOne(c, bson.M{"_id": userObjectId})
-	if err := result.Decode(&user); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "failed to decode user object"})
-		return
+	riderIds := make([]primitive.ObjectID, 0, len(candidates))
+	for _, candidate := range candidates {
+		riderIds = append(riderIds, candidate.Rider.ID)
 	}
 
-	cardId := checkoutBody.CardId
-	var selectedCard *data.Card
+	utils.SendNewErrandNotificationToRiders(ctx, db, fcm, riderIds, errand)
+}
 
-	for _, c := range user.Cards {
-		if c.ID == *cardId {
-			selectedCard = &c
-			break
-		}
+// newErrand validates the checkout body and prices the errand. The delivery fee comes from the
+// same distance bands as store orders, measured from the pickup to the drop-off location.
+func newErrand(c *gin.Context, db *mongo.Database, checkoutBody *ErrandCheckoutBody, customerId primitive.ObjectID) (*data.Errand, error) {
+
+	pickupAddress := strings.TrimSpace(checkoutBody.PickupAddress)
+	dropoffAddress := strings.TrimSpace(checkoutBody.DropoffAddress)
+	if pickupAddress == "" || dropoffAddress == "" {
+		return nil, fmt.Errorf("pickupAddress and dropoffAddress cannot be empty")
 	}
 
-	if selectedCard == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "selected card doesn't exist"})
-		return
+	pickupCoordinates, err := utils.ParseMapLocation(checkoutBody.PickupMapLocation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pickupMapLocation. " + err.Error())
 	}
 
-	cardAuthCode := selectedCard.AuthorizationCode
+	dropoffCoordinates, err := utils.ParseMapLocation(checkoutBody.DropoffMapLocation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dropoffMapLocation. " + err.Error())
+	}
 
-	chargeRequestBody := map[string]interface{}{
-		"email":              user.Email,
-		"amount":             strconv.FormatFloat(checkoutBody.TotalPrice*100, 'f', 2, 64),
-		"authorization_code": cardAuthCode,
-		"metadata": map[string]interface{}{
-			"type": "card",
-		},
+	var tasks []string
+	for _, task := range checkoutBody.Tasks {
+		if task = strings.TrimSpace(task); task != "" {
+			tasks = append(tasks, task)
+		}
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("tasks cannot be empty")
 	}
 
-	url := "https://api.paystack.co/transaction/charge_authorization"
-	apiKey := os.Getenv("PAYSTACK_SECRET_KEY")
+	if checkoutBody.EstimatedBudget < 0 {
+		return nil, fmt.Errorf("estimatedBudget cannot be negative")
+	}
 
-	payload, err := json.Marshal(chargeRequestBody)
+	deliveryFee, err := orders.DeliveryFeeBetween(c, db, *pickupCoordinates, *dropoffCoordinates)
+	if errors.Is(err, orders.ErrOutOfDeliveryRange) {
+		return nil, fmt.Errorf("drop-off location is too far from the pickup location")
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode request"})
-		return
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	deliveryCode, err := utils.GenerateDeliveryCode()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
-		return
+		return nil, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	req.Header.Set("Content-Type", "application/json")
+	status := data.OrderStatusOngoing
+	progressStatus := data.ErrandCreated
+	now := time.Now()
+
+	return &data.Errand{
+		ID:                 primitive.NewObjectID(),
+		CustomerID:         customerId,
+		PickupAddress:      pickupAddress,
+		PickupMapLocation:  checkoutBody.PickupMapLocation,
+		DropoffAddress:     dropoffAddress,
+		DropoffMapLocation: checkoutBody.DropoffMapLocation,
+		Tasks:              tasks,
+		Instructions:       checkoutBody.Instructions,
+		EstimatedBudget:    checkoutBody.EstimatedBudget,
+		DeliveryFee:        deliveryFee,
+		Price:              checkoutBody.EstimatedBudget + deliveryFee,
+		Code:               deliveryCode,
+		Status:             &status,
+		ProgressStatus:     &progressStatus,
+		PaymentMethod:      checkoutBody.CheckoutType,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}, nil
+}
+
+// createErrand saves a paid-for errand, taking the price out of the customer's wallet in the same
+// transaction for wallet payments.
+func createErrand(c *gin.Context, db *mongo.Database, errand *data.Errand) error {
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	session, err := db.Client().StartSession()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to make request"})
-		return
+		return err
 	}
-	defer resp.Body.Close()
+	defer session.EndSession(c)
+
+	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		if errand.PaymentMethod == "wallet" {
+			result, err := db.Collection(utils.USER).UpdateOne(sessCtx, bson.M{
+				"_id":                        errand.CustomerID,
+				"virtualBankAccount.balance": bson.M{"$gte": errand.Price + 100},
+			}, bson.M{
+				"$inc": bson.M{"virtualBankAccount.balance": -errand.Price},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if result.MatchedCount == 0 {
+				return nil, fmt.Errorf("insufficient amount in wallet")
+			}
+
+			if _, err := db.Collection(utils.WALLET_TRANSACTIONS).InsertOne(sessCtx, data.WalletTransactions{
+				ID:                   primitive.NewObjectID(),
+				PaymentTransactionId: *errand.PaymentReference,
+				UserId:               errand.CustomerID,
+				Amount:               errand.Price,
+				Type:                 "debit",
+				OrderID:              &errand.ID,
+				CreatedAt:            time.Now(),
+			}); err != nil {
+				return nil, err
+			}
+		}
 
-	body, err := io.ReadAll(resp.Body)
+		_, err := db.Collection(utils.ERRAND).InsertOne(sessCtx, errand)
+		return nil, err
+	})
+
+	return err
+}
+
+// GetErrands godoc
+// @Summary Get errands
+// @Description Get the errands the user requested or is running, newest first. Riders can pass available=true to see errands waiting for a rider.
+// @Tags Errands
+// @Accept json
+// @Produce json
+// @Param available query bool false "Only errands waiting for a rider"
+// @Param status query string false "ongoing, completed or cancelled"
+// @Param page query int false "Page number" default(1)
+// @Success 200 {object} object{data=[]data.Errand,page=int,pageSize=int,totalCount=int}
+// @Failure 400 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /errands [get]
+// @Security BearerAuth
+func GetErrands(c *gin.Context, db *mongo.Database) {
+
+	userId := c.GetString("userId")
+	userObjectId, err := primitive.ObjectIDFromHex(userId)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request"})
 		return
 	}
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+	filter := bson.M{"$or": []bson.M{{"customerId": userObjectId}, {"riderId": userObjectId}}}
 
-		var responseData map[string]interface{}
-		if err := json.Unmarshal(body, &responseData); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unmarshaling JSON into map"})
+	if c.Query("available") == "true" {
+		var user data.User
+		if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": userObjectId}).Decode(&user); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
 			return
 		}
 
-		status := responseData["data"].(map[string]interface{})["status"].(string)
-		gatewayResponse := responseData["data"].(map[string]interface{})["gateway_response"].(string)
-		reference := responseData["data"].(map[string]interface{})["reference"].(string)
-
-		if status != "success" && gatewayResponse != "Approved" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed chackout payment"})
+		if user.Type != "rider" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only riders can see available errands"})
 			return
 		}
 
-		order, err := CreateOrder(c, db, checkoutBody, &reference)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order " + err.Error()})
-			return
-		}
+		filter = bson.M{"status": data.OrderStatusOngoing, "progressStatus": data.ErrandCreated, "riderId": nil}
+	} else if status := c.Query("status"); len(status) > 0 {
+		filter["status"] = status
+	}
 
-		c.JSON(http.StatusOK, *order)
+	const pageSize int64 = 20
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	skip := (page - 1) * pageSize
 
-		utils.SendSuccessfulOrderNotificationToCustomer(c, db, fcm, &user)
-		utils.SendNewOrderNotificationToRiders(c, db, fcm)
-		utils.SendNewOrderNotificationToMerchant(c, db, fcm, order)
+	pipeline := []bson.M{
+		{"$match": filter},
+		{"$sort": bson.M{"createdAt": -1}},
+		{"$facet": bson.M{
+			"data": []bson.M{
+				{"$skip": skip},
+				{"$limit": pageSize},
+			},
+			"totalCount": []bson.M{
+				{"$count": "count"},
+			},
+		}},
+	}
 
+	cursor, err := db.Collection(utils.ERRAND).Aggregate(c, pipeline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get errands. " + err.Error()})
+		slog.Error("Failed to get errands", "error", err.Error())
 		return
+	}
+	defer cursor.Close(c)
 
-	} else {
-		var errorResponse map[string]interface{}
-		jsonErr := json.Unmarshal(body, &errorResponse)
-		if jsonErr != nil {
-			fmt.Println("Error unmarshaling error response:", jsonErr)
-			fmt.Println("Raw body:", string(body))
-			c.JSON(http.StatusInternalServerError, errorResponse)
+	var result struct {
+		Data       []data.Errand `bson:"data"`
+		TotalCount []struct {
+			Count int64 `bson:"count"`
+		} `bson:"totalCount"`
+	}
+
+	if cursor.Next(c) {
+		if err := cursor.Decode(&result); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode errands. " + err.Error()})
+			slog.Error("Failed to decode errands", "error", err.Error())
 			return
 		}
-		c.JSON(http.StatusInternalServerError, errorResponse)
-		return
 	}
 
-}
+	var total int64
+	if len(result.TotalCount) > 0 {
+		total = result.TotalCount[0].Count
+	}
+
+	if result.Data == nil {
+		result.Data = []data.Errand{}
+	}
+	for i := range result.Data {
+		result.Data[i].HideCodeFrom(userId)
+	}
 
-func CreateOrder(c *gin.Context, db *mongo.Database, checkoutBody *ErrandCheckoutBody, paymentReferenceId *string) (*data.Order, error) {
+	c.JSON(http.StatusOK, gin.H{"data": result.Data, "page": page, "pageSize": pageSize, "totalCount": total})
 
-	var orderToCreate *data.Order
+}
 
-	userId, ok := c.Get("userId")
+// GetErrand godoc
+// @Summary Get an errand
+// @Description Get an errand. Only its customer and rider can see it, and any rider while it is waiting for one.
+// @Tags Errands
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Router /errands/{id} [get]
+// @Security BearerAuth
+func GetErrand(c *gin.Context, db *mongo.Database) {
+
+	errand, ok := getErrand(c, db)
 	if !ok {
-		return nil, fmt.Errorf("UserId not found")
+		return
 	}
 
-	userObjectId, err := primitive.ObjectIDFromHex(userId.(string))
+	actorRole, actorId, err := resolveErrandActor(c, db, errand)
 	if err != nil {
-		return nil, err
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
 	}
 
-	orderTransactionCollection := db.Collection(utils.ORDER_TRANSACTIONS)
-	orderCollection := db.Collection(utils.ORDER)
-	cartCollection := db.Collection(utils.CART)
-	userCollection := db.Collection(utils.USER)
-
-	session, err := db.Client().StartSession()
-	if err != nil {
-		slog.Info("payment", "Failed to start db transaction session", err.Error())
-		return nil, err
+	if actorRole == data.ActorRider && !isAssignedRider(errand, *actorId) && errand.RiderID != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "errand is not assigned to you"})
+		return
 	}
-	defer session.EndSession(c)
 
-	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+	errand.HideCodeFrom(actorId.Hex())
+	c.JSON(http.StatusOK, errand)
 
-		var user data.User
-		result := userCollection.FindOne(c, bson.M{"_id": userObjectId})
-		err := result.Decode(&user)
-		if err != nil {
-			return nil, err
-		}
+}
 
-		if user.ID.IsZero() {
-			return nil, fmt.Errorf("valid user not found")
-		}
+// UpdateErrandProgress godoc
+// @Summary Update errand progress
+// @Description Move an errand to its next progress status. Moving it to errandReceivedByRider claims it for the rider.
+// @Tags Errands
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Param progress body ErrandProgressBody true "Next progress status"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Router /errands/{id}/progress [patch]
+// @Security BearerAuth
+func UpdateErrandProgress(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	var body ErrandProgressBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "error binding json " + err.Error()})
+		return
+	}
 
-		virtualAccount := user.VirtualBankAccount
+	if !body.ProgressStatus.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid progressStatus"})
+		return
+	}
 
-		cartId, err := primitive.ObjectIDFromHex(checkoutBody.CartId)
-		if err != nil {
-			return nil, err
-		}
-		storeId, err := primitive.ObjectIDFromHex(checkoutBody.StoreId)
-		if err != nil {
-			return nil, err
-		}
+	errand, ok := getErrand(c, db)
+	if !ok {
+		return
+	}
 
-		orderTransaction := data.OrderTransaction{
-			ID:                     primitive.NewObjectID(),
-			CartID:                 &cartId,
-			CustomerID:             userObjectId,
-			TotalPrice:             checkoutBody.TotalPrice,
-			VendorID:               storeId,
-			TransactionReferenceID: *paymentReferenceId,
-			CreatedAt:              time.Now(),
-			UpdatedAt:              time.Now(),
-		}
+	if errand.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand has been marked as " + string(errand.CurrentStatus()) + " already"})
+		return
+	}
 
-		orderStatus := "ongoing"
-		orderProgressStatus := "orderReceivedByVendor"
-		createdAt := time.Now()
-
-		order := data.Order{
-			ID:                  primitive.NewObjectID(),
-			CartID:              cartId,
-			CustomerID:          userObjectId,
-			StoreID:             storeId,
-			DeliveryInstruction: checkoutBody.DeliveryInstruction,
-			DeliveryLocation:    checkoutBody.DeliveryLocation,
-			DeliveryMapLocation: checkoutBody.DeliveryMapLocation,
-			Code:                strconv.Itoa(checkoutBody.Code),
-			Status:              &orderStatus,
-			OrderProgressStatus: &orderProgressStatus,
-			Price:               checkoutBody.TotalPrice,
-			DeliveryFee:         &checkoutBody.DeliveryFee,
-			CouponPrice:         checkoutBody.CouponPrice,
-			IsPaidFor:           true,
-			OrderTransactionID:  &orderTransaction.ID,
-			CreatedAt:           &createdAt,
-			UpdatedAt:           &createdAt,
-		}
+	actorRole, actorId, err := resolveErrandActor(c, db, errand)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 
-		_, err = orderTransactionCollection.InsertOne(sessCtx, orderTransaction)
-		if err != nil {
-			return nil, err
-		}
+	claiming := body.ProgressStatus == data.ErrandReceivedByRider
 
-		_, err = orderCollection.InsertOne(sessCtx, order)
-		if err != nil {
-			return nil, err
-		}
+	if actorRole == data.ActorRider && !claiming && !isAssignedRider(errand, *actorId) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "errand is not assigned to you"})
+		return
+	}
 
-		cartCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": order.CartID}, bson.M{
-			"$set": bson.M{
-				"isCompleted": true,
-			},
-		})
+	previousProgressStatus := errand.CurrentProgressStatus()
+	if err := previousProgressStatus.CanTransitionTo(body.ProgressStatus, actorRole); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": userObjectId}, bson.M{
-			"$set": bson.M{
-				"currentCartId": nil,
-			},
-		})
+	if claiming && errand.RiderID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrErrandClaimed.Error()})
+		return
+	}
 
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": userObjectId}, bson.M{
-			"$set": bson.M{
-				"virtualBankAccount.balance": virtualAccount.Balance - order.Price,
-			},
-		})
+	filter := bson.M{"_id": errand.ID, "status": data.OrderStatusOngoing, "progressStatus": previousProgressStatus}
+	update := bson.M{
+		"progressStatus": body.ProgressStatus,
+		"updatedAt":      time.Now(),
+	}
 
-		orderToCreate = &order
+	// Accepting is a claim: it only succeeds while no other rider holds the errand.
+	if claiming {
+		filter["riderId"] = nil
+		update["riderId"] = *actorId
+	}
 
-		return nil, nil
+	result, err := db.Collection(utils.ERRAND).UpdateOne(c, filter, bson.M{"$set": update})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update errand progress status " + err.Error()})
+		return
+	}
 
-	})
+	if result.MatchedCount == 0 {
+		if claiming {
+			c.JSON(http.StatusConflict, gin.H{"error": ErrErrandClaimed.Error()})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "errand progress status changed while updating, please refresh and try again"})
+		return
+	}
 
-	if err != nil {
-		return nil, err
+	errand.ProgressStatus = &body.ProgressStatus
+	if claiming {
+		errand.RiderID = actorId
 	}
 
-	return orderToCreate, nil
-}
+	utils.SendErrandUpdateToCustomer(c, db, fcm, errand)
 
-func MarkOrderAsComplete(c *gin.Context, db *mongo.Database) {
+	errand.HideCodeFrom(actorId.Hex())
+	c.JSON(http.StatusOK, errand)
 
-	orderStringId := c.Param("id")
+}
 
-	requestBody := map[string]interface{}{}
-	if err := c.ShouldBindJSON(&requestBody); err != nil {
+// ReportErrandSpend godoc
+// @Summary Report errand spend
+// @Description The rider reports how much of the budget they spent, with a photo of the receipt. It can be corrected until the errand is completed.
+// @Tags Errands
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Param spend body ErrandSpendBody true "Actual spend and base64 receipt image"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Router /errands/{id}/spend [patch]
+// @Security BearerAuth
+func ReportErrandSpend(c *gin.Context, db *mongo.Database) {
+
+	var body ErrandSpendBody
+	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "error binding json " + err.Error()})
 		return
 	}
-	code := requestBody["code"].(string)
 
-	orderObjectId, err := primitive.ObjectIDFromHex(orderStringId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to get order objectId"})
+	if body.ActualSpend == nil || len(body.ReceiptImage) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "actualSpend and receiptImage cannot be empty"})
 		return
 	}
 
-	orderCheckoutCollection := db.Collection(utils.ORDER_CHECKOUT_SETTINGS)
-	orderCollection := db.Collection(utils.ORDER)
-	walletTransactionCollection := db.Collection(utils.WALLET_TRANSACTIONS)
-	userCollection := db.Collection(utils.USER)
-	boiboiCollection := db.Collection(utils.BOIBOI_ACCOUNT)
+	errand, ok := getErrand(c, db)
+	if !ok {
+		return
+	}
 
-	var order data.Order
-	if err := orderCollection.FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order not found"})
+	riderId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil || !isAssignedRider(errand, riderId) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the assigned rider can report what was spent"})
 		return
 	}
 
-	if code != order.Code {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong order code inputted "})
+	if errand.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand has been marked as " + string(errand.CurrentStatus()) + " already"})
 		return
 	}
 
-	if *order.Status == "completed" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as completed already"})
+	if *body.ActualSpend < 0 || *body.ActualSpend > errand.EstimatedBudget {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("actualSpend must be between 0 and the estimated budget of %.2f", errand.EstimatedBudget)})
 		return
 	}
 
-	if *order.Status == "cancelled" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as cancelled already"})
+	receiptUrl, err := utils.UploadImage(body.ReceiptImage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to upload receipt. " + err.Error()})
 		return
 	}
 
-	session, err := db.Client().StartSession()
+	result, err := db.Collection(utils.ERRAND).UpdateOne(c, bson.M{"_id": errand.ID, "riderId": riderId, "status": data.OrderStatusOngoing}, bson.M{
+		"$set": bson.M{
+			"actualSpend":  *body.ActualSpend,
+			"receiptImage": receiptUrl,
+			"updatedAt":    time.Now(),
+		},
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to start db transaction session: "})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update errand. " + err.Error()})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrErrandNotOngoing.Error()})
 		return
 	}
-	defer session.EndSession(c)
 
-	// TODO()
-	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+	errand.ActualSpend = body.ActualSpend
+	errand.ReceiptImage = &receiptUrl
+	errand.HideCodeFrom(riderId.Hex())
 
-		var checkoutSettings data.OrderCheckoutSettings
-		if err := orderCheckoutCollection.FindOne(sessCtx, bson.M{}).Decode(&checkoutSettings); err != nil {
-			return nil, err
-		}
+	c.JSON(http.StatusOK, errand)
 
-		amountToPayToStore := (checkoutSettings.StorePercent / 100) * (order.Price - *order.DeliveryFee)
-		amountToPayToRider := *order.DeliveryFee
-		amountToPayToBoiboi := (checkoutSettings.StorePercent / 100) * (order.Price - *order.DeliveryFee)
+}
 
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"storeId": order.StoreID}, bson.M{
-			"$inc": bson.M{
-				"virtualBankAccount.balance": amountToPayToStore,
-			},
-		})
+// MarkErrandAsComplete godoc
+// @Summary Complete an errand
+// @Description The rider completes the errand with the customer's code. The rider is paid what they spent plus the delivery fee and the rest of the budget goes back to the customer.
+// @Tags Errands
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Param code body object{code=string} true "Delivery code"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Router /errands/{id}/complete [post]
+// @Security BearerAuth
+func MarkErrandAsComplete(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
 
-		var rider data.User
-		if err := userCollection.FindOne(sessCtx, bson.M{"_id": order.RiderID}).Decode(&rider); err != nil {
-			return nil, err
-		}
+	requestBody := map[string]interface{}{}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "error binding json " + err.Error()})
+		return
+	}
+	code, ok := requestBody["code"].(string)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code cannot be empty"})
+		return
+	}
 
-		var deliveryAdmin data.User
-		if err := userCollection.FindOne(sessCtx, bson.M{"deliveryService": rider.DeliveryService, "isAdmin": true}).Decode(&deliveryAdmin); err != nil {
-			return nil, err
-		}
+	errand, ok := getErrand(c, db)
+	if !ok {
+		return
+	}
 
-		riderTransaction := data.WalletTransactions{
-			ID:        primitive.NewObjectID(),
-			UserId:    deliveryAdmin.ID,
-			Amount:    amountToPayToRider,
-			Type:      "credit",
-			CreatedAt: time.Now(),
-		}
+	if errand.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand has been marked as " + string(errand.CurrentStatus()) + " already"})
+		return
+	}
 
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": deliveryAdmin.ID}, bson.M{
-			"$inc": bson.M{
-				"virtualBankAccount.balance": amountToPayToRider,
-			},
-		})
+	riderId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil || !isAssignedRider(errand, riderId) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the assigned rider can complete this errand"})
+		return
+	}
 
-		_, err := walletTransactionCollection.InsertOne(sessCtx, riderTransaction)
-		if err != nil {
-			return nil, err
-		}
+	if errand.CurrentProgressStatus() != data.ErrandRiderAtUserLocation {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand cannot be completed from " + string(errand.CurrentProgressStatus())})
+		return
+	}
 
-		boiboiCollection.FindOneAndUpdate(sessCtx, bson.M{}, bson.M{
-			"$inc": bson.M{
-				"balance": amountToPayToBoiboi,
-			},
-		})
+	if errand.ActualSpend == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "report what was spent before completing the errand"})
+		return
+	}
 
-		orderCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": orderObjectId}, bson.M{
-			"$set": bson.M{
-				"status": "completed",
-			},
+	errandCollection := db.Collection(utils.ERRAND)
+
+	maxCodeAttempts := utils.DeliveryCodeMaxAttempts()
+	if errand.CodeAttempts >= maxCodeAttempts {
+		c.JSON(http.StatusForbidden, gin.H{"error": "too many wrong codes entered. contact support to get a new code"})
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(code), []byte(errand.Code)) != 1 {
+		result, err := errandCollection.UpdateOne(c, bson.M{"_id": errand.ID, "codeAttempts": bson.M{"$not": bson.M{"$gte": maxCodeAttempts}}}, bson.M{
+			"$inc": bson.M{"codeAttempts": 1},
 		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record code attempt. " + err.Error()})
+			return
+		}
+		if result.ModifiedCount == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "too many wrong codes entered. contact support to get a new code"})
+			return
+		}
 
-		orderStatus := "completed"
-		order.Status = &orderStatus
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong errand code inputted", "attemptsLeft": max(maxCodeAttempts-errand.CodeAttempts-1, 0)})
+		return
+	}
 
-		return nil, nil
+	actualSpend := *errand.ActualSpend
+	leftover := errand.EstimatedBudget - actualSpend
 
+	err = settleErrand(c, db, errand, data.OrderStatusCompleted, leftover, bson.M{
+		"progressStatus": data.ErrandRiderAtUserLocation,
+		"riderId":        riderId,
+		"actualSpend":    actualSpend,
+	}, nil, func(sessCtx mongo.SessionContext) error {
+		return utils.CreditRider(sessCtx, db, riderId, errand.ID, actualSpend+errand.DeliveryFee, "errand payment")
 	})
-
+	if errors.Is(err, ErrErrandNotOngoing) {
+		c.JSON(http.StatusConflict, gin.H{"error": "errand changed while completing, please refresh and try again"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error marking order as complete " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to complete errand. " + err.Error()})
+		slog.Error("Failed to complete errand", "errandId", errand.ID.Hex(), "error", err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, order)
+	utils.SendErrandCompletedNotificationToCustomer(c, db, fcm, errand)
+
+	errand.HideCodeFrom(riderId.Hex())
+	c.JSON(http.StatusOK, errand)
 
 }
 
-func CancelOrder(c *gin.Context, db *mongo.Database) {
+// CancelErrand godoc
+// @Summary Cancel an errand
+// @Description The customer cancels an errand no rider has accepted yet and gets the full price back
+// @Tags Errands
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Param reason body object{reason=string} false "Cancellation reason"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Router /errands/{id}/cancel [patch]
+// @Security BearerAuth
+func CancelErrand(c *gin.Context, db *mongo.Database) {
+
+	var body struct {
+		Reason *string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "error binding json " + err.Error()})
+			return
+		}
+	}
 
-	orderId := c.Param("id")
-	orderObjectId, err := primitive.ObjectIDFromHex(orderId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order object id " + err.Error()})
+	errand, ok := getErrand(c, db)
+	if !ok {
 		return
 	}
 
-	orderCollection := db.Collection(utils.ORDER)
-	userCollection := db.Collection(utils.USER)
-	walletTransactionCollection := db.Collection(utils.WALLET_TRANSACTIONS)
-
-	var order data.Order
+	userId := c.GetString("userId")
+	if errand.CustomerID.Hex() != userId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the customer can cancel this errand"})
+		return
+	}
 
-	if err := orderCollection.FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order not found. " + err.Error()})
+	if errand.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand has been marked as " + string(errand.CurrentStatus()) + " already"})
 		return
 	}
 
-	if *order.Status == "cancelled" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as cancelled already"})
+	if errand.CurrentProgressStatus() != data.ErrandCreated || errand.RiderID != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand cannot be cancelled once a rider has accepted it"})
 		return
 	}
 
-	session, err := db.Client().StartSession()
+	update := bson.M{}
+	if body.Reason != nil {
+		update["cancellationReason"] = *body.Reason
+	}
+
+	err := settleErrand(c, db, errand, data.OrderStatusCancelled, errand.Price, bson.M{
+		"progressStatus": data.ErrandCreated,
+		"riderId":        nil,
+	}, update, nil)
+	if errors.Is(err, ErrErrandNotOngoing) {
+		c.JSON(http.StatusConflict, gin.H{"error": "errand was accepted by a rider while cancelling"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to start db transaction session: "})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel errand. " + err.Error()})
+		slog.Error("Failed to cancel errand", "errandId", errand.ID.Hex(), "error", err.Error())
 		return
 	}
-	defer session.EndSession(c)
 
-	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+	errand.CancellationReason = body.Reason
+	c.JSON(http.StatusOK, errand)
 
-		orderCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": orderObjectId}, bson.M{
-			"$set": bson.M{
-				"status": "cancelled",
-			},
-		})
+}
 
-		orderStatus := "cancelled"
-		order.Status = &orderStatus
+// settleErrand closes an ongoing errand with status and any extra fields in set, refunds
+// refundAmount to the customer and runs pay, all in one transaction. The errand must still match
+// expected, so it can only ever be settled once. Card refunds are sent to Paystack after the
+// transaction has committed.
+func settleErrand(ctx context.Context, db *mongo.Database, errand *data.Errand, status data.OrderStatus, refundAmount float64, expected bson.M, set bson.M, pay func(sessCtx mongo.SessionContext) error) error {
 
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": order.CustomerID}, bson.M{
-			"$inc": bson.M{
-				"virtualBankAccount.balance": order.Price,
-			},
-		})
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
 
-		transaction := data.WalletTransactions{
-			ID:                   primitive.NewObjectID(),
-			PaymentTransactionId: utils.GeneratePaymentReference(),
-			UserId:               order.CustomerID,
-			Amount:               order.Price,
-			Type:                 "credit",
-			CreatedAt:            time.Now(),
-		}
+	now := time.Now()
+	update := bson.M{
+		"status":    status,
+		"updatedAt": now,
+	}
+	if status == data.OrderStatusCompleted {
+		update["completedAt"] = now
+	}
+	if refundAmount > 0 {
+		update["refunded"] = refundAmount
+	}
+	for k, v := range set {
+		update[k] = v
+	}
+
+	filter := bson.M{"_id": errand.ID, "status": data.OrderStatusOngoing}
+	for k, v := range expected {
+		filter[k] = v
+	}
 
-		_, err = walletTransactionCollection.InsertOne(sessCtx, transaction)
+	var cardRefund data.Refund
+	refundToCard := errand.PaymentMethod == "card" && errand.PaymentReference != nil && refundAmount > 0
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		result, err := db.Collection(utils.ERRAND).UpdateOne(sessCtx, filter, bson.M{"$set": update})
 		if err != nil {
 			return nil, err
 		}
+		if result.MatchedCount == 0 {
+			return nil, ErrErrandNotOngoing
+		}
+
+		if refundToCard {
+			cardRefund = payments.NewCardRefund(errand.CustomerID, &errand.ID, *errand.PaymentReference, refundAmount)
+			if _, err := db.Collection(utils.REFUND).InsertOne(sessCtx, cardRefund); err != nil {
+				return nil, err
+			}
+		} else if refundAmount > 0 {
+			if err := utils.CreditCustomerWallet(sessCtx, db, errand.CustomerID, errand.ID, refundAmount, "errand refund"); err != nil {
+				return nil, err
+			}
+		}
+
+		if pay != nil {
+			if err := pay(sessCtx); err != nil {
+				return nil, err
+			}
+		}
 
 		return nil, nil
 	})
-
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error marking order as cancelled " + err.Error()})
-		return
+		return err
 	}
 
-	c.JSON(http.StatusOK, order)
+	errand.Status = &status
+	errand.UpdatedAt = now
+	if status == data.OrderStatusCompleted {
+		errand.CompletedAt = &now
+	}
+	if refundAmount > 0 {
+		errand.Refunded = &refundAmount
+	}
 
-}
+	// The errand is settled whatever Paystack says; a failed card refund is left for an admin to retry.
+	if refundToCard {
+		if err := payments.RequestRefund(ctx, db, &cardRefund); err != nil {
+			slog.Error("Failed to refund errand to card", "errandId", errand.ID.Hex(), "refundId", cardRefund.ID.Hex(), "error", err.Error())
+		}
+	}
 
-type OrderState struct {
-	Status string `json:"status"`
+	return nil
 }
 
-func UpdateOrderState(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+func getErrand(c *gin.Context, db *mongo.Database) (*data.Errand, bool) {
 
-	orderId := c.Param("id")
-	orderObjectId, err := primitive.ObjectIDFromHex(orderId)
+	errandId, err := primitive.ObjectIDFromHex(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order object id. " + err.Error()})
-		return
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid errand id. " + err.Error()})
+		return nil, false
 	}
 
-	var orderState OrderState
-	if err := c.ShouldBindJSON(&orderState); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body " + err.Error()})
-		return
+	var errand data.Errand
+	if err := db.Collection(utils.ERRAND).FindOne(c, bson.M{"_id": errandId}).Decode(&errand); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "errand not found. " + err.Error()})
+		return nil, false
 	}
 
-	if orderState.Status == "orderCreated" || orderState.Status == "orderReceivedByVendor" ||
-		orderState.Status == "orderAcceptedByRider" || orderState.Status == "riderAtVendor" ||
-		orderState.Status == "riderOnHisWay" || orderState.Status == "riderAtUserLocation" {
-		orderCollection := db.Collection(utils.ORDER)
-
-		_, err = orderCollection.UpdateOne(c, bson.M{"_id": orderObjectId}, bson.M{
-			"$set": bson.M{
-				"orderProgressStatus": orderState.Status,
-			},
-		})
+	return &errand, true
+}
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order progress status " + err.Error()})
-			return
-		}
+// resolveErrandActor works out whether the caller is the errand's customer or a rider.
+func resolveErrandActor(c *gin.Context, db *mongo.Database, errand *data.Errand) (data.ActorRole, *primitive.ObjectID, error) {
 
-		c.JSON(http.StatusOK, gin.H{"message": "successfully updated order progress status"})
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid userId associated with request")
+	}
 
-		var order data.Order
-		if err := orderCollection.FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
-			slog.Info("error fetching order", "error", err.Error())
-		}
-		utils.SendOrderUpdateToCustomer(c, db, fcm, &order)
+	if errand.CustomerID == userId {
+		return data.ActorCustomer, &userId, nil
+	}
 
-		return
+	var user data.User
+	if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": userId}).Decode(&user); err != nil {
+		return "", nil, fmt.Errorf("user not found")
+	}
 
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "not a valid order progress status"})
-		return
+	if user.Type == "rider" {
+		return data.ActorRider, &userId, nil
 	}
 
+	return "", nil, fmt.Errorf("user is not a participant of this errand")
+}
+
+func isAssignedRider(errand *data.Errand, riderId primitive.ObjectID) bool {
+	return errand.RiderID != nil && *errand.RiderID == riderId
 }
@@ -0,0 +1,269 @@
+package errands
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"firebase.google.com/go/messaging"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AdminCancelErrandBody struct {
+	Reason       *string  `json:"reason"`
+	RiderPayment *float64 `json:"riderPayment"` // paid to the assigned rider out of the price, e.g. for items already bought
+}
+
+type ReassignErrandBody struct {
+	RiderID *string `json:"riderId"` // leave empty to offer the errand to riders near the pickup again
+}
+
+// RegenerateErrandCode godoc
+// @Summary Regenerate an errand's delivery code
+// @Description Replace an ongoing errand's delivery code, unlock it after too many wrong attempts and send the new code to the customer
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Success 200 {object} object{message=string}
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/errands/{id}/code [post]
+// @Security BearerAuth
+func RegenerateErrandCode(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	errandId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid errand id. " + err.Error()})
+		return
+	}
+
+	code, err := utils.GenerateDeliveryCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate code. " + err.Error()})
+		return
+	}
+
+	var errand data.Errand
+	if err := db.Collection(utils.ERRAND).FindOneAndUpdate(c, bson.M{"_id": errandId, "status": data.OrderStatusOngoing}, bson.M{
+		"$set": bson.M{
+			"code":         code,
+			"codeAttempts": 0,
+			"updatedAt":    time.Now(),
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&errand); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no ongoing errand found with this id"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to regenerate code. " + err.Error()})
+		slog.Error("Failed to regenerate errand code", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "a new delivery code has been sent to the customer"})
+
+	utils.SendErrandCodeToCustomer(c, db, fcm, &errand)
+
+}
+
+// AdminCancelErrand godoc
+// @Summary Cancel an errand
+// @Description Cancel an ongoing errand at any stage, e.g. one locked out by wrong codes or abandoned by its rider. The assigned rider can be paid part of the price for what they already spent; the rest is refunded to the customer
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Param cancellation body AdminCancelErrandBody false "Cancellation"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/errands/{id}/cancel [patch]
+// @Security BearerAuth
+func AdminCancelErrand(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	var body AdminCancelErrandBody
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "error binding json " + err.Error()})
+			return
+		}
+	}
+
+	errand, ok := getErrand(c, db)
+	if !ok {
+		return
+	}
+
+	if errand.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand has been marked as " + string(errand.CurrentStatus()) + " already"})
+		return
+	}
+
+	riderPayment := 0.0
+	if body.RiderPayment != nil {
+		riderPayment = utils.RoundToKobo(*body.RiderPayment)
+	}
+	if riderPayment < 0 || riderPayment > errand.Price {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "riderPayment must be between 0 and the errand's price"})
+		return
+	}
+	if riderPayment > 0 && errand.RiderID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand has no rider to pay"})
+		return
+	}
+
+	reason := "Your errand was cancelled by support"
+	if body.Reason != nil && len(strings.TrimSpace(*body.Reason)) > 0 {
+		reason = strings.TrimSpace(*body.Reason)
+	}
+
+	var pay func(sessCtx mongo.SessionContext) error
+	if riderPayment > 0 {
+		riderId := *errand.RiderID
+		pay = func(sessCtx mongo.SessionContext) error {
+			return utils.CreditRider(sessCtx, db, riderId, errand.ID, riderPayment, "errand cancellation payment")
+		}
+	}
+
+	err := settleErrand(c, db, errand, data.OrderStatusCancelled, utils.RoundToKobo(errand.Price-riderPayment), bson.M{
+		"progressStatus": errand.CurrentProgressStatus(),
+		"riderId":        errand.RiderID,
+	}, bson.M{"cancellationReason": reason}, pay)
+	if errors.Is(err, ErrErrandNotOngoing) {
+		c.JSON(http.StatusConflict, gin.H{"error": "errand changed while cancelling, please refresh and try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel errand. " + err.Error()})
+		slog.Error("Failed to cancel errand", "errandId", errand.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	errand.CancellationReason = &reason
+	errand.HideCodeFrom("")
+	c.JSON(http.StatusOK, errand)
+
+	utils.SendErrandCancelledNotificationToCustomer(c, db, fcm, errand)
+
+}
+
+// ReassignErrand godoc
+// @Summary Reassign an errand
+// @Description Take an ongoing errand off its rider, e.g. one who abandoned it. Given a riderId it is assigned straight to that rider; otherwise it goes back to waiting for a rider and riders near the pickup are told about it
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Errand ID"
+// @Param rider body ReassignErrandBody false "New rider"
+// @Success 200 {object} data.Errand
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /admin/errands/{id}/reassign [patch]
+// @Security BearerAuth
+func ReassignErrand(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	var body ReassignErrandBody
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "error binding json " + err.Error()})
+			return
+		}
+	}
+
+	errand, ok := getErrand(c, db)
+	if !ok {
+		return
+	}
+
+	if errand.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "errand has been marked as " + string(errand.CurrentStatus()) + " already"})
+		return
+	}
+
+	// The new rider starts the errand over, so what the last rider reported spending no longer applies.
+	progressStatus := data.ErrandCreated
+	set := bson.M{
+		"progressStatus": progressStatus,
+		"codeAttempts":   0,
+		"updatedAt":      time.Now(),
+	}
+
+	var newRiderId *primitive.ObjectID
+	if body.RiderID != nil && len(strings.TrimSpace(*body.RiderID)) > 0 {
+		riderId, err := primitive.ObjectIDFromHex(strings.TrimSpace(*body.RiderID))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid riderId. " + err.Error()})
+			return
+		}
+
+		var rider data.User
+		if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": riderId, "type": "rider", "status": "active"}).Decode(&rider); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no active rider found with this id"})
+			return
+		}
+
+		if errand.RiderID != nil && *errand.RiderID == riderId {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "errand is already assigned to this rider"})
+			return
+		}
+
+		newRiderId = &riderId
+		progressStatus = data.ErrandReceivedByRider
+		set["progressStatus"] = progressStatus
+		set["riderId"] = riderId
+	} else {
+		set["riderId"] = nil
+	}
+
+	filter := bson.M{
+		"_id":            errand.ID,
+		"status":         data.OrderStatusOngoing,
+		"progressStatus": errand.CurrentProgressStatus(),
+		"riderId":        errand.RiderID,
+	}
+
+	result, err := db.Collection(utils.ERRAND).UpdateOne(c, filter, bson.M{
+		"$set":   set,
+		"$unset": bson.M{"actualSpend": "", "receiptImage": ""},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reassign errand. " + err.Error()})
+		slog.Error("Failed to reassign errand", "errandId", errand.ID.Hex(), "error", err.Error())
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "errand changed while reassigning, please refresh and try again"})
+		return
+	}
+
+	errand.RiderID = newRiderId
+	errand.ProgressStatus = &progressStatus
+	errand.CodeAttempts = 0
+	errand.ActualSpend = nil
+	errand.ReceiptImage = nil
+	errand.HideCodeFrom("")
+
+	c.JSON(http.StatusOK, errand)
+
+	if newRiderId == nil {
+		notifyNearbyRiders(c, db, fcm, errand)
+	} else {
+		utils.SendErrandUpdateToCustomer(c, db, fcm, errand)
+	}
+
+}
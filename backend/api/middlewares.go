@@ -2,9 +2,14 @@ package api
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -176,6 +181,69 @@ func AuthMiddleware(db *mongo.Database) gin.HandlerFunc {
 	}
 }
 
+// StreamTokenMiddleware authenticates order streams with a stream token from utils.GenerateStreamToken,
+// passed in the token query parameter since browser EventSource streams can't set the Authorization
+// header. The token only opens the stream of the order it was issued for and expires within a minute.
+func StreamTokenMiddleware(db *mongo.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		token := c.Query("token")
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "stream token missing"})
+			c.Abort()
+			return
+		}
+
+		userId, err := utils.ParseStreamToken(token, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization error " + err.Error()})
+			c.Abort()
+			return
+		}
+
+		if !doesUserExist(userId, c, db) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authorized"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userId", userId)
+		c.Next()
+	}
+}
+
+// RequestLogger is gin's request logger with the token query parameter left out, so stream tokens
+// don't end up in the logs.
+func RequestLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			param.StatusCode,
+			param.Latency,
+			param.ClientIP,
+			param.Method,
+			redactQueryToken(param.Path),
+			param.ErrorMessage,
+		)
+	})
+}
+
+func redactQueryToken(path string) string {
+	parsed, err := url.Parse(path)
+	if err != nil || parsed.RawQuery == "" {
+		return path
+	}
+
+	query := parsed.Query()
+	if !query.Has("token") {
+		return path
+	}
+
+	query.Set("token", "REDACTED")
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
 type responseBodyWriter struct {
 	gin.ResponseWriter
 	body *bytes.Buffer
@@ -209,3 +277,119 @@ func LoggingMiddleware() gin.HandlerFunc {
 		)
 	}
 }
+
+// idempotencyLockTimeout is how long an in-flight request holds its key before a retry may take it over.
+const idempotencyLockTimeout = 2 * time.Minute
+
+// IdempotencyMiddleware makes a route safe to retry. Requests carrying an Idempotency-Key header
+// are recorded per user with a hash of their body; a retry with the same key gets the original
+// response back instead of running the handler again, and a duplicate sent while the first is
+// still running is turned away. Requests without the header are passed through untouched.
+func IdempotencyMiddleware(db *mongo.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		key := strings.TrimSpace(c.GetHeader("Idempotency-Key"))
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request"})
+			c.Abort()
+			return
+		}
+
+		requestBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body. " + err.Error()})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(requestBody))
+
+		hash := sha256.Sum256(requestBody)
+		requestHash := hex.EncodeToString(hash[:])
+
+		idempotencyCollection := db.Collection(utils.IDEMPOTENCY_KEY)
+
+		now := time.Now()
+		record := data.IdempotencyKey{
+			ID:          userId.Hex() + ":" + key,
+			UserID:      userId,
+			Key:         key,
+			RequestHash: requestHash,
+			Status:      "inProgress",
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+
+		if _, err := idempotencyCollection.InsertOne(c, record); err != nil {
+			if !mongo.IsDuplicateKeyError(err) {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record idempotency key. " + err.Error()})
+				c.Abort()
+				return
+			}
+
+			var existing data.IdempotencyKey
+			if err := idempotencyCollection.FindOne(c, bson.M{"_id": record.ID}).Decode(&existing); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get idempotency key. " + err.Error()})
+				c.Abort()
+				return
+			}
+
+			if existing.RequestHash != requestHash {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "idempotency key has already been used for a different request"})
+				c.Abort()
+				return
+			}
+
+			if existing.Status == "completed" {
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.ResponseStatus, "application/json; charset=utf-8", []byte(existing.ResponseBody))
+				c.Abort()
+				return
+			}
+
+			// The first request may have died without releasing the key; let a retry take it over.
+			result, err := idempotencyCollection.UpdateOne(c, bson.M{
+				"_id":       record.ID,
+				"status":    "inProgress",
+				"updatedAt": bson.M{"$lt": now.Add(-idempotencyLockTimeout)},
+			}, bson.M{"$set": bson.M{"updatedAt": now}})
+			if err != nil || result.MatchedCount == 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "a request with this idempotency key is still being processed"})
+				c.Abort()
+				return
+			}
+		}
+
+		writer := &responseBodyWriter{
+			ResponseWriter: c.Writer,
+			body:           bytes.NewBufferString(""),
+		}
+		c.Writer = writer
+
+		c.Next()
+
+		// Server errors are not stored so the client can retry with the same key.
+		if writer.Status() >= http.StatusInternalServerError {
+			if _, err := idempotencyCollection.DeleteOne(c, bson.M{"_id": record.ID}); err != nil {
+				slog.Error("Failed to release idempotency key", "key", record.ID, "error", err.Error())
+			}
+			return
+		}
+
+		if _, err := idempotencyCollection.UpdateOne(c, bson.M{"_id": record.ID}, bson.M{
+			"$set": bson.M{
+				"status":         "completed",
+				"responseStatus": writer.Status(),
+				"responseBody":   writer.body.String(),
+				"updatedAt":      time.Now(),
+			},
+		}); err != nil {
+			slog.Error("Failed to store idempotent response", "key", record.ID, "error", err.Error())
+		}
+	}
+}
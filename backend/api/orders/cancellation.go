@@ -0,0 +1,173 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"useboi-boi/backend/api/payments"
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrOrderNotOngoing        = errors.New("order is no longer ongoing")
+	ErrCancellationNotAllowed = errors.New("order cannot be cancelled at this stage")
+)
+
+// CancelAndRefundOrder cancels an ongoing order, puts its stock back and splits the price between
+// the customer, store, rider and platform according to the cancellation policy for the order's
+// progress status and actorRole, all in a single transaction. Wallet payments are refunded to the
+// wallet; card payments are refunded to the card through Paystack once the transaction has
+// committed, up to what the card was charged, with anything paid for substitutes from the wallet
+// going back to the wallet. It returns ErrCancellationNotAllowed if the policy forbids the
+// cancellation, and ErrOrderNotOngoing if the order was completed, cancelled or moved on in the
+// meantime, so an order is never refunded twice or under the wrong policy.
+func CancelAndRefundOrder(ctx context.Context, db *mongo.Database, order *data.Order, actorRole data.ActorRole, actorId *primitive.ObjectID, reason *string) error {
+
+	orderCollection := db.Collection(utils.ORDER)
+	refundCollection := db.Collection(utils.REFUND)
+
+	previousStatus := order.CurrentStatus()
+	progressStatus := order.CurrentProgressStatus()
+
+	policy, err := utils.GetCancellationPolicy(ctx, db, progressStatus, actorRole)
+	if err != nil {
+		return err
+	}
+
+	if !policy.CanCancel {
+		return ErrCancellationNotAllowed
+	}
+
+	split := utils.SplitCancellation(policy, order)
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	cardRefundAmount, walletRefundAmount := splitRefund(order, split.Refund)
+
+	var cardRefund data.Refund
+	refundToCard := cardRefundAmount > 0
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		update := bson.M{
+			"status":            data.OrderStatusCancelled,
+			"cancellationSplit": split,
+			"updatedAt":         time.Now(),
+		}
+		if reason != nil {
+			update["cancellationReason"] = *reason
+		}
+
+		filter := bson.M{"_id": order.ID, "status": data.OrderStatusOngoing, "orderProgressStatus": progressStatus}
+		if order.OrderProgressStatus == nil {
+			filter["orderProgressStatus"] = nil
+		}
+
+		result, err := orderCollection.UpdateOne(sessCtx, filter, bson.M{
+			"$set": update,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, ErrOrderNotOngoing
+		}
+
+		if err := restoreStock(sessCtx, db, order); err != nil {
+			return nil, err
+		}
+
+		if refundToCard {
+			cardRefund = payments.NewCardRefund(order.CustomerID, &order.ID, *order.PaymentReference, cardRefundAmount)
+			if _, err := refundCollection.InsertOne(sessCtx, cardRefund); err != nil {
+				return nil, err
+			}
+		}
+
+		if walletRefundAmount > 0 {
+			if err := utils.CreditCustomerWallet(sessCtx, db, order.CustomerID, order.ID, walletRefundAmount, "order cancellation refund"); err != nil {
+				return nil, err
+			}
+		}
+
+		if split.Store > 0 {
+			if err := utils.CreditStore(sessCtx, db, order.StoreID, order.ID, split.Store, "order cancellation fee"); err != nil {
+				return nil, err
+			}
+		}
+
+		if split.Rider > 0 {
+			if err := utils.CreditRider(sessCtx, db, *order.RiderID, order.ID, split.Rider, "order cancellation fee"); err != nil {
+				return nil, err
+			}
+		}
+
+		if split.Platform > 0 {
+			if err := utils.CreditPlatform(sessCtx, db, split.Platform); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := utils.RecordOrderTransition(sessCtx, db, data.OrderTimelineEntry{
+			OrderID:                order.ID,
+			ActorID:                actorId,
+			ActorRole:              actorRole,
+			PreviousProgressStatus: &progressStatus,
+			ProgressStatus:         progressStatus,
+			PreviousStatus:         &previousStatus,
+			Status:                 data.OrderStatusCancelled,
+			Note:                   reason,
+		}); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	orderStatus := data.OrderStatusCancelled
+	order.Status = &orderStatus
+	order.CancellationReason = reason
+	order.CancellationSplit = &split
+
+	// The order is cancelled whatever Paystack says; a failed card refund is left for an admin to retry.
+	if refundToCard {
+		if err := payments.RequestRefund(ctx, db, &cardRefund); err != nil {
+			slog.Error("Failed to refund order to card", "orderId", order.ID.Hex(), "refundId", cardRefund.ID.Hex(), "error", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func isCardPayment(order *data.Order) bool {
+	return order.PaymentMethod == "card" && order.PaymentReference != nil
+}
+
+// splitRefund divides a cancellation refund between the card the order was paid with and the
+// customer's wallet. The card only gets back what it was charged, less what substitutions already
+// refunded to the wallet; the rest, paid for substitutes from the wallet, goes back to the wallet.
+func splitRefund(order *data.Order, refund float64) (card float64, wallet float64) {
+
+	if !isCardPayment(order) {
+		return 0, refund
+	}
+
+	cardCharged := order.Price - max(order.SubstitutionWalletAmount(), 0)
+	card = utils.RoundToKobo(min(refund, max(cardCharged, 0)))
+
+	return card, utils.RoundToKobo(refund - card)
+}
@@ -0,0 +1,127 @@
+package orders
+
+import (
+	"context"
+	"fmt"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// reserveStock takes the ordered quantities out of each item's inventory. It is meant to run
+// inside the checkout transaction so a shortage on any item rolls the whole order back.
+// Items without a tracked inventory are left alone.
+func reserveStock(ctx context.Context, db *mongo.Database, items []PricedCartItem) error {
+
+	itemCollection := db.Collection(utils.ITEM)
+
+	for _, pricedItem := range items {
+		if pricedItem.Item.CurrentInventory == nil {
+			continue
+		}
+
+		quantity := pricedItem.CartItem.Quantity
+
+		result, err := itemCollection.UpdateOne(ctx, bson.M{
+			"_id":              pricedItem.Item.ID,
+			"currentInventory": bson.M{"$gte": quantity},
+		}, bson.M{
+			"$inc": bson.M{"currentInventory": -quantity},
+		})
+		if err != nil {
+			return err
+		}
+
+		if result.MatchedCount == 0 {
+			return fmt.Errorf("item %s does not have enough stock left", itemName(&pricedItem.Item))
+		}
+	}
+
+	return nil
+}
+
+// restoreStock puts the quantities of a cancelled order back into inventory.
+func restoreStock(ctx context.Context, db *mongo.Database, order *data.Order) error {
+
+	lineItems := order.LineItems
+
+	// Orders placed before line items were recorded only point at their cart.
+	if len(lineItems) == 0 {
+		cursor, err := db.Collection(utils.CART_ITEM).Find(ctx, bson.M{"cartId": order.CartID})
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		var cartItems []data.CartItem
+		if err := cursor.All(ctx, &cartItems); err != nil {
+			return err
+		}
+
+		for _, cartItem := range cartItems {
+			lineItems = append(lineItems, data.OrderLineItem{ItemID: cartItem.ItemID, Quantity: cartItem.Quantity})
+		}
+	}
+
+	return restoreLineItemStock(ctx, db, lineItems)
+}
+
+// restoreLineItemStock puts the quantities of line items taken off an order back into inventory.
+func restoreLineItemStock(ctx context.Context, db *mongo.Database, lineItems []data.OrderLineItem) error {
+
+	itemCollection := db.Collection(utils.ITEM)
+
+	for _, lineItem := range lineItems {
+		if lineItem.Quantity < 1 {
+			continue
+		}
+
+		if _, err := itemCollection.UpdateOne(ctx, bson.M{
+			"_id":              lineItem.ItemID,
+			"currentInventory": bson.M{"$exists": true},
+		}, bson.M{
+			"$inc": bson.M{"currentInventory": lineItem.Quantity},
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reserveLineItemStock takes the quantities of line items added to an order out of inventory, like
+// reserveStock does at checkout.
+func reserveLineItemStock(ctx context.Context, db *mongo.Database, lineItems []data.OrderLineItem) error {
+
+	itemCollection := db.Collection(utils.ITEM)
+
+	for _, lineItem := range lineItems {
+		var item data.Item
+		if err := itemCollection.FindOne(ctx, bson.M{"_id": lineItem.ItemID}).Decode(&item); err != nil {
+			return fmt.Errorf("item %s no longer exists", lineItem.Name)
+		}
+
+		if item.CurrentInventory == nil {
+			continue
+		}
+
+		result, err := itemCollection.UpdateOne(ctx, bson.M{
+			"_id":              lineItem.ItemID,
+			"currentInventory": bson.M{"$gte": lineItem.Quantity},
+		}, bson.M{
+			"$inc": bson.M{"currentInventory": -lineItem.Quantity},
+		})
+		if err != nil {
+			return err
+		}
+
+		if result.MatchedCount == 0 {
+			return fmt.Errorf("item %s does not have enough stock left", lineItem.Name)
+		}
+	}
+
+	return nil
+}
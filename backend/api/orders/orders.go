@@ -1,16 +1,15 @@
 package orders
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"os"
-	"strconv"
 	"time"
 
+	"useboi-boi/backend/api/dispatch"
+	"useboi-boi/backend/api/payments"
 	"useboi-boi/backend/internal/data"
 	"useboi-boi/backend/utils"
 
@@ -22,21 +21,26 @@ import (
 )
 
 type CheckoutBody struct {
-	TotalPrice          float64  `json:"totalPrice"`
-	CartId              string   `json:"cartId"`
-	StoreId             string   `json:"storeId"`
-	IsErrand            bool     `json:"isErrand"`
-	DeliveryLocation    *string  `json:"deliveryLocation"`
-	DeliveryFee         float64  `json:"deliveryFee"`
-	ServiceCharge       float64  `json:"serviceCharge"`
-	Code                int      `json:"code"`
-	CouponPrice         *float64 `json:"couponPrice"`
-	DeliveryMapLocation *string  `json:"deliveryMapLocation"`
-	DeliveryInstruction *string  `json:"deliveryInstruction"`
-	CheckoutType        string   `json:"checkoutType"` // card, wallet
-	CardId              *float64 `json:"cardId"`
+	TotalPrice          float64    `json:"totalPrice"`
+	CartId              string     `json:"cartId"`
+	StoreId             string     `json:"storeId"`
+	IsErrand            bool       `json:"isErrand"`
+	DeliveryLocation    *string    `json:"deliveryLocation"`
+	DeliveryFee         float64    `json:"deliveryFee"`
+	ServiceCharge       float64    `json:"serviceCharge"`
+	CouponPrice         *float64   `json:"couponPrice"`
+	CouponCode          *string    `json:"couponCode"`
+	Tip                 *float64   `json:"tip"` // optional tip for the rider, paid to them in full on delivery
+	DeliveryMapLocation *string    `json:"deliveryMapLocation"`
+	DeliveryInstruction *string    `json:"deliveryInstruction"`
+	CheckoutType        string     `json:"checkoutType"` // card, wallet
+	CardId              *float64   `json:"cardId"`
+	ScheduledFor        *time.Time `json:"scheduledFor"`
 }
 
+// maxScheduleAhead is how far in the future an order can be scheduled.
+const maxScheduleAhead = 7 * 24 * time.Hour
+
 func Checkout(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
 	var checkoutBody CheckoutBody
 	if err := c.ShouldBindJSON(&checkoutBody); err != nil {
@@ -50,7 +54,7 @@ func Checkout(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
 	}
 
 	if len(checkoutBody.StoreId) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "cartId cannot be empty"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "storeId cannot be empty"})
 		return
 	}
 
@@ -64,10 +68,22 @@ func Checkout(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
 		return
 	}
 
+	userObjectId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "cannot create objectId from userId " + err.Error()})
+		return
+	}
+
+	storeId, err := primitive.ObjectIDFromHex(checkoutBody.StoreId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId. " + err.Error()})
+		return
+	}
+
 	storeCollection := db.Collection(utils.STORE)
 
 	var store data.Store
-	if err := storeCollection.FindOne(c, bson.M{"_id": checkoutBody.StoreId}).Decode(&store); err != nil {
+	if err := storeCollection.FindOne(c, bson.M{"_id": storeId}).Decode(&store); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to get store. " + err.Error()})
 		slog.Error("Failed to get store", "error", err.Error())
 		return
@@ -79,11 +95,40 @@ func Checkout(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
 		return
 	}
 
+	if checkoutBody.ScheduledFor != nil {
+		if err := validateScheduledFor(&store, *checkoutBody.ScheduledFor); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order cannot be scheduled. " + err.Error()})
+			return
+		}
+	} else {
+		isOpen, err := utils.IsStoreOpenAt(&store, time.Now())
+		if err != nil {
+			slog.Error("Failed to evaluate store hours", "storeId", store.ID.Hex(), "error", err.Error())
+		} else if !isOpen {
+			nextOpensAt, _ := utils.NextStoreOpening(&store, time.Now())
+			c.JSON(http.StatusBadRequest, gin.H{"error": "store is currently closed. cannot process order", "nextOpensAt": nextOpensAt})
+			return
+		}
+	}
+
+	totals, err := ComputeCheckoutTotals(c, db, &checkoutBody, &store, userObjectId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order cannot be placed. " + err.Error()})
+		slog.Info("Failed to compute checkout totals", "error", err.Error())
+		return
+	}
+
+	if !totals.MatchesClientTotal(checkoutBody.TotalPrice) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order cannot be placed, price mismatch", "totals": totals})
+		slog.Info("Checkout price mismatch", "clientTotal", checkoutBody.TotalPrice, "serverTotal", totals.TotalPrice)
+		return
+	}
+
 	switch checkoutBody.CheckoutType {
 	case "card":
-		CheckoutFromCard(c, db, &checkoutBody, fcm)
+		CheckoutFromCard(c, db, &checkoutBody, totals, fcm)
 	case "wallet":
-		CheckoutFromWallet(c, db, &checkoutBody, fcm)
+		CheckoutFromWallet(c, db, &checkoutBody, totals, fcm)
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad request. invalid checkout type"})
 		return
@@ -91,7 +136,32 @@ func Checkout(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
 
 }
 
-func CheckoutFromWallet(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody, fcm *messaging.Client) {
+func validateScheduledFor(store *data.Store, scheduledFor time.Time) error {
+
+	now := time.Now()
+
+	if !scheduledFor.After(now) {
+		return fmt.Errorf("scheduledFor must be in the future")
+	}
+
+	if scheduledFor.After(now.Add(maxScheduleAhead)) {
+		return fmt.Errorf("orders can only be scheduled up to %d days ahead", int(maxScheduleAhead.Hours()/24))
+	}
+
+	isOpen, err := utils.IsStoreOpenAt(store, scheduledFor)
+	if err != nil {
+		slog.Error("Failed to evaluate store hours", "storeId", store.ID.Hex(), "error", err.Error())
+		return nil
+	}
+
+	if !isOpen {
+		return fmt.Errorf("store is closed at the scheduled time")
+	}
+
+	return nil
+}
+
+func CheckoutFromWallet(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody, totals *CheckoutTotals, fcm *messaging.Client) {
 
 	userId, ok := c.Get("userId")
 	if !ok {
@@ -106,7 +176,6 @@ func CheckoutFromWallet(c *gin.Context, db *mongo.Database, checkoutBody *Checko
 	}
 
 	userCollection := db.Collection(utils.USER)
-	walletTransactionCollection := db.Collection(utils.WALLET_TRANSACTIONS)
 
 	var user data.User
 	result := userCollection.FindOne(c, bson.M{"_id": userObjectId})
@@ -122,43 +191,27 @@ func CheckoutFromWallet(c *gin.Context, db *mongo.Database, checkoutBody *Checko
 		return
 	}
 
-	walletBalance := user.VirtualBankAccount.Balance
-
-	if walletBalance-checkoutBody.TotalPrice < 100 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient amount in wallet. Wallet balance cannot be less than 100 after checkout"})
+	paymentReference := utils.GeneratePaymentReference()
+	order, err := CreateOrder(c, db, checkoutBody, totals, &paymentReference)
+	if errors.Is(err, utils.ErrInsufficientWalletBalance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	paymentReference := utils.GeneratePaymentReference()
-	order, err := CreateOrder(c, db, checkoutBody, &paymentReference)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order " + err.Error()})
 		return
 	}
 
-	transaction := data.WalletTransactions{
-		ID:                   primitive.NewObjectID(),
-		PaymentTransactionId: paymentReference,
-		UserId:               userObjectId,
-		Amount:               checkoutBody.TotalPrice,
-		Type:                 "debit",
-		CreatedAt:            time.Now(),
-	}
-
-	_, err = walletTransactionCollection.InsertOne(c, transaction)
-	if err != nil {
-		slog.Info("unable to create transaction", "error", err.Error())
-	}
-
 	c.JSON(http.StatusOK, *order)
 
 	utils.SendSuccessfulOrderNotificationToCustomer(c, db, fcm, &user)
-	utils.SendNewOrderNotificationToRiders(c, db, fcm)
-	utils.SendNewOrderNotificationToMerchant(c, db, fcm, order)
+	if order.DispatchedAt != nil {
+		utils.SendNewOrderNotificationToMerchant(c, db, fcm, order)
+	}
 
 }
 
-func CheckoutFromCard(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody, fcm *messaging.Client) {
+func CheckoutFromCard(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody, totals *CheckoutTotals, fcm *messaging.Client) {
 
 	if checkoutBody.CardId == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "cardId cannot be empty"})
@@ -201,96 +254,43 @@ func CheckoutFromCard(c *gin.Context, db *mongo.Database, checkoutBody *Checkout
 		return
 	}
 
-	cardAuthCode := selectedCard.AuthorizationCode
-
-	chargeRequestBody := map[string]interface{}{
-		"email":              user.Email,
-		"amount":             strconv.FormatFloat(checkoutBody.TotalPrice*100, 'f', 2, 64),
-		"authorization_code": cardAuthCode,
-		"metadata": map[string]interface{}{
-			"type": "card",
-		},
-	}
-
-	url := "https://api.paystack.co/transaction/charge_authorization"
-	apiKey := os.Getenv("PAYSTACK_SECRET_KEY")
-
-	payload, err := json.Marshal(chargeRequestBody)
+	reference, err := payments.ChargeAuthorization(user.Email, selectedCard.AuthorizationCode, totals.TotalPrice)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode request"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed chackout payment. " + err.Error()})
 		return
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	order, err := CreateOrder(c, db, checkoutBody, totals, &reference)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order " + err.Error()})
+		refundFailedCheckout(c, db, userObjectId, reference, totals.TotalPrice)
 		return
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to make request"})
-		return
-	}
-	defer resp.Body.Close()
+	c.JSON(http.StatusOK, *order)
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
-		return
+	utils.SendSuccessfulOrderNotificationToCustomer(c, db, fcm, &user)
+	if order.DispatchedAt != nil {
+		utils.SendNewOrderNotificationToMerchant(c, db, fcm, order)
 	}
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-
-		var responseData map[string]interface{}
-		if err := json.Unmarshal(body, &responseData); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unmarshaling JSON into map"})
-			return
-		}
-
-		status := responseData["data"].(map[string]interface{})["status"].(string)
-		gatewayResponse := responseData["data"].(map[string]interface{})["gateway_response"].(string)
-		reference := responseData["data"].(map[string]interface{})["reference"].(string)
-
-		if status != "success" && gatewayResponse != "Approved" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed chackout payment"})
-			return
-		}
-
-		order, err := CreateOrder(c, db, checkoutBody, &reference)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order " + err.Error()})
-			return
-		}
-
-		c.JSON(http.StatusOK, *order)
+}
 
-		utils.SendSuccessfulOrderNotificationToCustomer(c, db, fcm, &user)
-		utils.SendNewOrderNotificationToRiders(c, db, fcm)
-		utils.SendNewOrderNotificationToMerchant(c, db, fcm, order)
+// refundFailedCheckout gives back a card charge whose order could not be created.
+func refundFailedCheckout(c *gin.Context, db *mongo.Database, userId primitive.ObjectID, reference string, amount float64) {
 
-		return
-
-	} else {
-		var errorResponse map[string]interface{}
-		jsonErr := json.Unmarshal(body, &errorResponse)
-		if jsonErr != nil {
-			fmt.Println("Error unmarshaling error response:", jsonErr)
-			fmt.Println("Raw body:", string(body))
-			c.JSON(http.StatusInternalServerError, errorResponse)
-			return
-		}
-		c.JSON(http.StatusInternalServerError, errorResponse)
+	refund := payments.NewCardRefund(userId, nil, reference, amount)
+	if _, err := db.Collection(utils.REFUND).InsertOne(c, refund); err != nil {
+		slog.Error("Failed to record refund for failed checkout", "reference", reference, "error", err.Error())
 		return
 	}
 
+	if err := payments.RequestRefund(c, db, &refund); err != nil {
+		slog.Error("Failed to refund failed checkout", "reference", reference, "refundId", refund.ID.Hex(), "error", err.Error())
+	}
 }
 
-func CreateOrder(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody, paymentReferenceId *string) (*data.Order, error) {
+func CreateOrder(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody, totals *CheckoutTotals, paymentReferenceId *string) (*data.Order, error) {
 
 	var orderToCreate *data.Order
 
@@ -304,6 +304,11 @@ func CreateOrder(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody,
 		return nil, err
 	}
 
+	deliveryCode, err := utils.GenerateDeliveryCode()
+	if err != nil {
+		return nil, err
+	}
+
 	orderTransactionCollection := db.Collection(utils.ORDER_TRANSACTIONS)
 	orderCollection := db.Collection(utils.ORDER)
 	cartCollection := db.Collection(utils.CART)
@@ -329,51 +334,64 @@ func CreateOrder(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody,
 			return nil, fmt.Errorf("valid user not found")
 		}
 
-		virtualAccount := user.VirtualBankAccount
-
-		cartId, err := primitive.ObjectIDFromHex(checkoutBody.CartId)
-		if err != nil {
-			return nil, err
-		}
-		storeId, err := primitive.ObjectIDFromHex(checkoutBody.StoreId)
-		if err != nil {
-			return nil, err
-		}
+		cartId := totals.CartID
+		storeId := totals.StoreID
 
 		orderTransaction := data.OrderTransaction{
 			ID:                     primitive.NewObjectID(),
 			CartID:                 &cartId,
 			CustomerID:             userObjectId,
-			TotalPrice:             checkoutBody.TotalPrice,
+			TotalPrice:             totals.TotalPrice,
 			VendorID:               storeId,
 			TransactionReferenceID: *paymentReferenceId,
 			CreatedAt:              time.Now(),
 			UpdatedAt:              time.Now(),
 		}
 
-		orderStatus := "ongoing"
-		orderProgressStatus := "orderReceivedByVendor"
+		orderStatus := data.OrderStatusOngoing
+		orderProgressStatus := data.OrderCreated
 		createdAt := time.Now()
 
+		// Scheduled orders are held back from the vendor and riders until the dispatcher picks them up,
+		// and the vendor's time to respond only starts then.
+		var dispatchedAt, vendorResponseDeadline *time.Time
+		if checkoutBody.ScheduledFor == nil {
+			deadline := createdAt.Add(utils.VendorResponseTimeout())
+			dispatchedAt = &createdAt
+			vendorResponseDeadline = &deadline
+		}
+
 		order := data.Order{
-			ID:                  primitive.NewObjectID(),
-			CartID:              cartId,
-			CustomerID:          userObjectId,
-			StoreID:             storeId,
-			DeliveryInstruction: checkoutBody.DeliveryInstruction,
-			DeliveryLocation:    checkoutBody.DeliveryLocation,
-			DeliveryMapLocation: checkoutBody.DeliveryMapLocation,
-			Code:                strconv.Itoa(checkoutBody.Code),
-			Status:              &orderStatus,
-			OrderProgressStatus: &orderProgressStatus,
-			Price:               checkoutBody.TotalPrice,
-			ServiceCharge:       &checkoutBody.ServiceCharge,
-			DeliveryFee:         &checkoutBody.DeliveryFee,
-			CouponPrice:         checkoutBody.CouponPrice,
-			IsPaidFor:           true,
-			OrderTransactionID:  &orderTransaction.ID,
-			CreatedAt:           &createdAt,
-			UpdatedAt:           &createdAt,
+			ID:                     primitive.NewObjectID(),
+			CartID:                 cartId,
+			CustomerID:             userObjectId,
+			StoreID:                storeId,
+			DeliveryInstruction:    checkoutBody.DeliveryInstruction,
+			DeliveryLocation:       checkoutBody.DeliveryLocation,
+			DeliveryMapLocation:    checkoutBody.DeliveryMapLocation,
+			Code:                   deliveryCode,
+			Status:                 &orderStatus,
+			OrderProgressStatus:    &orderProgressStatus,
+			Price:                  totals.TotalPrice,
+			ServiceCharge:          &totals.ServiceCharge,
+			DeliveryFee:            &totals.DeliveryFee,
+			CouponPrice:            &totals.CouponPrice,
+			CouponType:             totals.CouponType,
+			Tip:                    totals.TipAmount(),
+			LineItems:              totals.LineItems(),
+			PaymentMethod:          checkoutBody.CheckoutType,
+			PaymentReference:       paymentReferenceId,
+			IsPaidFor:              true,
+			OrderTransactionID:     &orderTransaction.ID,
+			ScheduledFor:           checkoutBody.ScheduledFor,
+			DispatchedAt:           dispatchedAt,
+			VendorResponseDeadline: vendorResponseDeadline,
+			CreatedAt:              &createdAt,
+			UpdatedAt:              &createdAt,
+		}
+
+		if err := reserveStock(sessCtx, db, totals.Items); err != nil {
+			return nil, err
 		}
 
 		_, err = orderTransactionCollection.InsertOne(sessCtx, orderTransaction)
@@ -386,23 +404,35 @@ func CreateOrder(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody,
 			return nil, err
 		}
 
+		if err := utils.RecordOrderTransition(sessCtx, db, data.OrderTimelineEntry{
+			OrderID:        order.ID,
+			ActorID:        &userObjectId,
+			ActorRole:      data.ActorCustomer,
+			ProgressStatus: orderProgressStatus,
+			Status:         orderStatus,
+		}); err != nil {
+			return nil, err
+		}
+
 		cartCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": order.CartID}, bson.M{
 			"$set": bson.M{
 				"isCompleted": true,
 			},
 		})
 
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": userObjectId}, bson.M{
-			"$set": bson.M{
-				"currentCartId": nil,
+		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": userObjectId, "currentCartId": order.CartID}, bson.M{
+			"$unset": bson.M{
+				"currentCartId": "",
 			},
 		})
 
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": userObjectId}, bson.M{
-			"$set": bson.M{
-				"virtualBankAccount.balance": virtualAccount.Balance - order.Price,
-			},
-		})
+		// Card orders were paid for at Paystack, so only wallet orders come out of the balance. The
+		// balance is checked as part of the debit, so concurrent spends can't take it below the minimum.
+		if order.PaymentMethod == "wallet" {
+			if err := utils.DebitCustomerWallet(sessCtx, db, userObjectId, order.ID, order.Price, "order checkout"); err != nil {
+				return nil, err
+			}
+		}
 
 		orderToCreate = &order
 
@@ -426,7 +456,11 @@ func MarkOrderAsComplete(c *gin.Context, db *mongo.Database) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "error binding json " + err.Error()})
 		return
 	}
-	code := requestBody["code"].(string)
+	code, ok := requestBody["code"].(string)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code cannot be empty"})
+		return
+	}
 
 	orderObjectId, err := primitive.ObjectIDFromHex(orderStringId)
 	if err != nil {
@@ -436,10 +470,6 @@ func MarkOrderAsComplete(c *gin.Context, db *mongo.Database) {
 
 	orderCheckoutCollection := db.Collection(utils.ORDER_CHECKOUT_SETTINGS)
 	orderCollection := db.Collection(utils.ORDER)
-	walletTransactionCollection := db.Collection(utils.WALLET_TRANSACTIONS)
-	userCollection := db.Collection(utils.USER)
-	deliveryServiceCollection := db.Collection(utils.DELIVERY_SERVICE)
-	boiboiCollection := db.Collection(utils.BOIBOI_ACCOUNT)
 
 	var order data.Order
 	if err := orderCollection.FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
@@ -447,18 +477,55 @@ func MarkOrderAsComplete(c *gin.Context, db *mongo.Database) {
 		return
 	}
 
-	if code != order.Code {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong order code inputted "})
+	if order.CurrentStatus() == data.OrderStatusCompleted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as completed already"})
 		return
 	}
 
-	if *order.Status == "completed" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as completed already"})
+	if order.CurrentStatus() == data.OrderStatusCancelled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as cancelled already"})
 		return
 	}
 
-	if *order.Status == "cancelled" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as cancelled already"})
+	actorRole, actorId, err := utils.ResolveOrderActor(c, db, c.GetString("userId"), &order)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	if order.RiderID == nil || *order.RiderID != *actorId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the assigned rider can complete this order"})
+		return
+	}
+
+	previousProgressStatus := order.CurrentProgressStatus()
+	if err := previousProgressStatus.CanComplete(actorRole); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	maxCodeAttempts := utils.DeliveryCodeMaxAttempts()
+	if order.CodeAttempts >= maxCodeAttempts {
+		c.JSON(http.StatusForbidden, gin.H{"error": "too many wrong codes entered. contact support to get a new code"})
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(code), []byte(order.Code)) != 1 {
+		// Only count the attempt while the order is still under the limit, so concurrent guesses
+		// can't go past it.
+		result, err := orderCollection.UpdateOne(c, bson.M{"_id": order.ID, "codeAttempts": bson.M{"$not": bson.M{"$gte": maxCodeAttempts}}}, bson.M{
+			"$inc": bson.M{"codeAttempts": 1},
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record code attempt. " + err.Error()})
+			return
+		}
+		if result.ModifiedCount == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "too many wrong codes entered. contact support to get a new code"})
+			return
+		}
+
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong order code inputted", "attemptsLeft": max(maxCodeAttempts-order.CodeAttempts-1, 0)})
 		return
 	}
 
@@ -476,163 +543,88 @@ func MarkOrderAsComplete(c *gin.Context, db *mongo.Database) {
 			return nil, err
 		}
 
-		delFee := 0.0
-		if order.DeliveryFee != nil {
-			delFee = *order.DeliveryFee
+		// Claim the completion first so an order cancelled in the meantime is never paid out.
+		filter := bson.M{
+			"_id":                 order.ID,
+			"status":              data.OrderStatusOngoing,
+			"orderProgressStatus": previousProgressStatus,
+			"riderId":             *actorId,
 		}
-
-		serviceFee := 0.0
-
-		subTotalPrice := order.Price - delFee
-
-		if subTotalPrice <= 5000 {
-			serviceFee = 0.03 * subTotalPrice
-		} else if subTotalPrice <= 9999 {
-			serviceFee = 0.05 * subTotalPrice
-		} else {
-			serviceFee = 0.07 * subTotalPrice
+		if order.OrderProgressStatus == nil {
+			filter["orderProgressStatus"] = nil
 		}
 
-		amountToPayToStore := subTotalPrice - serviceFee
-		amountToPayToRider := delFee
-		amountToPayToBoiboi := serviceFee
-
-		var vendorAdmin data.User
-		if err := userCollection.FindOne(sessCtx, bson.M{"storeId": order.StoreID}).Decode(&vendorAdmin); err != nil {
-			return nil, fmt.Errorf("no vendor admin connected to store. " + err.Error())
+		result, err := orderCollection.UpdateOne(sessCtx, filter, bson.M{
+			"$set": bson.M{
+				"status":    data.OrderStatusCompleted,
+				"updatedAt": time.Now(),
+			},
+		})
+		if err != nil {
+			return nil, err
 		}
-
-		vendorTransaction := data.WalletTransactions{
-			ID:        primitive.NewObjectID(),
-			UserId:    vendorAdmin.ID,
-			Amount:    amountToPayToStore,
-			Type:      "credit",
-			CreatedAt: time.Now(),
+		if result.MatchedCount == 0 {
+			return nil, ErrOrderNotOngoing
 		}
 
-		if err := userCollection.FindOneAndUpdate(sessCtx, bson.M{"storeId": order.StoreID}, bson.M{
-			"$inc": bson.M{
-				"virtualBankAccount.balance": amountToPayToStore,
-			},
-		}).Err(); err != nil {
+		amountToPayToStore, amountToPayToRider, amountToPayToBoiboi := utils.OrderPayoutSplit(&order)
+
+		if err := utils.CreditStore(sessCtx, db, order.StoreID, order.ID, amountToPayToStore, "order payment"); err != nil {
 			return nil, err
 		}
 
-		var rider data.User
-		if err := userCollection.FindOne(sessCtx, bson.M{"_id": order.RiderID}).Decode(&rider); err != nil {
+		if err := utils.CreditRider(sessCtx, db, *order.RiderID, order.ID, amountToPayToRider, "delivery payment"); err != nil {
 			return nil, err
 		}
 
-		var deliveryService data.DeliveryService
-		if err := deliveryServiceCollection.FindOne(sessCtx, bson.M{"_id": rider.DeliveryService}).Decode(&deliveryService); err != nil {
-			return nil, fmt.Errorf("no delivery service found. " + err.Error())
+		if err := utils.CreditPlatform(sessCtx, db, amountToPayToBoiboi); err != nil {
+			return nil, err
 		}
 
-		if deliveryService.SignupCode == "BBP2P" {
-
-			_, err := userCollection.UpdateOne(sessCtx, bson.M{"_id": rider.ID}, bson.M{"$inc": bson.M{
-				"p2pBalance": amountToPayToRider,
-			}})
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update rider balance"})
-				return nil, fmt.Errorf("failed to update rider balance. " + err.Error())
-			}
-
-			riderTransaction := data.WalletTransactions{
-				ID:        primitive.NewObjectID(),
-				UserId:    rider.ID,
-				Amount:    amountToPayToRider,
-				Type:      "credit",
-				CreatedAt: time.Now(),
-			}
-
-			_, err = walletTransactionCollection.InsertOne(sessCtx, vendorTransaction)
-			if err != nil {
-				return nil, err
-			}
-
-			_, err = walletTransactionCollection.InsertOne(sessCtx, riderTransaction)
-			if err != nil {
-				return nil, err
-			}
-
-			if err := boiboiCollection.FindOneAndUpdate(sessCtx, bson.M{}, bson.M{
-				"$inc": bson.M{
-					"balance": amountToPayToBoiboi,
-				},
-			}).Err(); err != nil {
-				return nil, err
-			}
-
-			orderCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": orderObjectId}, bson.M{
-				"$set": bson.M{
-					"status": "completed",
-				},
-			})
-
-			orderStatus := "completed"
-			order.Status = &orderStatus
-		} else {
-			var deliveryAdmin data.User
-			if err := userCollection.FindOne(sessCtx, bson.M{"deliveryService": rider.DeliveryService, "isAdmin": true}).Decode(&deliveryAdmin); err != nil {
-				return nil, fmt.Errorf("no delivery service admin connected to delivery service")
-			}
-
-			riderTransaction := data.WalletTransactions{
-				ID:        primitive.NewObjectID(),
-				UserId:    deliveryAdmin.ID,
-				Amount:    amountToPayToRider,
-				Type:      "credit",
-				CreatedAt: time.Now(),
-			}
-
-			userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": deliveryAdmin.ID}, bson.M{
-				"$inc": bson.M{
-					"virtualBankAccount.balance": amountToPayToRider,
-				},
-			})
-
-			_, err := walletTransactionCollection.InsertOne(sessCtx, vendorTransaction)
-			if err != nil {
-				return nil, err
-			}
-
-			_, err = walletTransactionCollection.InsertOne(sessCtx, riderTransaction)
-			if err != nil {
-				return nil, err
-			}
-
-			if err := boiboiCollection.FindOneAndUpdate(sessCtx, bson.M{}, bson.M{
-				"$inc": bson.M{
-					"balance": amountToPayToBoiboi,
-				},
-			}).Err(); err != nil {
-				return nil, err
-			}
-
-			if err := orderCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": orderObjectId}, bson.M{
-				"$set": bson.M{
-					"status": "completed",
-				},
-			}).Err(); err != nil {
+		if tip := order.CheckoutTip(); tip > 0 {
+			if err := utils.TipRider(sessCtx, db, *order.RiderID, order.ID, tip); err != nil {
 				return nil, err
 			}
+		}
 
-			orderStatus := "completed"
-			order.Status = &orderStatus
+		previousStatus := data.OrderStatusOngoing
+		if err := utils.RecordOrderTransition(sessCtx, db, data.OrderTimelineEntry{
+			OrderID:                order.ID,
+			ActorID:                actorId,
+			ActorRole:              actorRole,
+			PreviousProgressStatus: &previousProgressStatus,
+			ProgressStatus:         previousProgressStatus,
+			PreviousStatus:         &previousStatus,
+			Status:                 data.OrderStatusCompleted,
+		}); err != nil {
+			return nil, err
 		}
 
 		return nil, nil
 
 	})
 
+	if err == ErrOrderNotOngoing {
+		c.JSON(http.StatusConflict, gin.H{"error": "order changed while completing, please refresh and try again"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error marking order as complete " + err.Error()})
 		return
 	}
 
+	orderStatus := data.OrderStatusCompleted
+	order.Status = &orderStatus
+
+	if err := utils.LockOrderConversation(c, db, order.ID); err != nil {
+		slog.Error("Failed to lock order conversation", "orderId", order.ID.Hex(), "error", err.Error())
+	}
+
+	order.HideCodeFrom(c.GetString("userId"))
 	c.JSON(http.StatusOK, order)
 
+	sendOrderReceipt(c, db, &order)
+
 }
 
 func CancelOrder(c *gin.Context, db *mongo.Database) {
@@ -647,8 +639,6 @@ func CancelOrder(c *gin.Context, db *mongo.Database) {
 	}
 
 	orderCollection := db.Collection(utils.ORDER)
-	userCollection := db.Collection(utils.USER)
-	walletTransactionCollection := db.Collection(utils.WALLET_TRANSACTIONS)
 
 	var order data.Order
 
@@ -657,62 +647,32 @@ func CancelOrder(c *gin.Context, db *mongo.Database) {
 		return
 	}
 
-	if *order.Status == "cancelled" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as cancelled already"})
+	if order.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as " + string(order.CurrentStatus()) + " already"})
 		return
 	}
 
-	if order.RiderID != nil && order.CustomerID.Hex() == associatedUserStringId {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "you can't cancel an order that has been assigned"})
+	actorRole, actorId, err := utils.ResolveOrderActor(c, db, associatedUserStringId, &order)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
 	}
 
-	session, err := db.Client().StartSession()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to start db transaction session: "})
+	err = CancelAndRefundOrder(c, db, &order, actorRole, actorId, nil)
+	if err == ErrCancellationNotAllowed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err == ErrOrderNotOngoing {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
 	}
-	defer session.EndSession(c)
-
-	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
-
-		orderCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": orderObjectId}, bson.M{
-			"$set": bson.M{
-				"status": "cancelled",
-			},
-		})
-
-		orderStatus := "cancelled"
-		order.Status = &orderStatus
-
-		userCollection.FindOneAndUpdate(sessCtx, bson.M{"_id": order.CustomerID}, bson.M{
-			"$inc": bson.M{
-				"virtualBankAccount.balance": order.Price,
-			},
-		})
-
-		transaction := data.WalletTransactions{
-			ID:                   primitive.NewObjectID(),
-			PaymentTransactionId: utils.GeneratePaymentReference(),
-			UserId:               order.CustomerID,
-			Amount:               order.Price,
-			Type:                 "credit",
-			CreatedAt:            time.Now(),
-		}
-
-		_, err = walletTransactionCollection.InsertOne(sessCtx, transaction)
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, nil
-	})
-
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error marking order as cancelled " + err.Error()})
 		return
 	}
 
+	order.HideCodeFrom(associatedUserStringId)
 	c.JSON(http.StatusOK, order)
 
 }
@@ -737,72 +697,183 @@ func UpdateOrderState(c *gin.Context, db *mongo.Database, fcm *messaging.Client)
 		return
 	}
 
-	fmt.Println("omooo wetin dey sup")
+	nextProgressStatus := data.OrderProgressStatus(orderState.Status)
+	if !nextProgressStatus.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "not a valid order progress status"})
+		return
+	}
 
-	if orderState.Status == "orderCreated" || orderState.Status == "orderReceivedByVendor" ||
-		orderState.Status == "orderAcceptedByRider" || orderState.Status == "riderAtVendor" ||
-		orderState.Status == "riderOnHisWay" || orderState.Status == "riderAtUserLocation" {
+	orderCollection := db.Collection(utils.ORDER)
 
-		orderCollection := db.Collection(utils.ORDER)
+	var order data.Order
+	if err := orderCollection.FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
 
-		if orderState.Status == "orderAcceptedByRider" {
+	if order.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as " + string(order.CurrentStatus()) + " already"})
+		return
+	}
 
-			riderIdStr := c.GetString("userId")
+	resolveActor := utils.ResolveOrderActor
+	if nextProgressStatus == data.OrderAcceptedByRider {
+		resolveActor = utils.ResolveOrderClaimant
+	}
 
-			slog.Info("Adding riderId ", "msg", riderIdStr)
+	actorRole, actorId, err := resolveActor(c, db, c.GetString("userId"), &order)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 
-			riderId, err := primitive.ObjectIDFromHex(riderIdStr)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid userId associated with request. " + err.Error()})
-				slog.Info("Invalid userId associated with request", "error", err)
-				return
-			}
+	// Accepting goes through VendorAcceptOrder, which holds back scheduled orders and records the prep time.
+	if actorRole == data.ActorVendor && nextProgressStatus == data.OrderReceivedByVendor {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "accept orders with PATCH /orders/{id}/accept"})
+		return
+	}
 
-			_, err = orderCollection.UpdateOne(c, bson.M{"_id": orderObjectId}, bson.M{
-				"$set": bson.M{
-					"riderId": riderId,
-				},
-			})
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update riderId " + err.Error()})
-				slog.Info("Failed to update riderId", "error", err)
-				return
-			}
-		}
+	if actorRole == data.ActorRider && order.DispatchedAt == nil && order.ScheduledFor != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order is scheduled and not yet open to riders"})
+		return
+	}
 
-		_, err = orderCollection.UpdateOne(c, bson.M{"_id": orderObjectId}, bson.M{
-			"$set": bson.M{
-				"orderProgressStatus": orderState.Status,
-			},
-		})
+	if nextProgressStatus == data.OrderAcceptedByRider && order.RiderID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "order has already been claimed by another rider"})
+		return
+	}
+
+	previousProgressStatus := order.CurrentProgressStatus()
+	if err := previousProgressStatus.CanTransitionTo(nextProgressStatus, actorRole); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
+	// The rider can't leave with the order while the customer is still deciding what goes in it.
+	if nextProgressStatus == data.RiderOnHisWay {
+		pending, err := db.Collection(utils.SUBSTITUTION).CountDocuments(c, bson.M{"orderId": order.ID, "status": data.SubstitutionPending})
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order progress status " + err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check substitutions. " + err.Error()})
 			return
 		}
+		if pending > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "the customer hasn't answered the store's changes to the order yet"})
+			return
+		}
+	}
+
+	// Riders can only claim orders that were offered to them.
+	if nextProgressStatus == data.OrderAcceptedByRider {
+		if _, err := dispatch.FindActiveOffer(c, db, order.ID, *actorId); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
-		c.JSON(http.StatusOK, gin.H{"message": "successfully updated order progress status"})
+	filter := bson.M{"_id": orderObjectId, "status": data.OrderStatusOngoing}
+	if order.OrderProgressStatus == nil {
+		filter["orderProgressStatus"] = bson.M{"$exists": false}
+	} else {
+		filter["orderProgressStatus"] = previousProgressStatus
+	}
 
-		var order data.Order
-		if err := orderCollection.FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
-			slog.Info("error fetching order", "error", err.Error())
+	update := bson.M{
+		"orderProgressStatus": nextProgressStatus,
+		"updatedAt":           time.Now(),
+	}
+
+	// Accepting is a claim: it only succeeds while no other rider holds the order,
+	// so two riders accepting at once can't both win.
+	if nextProgressStatus == data.OrderAcceptedByRider {
+		slog.Info("Adding riderId ", "msg", actorId.Hex())
+		filter["riderId"] = nil
+		update["riderId"] = *actorId
+	}
+
+	result, err := orderCollection.UpdateOne(c, filter, bson.M{"$set": update})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order progress status " + err.Error()})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		if nextProgressStatus == data.OrderAcceptedByRider {
+			c.JSON(http.StatusConflict, gin.H{"error": "order has already been claimed by another rider"})
+			return
 		}
-		utils.SendOrderUpdateToCustomer(c, db, fcm, &order)
+		c.JSON(http.StatusConflict, gin.H{"error": "order progress status changed while updating, please refresh and try again"})
+		return
+	}
+
+	if nextProgressStatus == data.OrderAcceptedByRider {
+		if err := dispatch.CloseOffers(c, db, order.ID, *actorId); err != nil {
+			slog.Error("Failed to close dispatch offers", "orderId", order.ID.Hex(), "error", err.Error())
+		}
+	}
+
+	orderStatus := order.CurrentStatus()
+	if err := utils.RecordOrderTransition(c, db, data.OrderTimelineEntry{
+		OrderID:                order.ID,
+		ActorID:                actorId,
+		ActorRole:              actorRole,
+		PreviousProgressStatus: &previousProgressStatus,
+		ProgressStatus:         nextProgressStatus,
+		PreviousStatus:         &orderStatus,
+		Status:                 orderStatus,
+	}); err != nil {
+		slog.Error("Failed to record order transition", "error", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "successfully updated order progress status"})
 
+	if err := orderCollection.FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
+		slog.Info("error fetching order", "error", err.Error())
+	}
+	utils.SendOrderUpdateToCustomer(c, db, fcm, &order)
+	if nextProgressStatus == data.OrderReceivedByVendor {
+		if err := dispatch.DispatchNextWave(c, db, fcm, &order); err != nil {
+			slog.Error("Failed to dispatch order", "orderId", order.ID.Hex(), "error", err.Error())
+		}
+	}
+
+}
+
+func GetOrderTimeline(c *gin.Context, db *mongo.Database) {
+
+	orderObjectId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
 		return
+	}
 
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "not a valid order progress status"})
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if _, _, err := utils.ResolveOrderActor(c, db, c.GetString("userId"), &order); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	timeline, err := utils.GetOrderTimeline(c, db, orderObjectId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order timeline. " + err.Error()})
+		slog.Info("Failed to get order timeline", "error", err)
 		return
 	}
 
+	c.JSON(http.StatusOK, timeline)
+
 }
 
 type OrderData struct {
 	data.Order `bson:",inline"`
-	Store      data.Store `json:"store"`
-	Customer   data.User  `json:"customer"`
-	Cart       data.Cart  `json:"cart"`
+	Store      data.Store      `json:"store"`
+	Customer   data.User       `json:"customer"`
+	Cart       data.Cart       `json:"cart"`
+	ETA        *utils.OrderETA `bson:"-" json:"eta,omitempty"` // only on a single ongoing order with a tracked rider
 }
 
 func GetOrders(c *gin.Context, db *mongo.Database) {
@@ -874,25 +945,39 @@ func GetOrders(c *gin.Context, db *mongo.Database) {
 		}},
 		{"$unwind": "$cart"},
 		{"$project": bson.M{
-			"_id":                 1,
-			"cartId":              1,
-			"customerId":          1,
-			"storeId":             1,
-			"riderId":             1,
-			"deliveryInstruction": 1,
-			"deliveryLocation":    1,
-			"deliveryMapLocation": 1,
-			"code":                1,
-			"status":              1,
-			"orderProgressStatus": 1,
-			"price":               1,
-			"serviceCharge":       1,
-			"deliveryFee":         1,
-			"couponPrice":         1,
-			"isPaidFor":           1,
-			"orderTransactionID":  1,
-			"createdAt":           1,
-			"updatedAt":           1,
+			"_id":                     1,
+			"cartId":                  1,
+			"customerId":              1,
+			"storeId":                 1,
+			"riderId":                 1,
+			"deliveryInstruction":     1,
+			"deliveryLocation":        1,
+			"deliveryMapLocation":     1,
+			"code":                    1,
+			"status":                  1,
+			"orderProgressStatus":     1,
+			"price":                   1,
+			"serviceCharge":           1,
+			"deliveryFee":             1,
+			"couponPrice":             1,
+			"lineItems":               1,
+			"couponType":              1,
+			"substitutionWalletDelta": 1,
+			"paymentMethod":           1,
+			"paymentReference":        1,
+			"tip":                     1,
+			"postDeliveryTip":         1,
+			"scheduledFor":            1,
+			"dispatchedAt":            1,
+			"vendorResponseDeadline":  1,
+			"vendorRating":            1,
+			"vendorReviewId":          1,
+			"riderRating":             1,
+			"riderReviewId":           1,
+			"isPaidFor":               1,
+			"orderTransactionID":      1,
+			"createdAt":               1,
+			"updatedAt":               1,
 			"store": bson.M{
 				"_id":   "$store._id",
 				"name":  "$store.name",
@@ -923,6 +1008,10 @@ func GetOrders(c *gin.Context, db *mongo.Database) {
 		return
 	}
 
+	for i := range ordersData {
+		ordersData[i].HideCodeFrom(c.GetString("userId"))
+	}
+
 	c.JSON(http.StatusOK, ordersData)
 
 }
@@ -963,25 +1052,39 @@ func GetOrder(c *gin.Context, db *mongo.Database) {
 		}},
 		{"$unwind": "$cart"},
 		{"$project": bson.M{
-			"_id":                 1,
-			"cartId":              1,
-			"customerId":          1,
-			"storeId":             1,
-			"riderId":             1,
-			"deliveryInstruction": 1,
-			"deliveryLocation":    1,
-			"deliveryMapLocation": 1,
-			"code":                1,
-			"status":              1,
-			"orderProgressStatus": 1,
-			"price":               1,
-			"serviceCharge":       1,
-			"deliveryFee":         1,
-			"couponPrice":         1,
-			"isPaidFor":           1,
-			"orderTransactionID":  1,
-			"createdAt":           1,
-			"updatedAt":           1,
+			"_id":                     1,
+			"cartId":                  1,
+			"customerId":              1,
+			"storeId":                 1,
+			"riderId":                 1,
+			"deliveryInstruction":     1,
+			"deliveryLocation":        1,
+			"deliveryMapLocation":     1,
+			"code":                    1,
+			"status":                  1,
+			"orderProgressStatus":     1,
+			"price":                   1,
+			"serviceCharge":           1,
+			"deliveryFee":             1,
+			"couponPrice":             1,
+			"lineItems":               1,
+			"couponType":              1,
+			"substitutionWalletDelta": 1,
+			"paymentMethod":           1,
+			"paymentReference":        1,
+			"tip":                     1,
+			"postDeliveryTip":         1,
+			"scheduledFor":            1,
+			"dispatchedAt":            1,
+			"vendorResponseDeadline":  1,
+			"vendorRating":            1,
+			"vendorReviewId":          1,
+			"riderRating":             1,
+			"riderReviewId":           1,
+			"isPaidFor":               1,
+			"orderTransactionID":      1,
+			"createdAt":               1,
+			"updatedAt":               1,
 			"store": bson.M{
 				"_id":   "$store._id",
 				"name":  "$store.name",
@@ -1019,6 +1122,19 @@ func GetOrder(c *gin.Context, db *mongo.Database) {
 
 	defer cursor.Close(c)
 
+	// The ETA carries the rider's live location, so only the order's participants may see the order.
+	if _, _, err := utils.ResolveOrderActor(c, db, c.GetString("userId"), &orderData.Order); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	eta, err := utils.GetOrderETA(c, db, &orderData.Order)
+	if err != nil {
+		slog.Error("Failed to get order ETA", "orderId", idStr, "error", err.Error())
+	}
+	orderData.ETA = eta
+
+	orderData.HideCodeFrom(c.GetString("userId"))
 	c.JSON(http.StatusOK, orderData)
 
 }
@@ -0,0 +1,327 @@
+package orders
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// priceTolerance is how far the client's total may drift from ours before we reject it.
+const priceTolerance = 0.01
+
+var ErrOutOfDeliveryRange = errors.New("distance is outside every delivery fee band")
+
+type PricedCartItem struct {
+	CartItem data.CartItem `json:"cartItem"`
+	Item     data.Item     `json:"item"`
+	Total    float64       `json:"total"`
+}
+
+type CheckoutTotals struct {
+	CartID        primitive.ObjectID  `json:"cartId"`
+	StoreID       primitive.ObjectID  `json:"storeId"`
+	Items         []PricedCartItem    `json:"items"`
+	SubTotal      float64             `json:"subTotal"`
+	DeliveryFee   float64             `json:"deliveryFee"`
+	ServiceCharge float64             `json:"serviceCharge"`
+	CouponPrice   float64             `json:"couponPrice"`
+	CouponID      *primitive.ObjectID `json:"couponId,omitempty"`
+	CouponType    *string             `json:"couponType,omitempty"`
+	Tip           float64             `json:"tip"`
+	TotalPrice    float64             `json:"totalPrice"`
+}
+
+// ComputeCheckoutTotals rebuilds the price of a checkout from the cart contents and the
+// configured fees instead of trusting the figures sent by the client.
+func ComputeCheckoutTotals(c *gin.Context, db *mongo.Database, checkoutBody *CheckoutBody, store *data.Store, userId primitive.ObjectID) (*CheckoutTotals, error) {
+
+	cartId, err := primitive.ObjectIDFromHex(checkoutBody.CartId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cartId")
+	}
+
+	var cart data.Cart
+	if err := db.Collection(utils.CART).FindOne(c, bson.M{"_id": cartId}).Decode(&cart); err != nil {
+		return nil, fmt.Errorf("cart not found")
+	}
+
+	if cart.UserID != userId {
+		return nil, fmt.Errorf("cart does not belong to user")
+	}
+
+	if cart.IsCompleted != nil && *cart.IsCompleted {
+		return nil, fmt.Errorf("cart has already been checked out")
+	}
+
+	if cart.StoreID != store.ID {
+		return nil, fmt.Errorf("cart does not belong to store")
+	}
+
+	totals := CheckoutTotals{
+		CartID:  cart.ID,
+		StoreID: store.ID,
+		Items:   []PricedCartItem{},
+	}
+
+	cursor, err := db.Collection(utils.CART_ITEM).Find(c, bson.M{"cartId": cart.ID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+
+	var cartItems []data.CartItem
+	if err := cursor.All(c, &cartItems); err != nil {
+		return nil, err
+	}
+
+	itemCollection := db.Collection(utils.ITEM)
+
+	for _, cartItem := range cartItems {
+		if cartItem.Quantity < 1 {
+			continue
+		}
+
+		var item data.Item
+		if err := itemCollection.FindOne(c, bson.M{"_id": cartItem.ItemID}).Decode(&item); err != nil {
+			return nil, fmt.Errorf("item %s in cart no longer exists", cartItem.ItemID.Hex())
+		}
+
+		if item.Status != nil && *item.Status != "active" {
+			return nil, fmt.Errorf("item %s is no longer available", itemName(&item))
+		}
+
+		if item.StoreID == nil || *item.StoreID != store.ID {
+			return nil, fmt.Errorf("item %s does not belong to store", itemName(&item))
+		}
+
+		if item.Price == nil {
+			return nil, fmt.Errorf("item %s has no price", itemName(&item))
+		}
+
+		if item.CurrentInventory != nil && cartItem.Quantity > *item.CurrentInventory {
+			return nil, fmt.Errorf("only %d of item %s left in stock", *item.CurrentInventory, itemName(&item))
+		}
+
+		lineTotal := *item.Price * float64(cartItem.Quantity)
+
+		totals.Items = append(totals.Items, PricedCartItem{
+			CartItem: cartItem,
+			Item:     item,
+			Total:    utils.RoundToKobo(lineTotal),
+		})
+		totals.SubTotal += lineTotal
+	}
+
+	if len(totals.Items) == 0 {
+		return nil, fmt.Errorf("cart is empty")
+	}
+
+	totals.DeliveryFee, err = computeDeliveryFee(c, db, store, checkoutBody.DeliveryMapLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	totals.ServiceCharge, err = computeServiceCharge(c, db, store)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkoutBody.CouponCode != nil && len(strings.TrimSpace(*checkoutBody.CouponCode)) > 0 {
+		coupon, err := findApplicableCoupon(c, db, strings.TrimSpace(*checkoutBody.CouponCode), store)
+		if err != nil {
+			return nil, err
+		}
+
+		switch coupon.ChargeType {
+		case "percent":
+			totals.CouponPrice = totals.SubTotal * coupon.Discount / 100
+		default:
+			totals.CouponPrice = coupon.Discount
+		}
+
+		totals.CouponPrice = math.Min(totals.CouponPrice, totals.SubTotal)
+		totals.CouponID = &coupon.ID
+		totals.CouponType = &coupon.Type
+	}
+
+	if checkoutBody.Tip != nil {
+		if err := validateTip(*checkoutBody.Tip, true); err != nil {
+			return nil, err
+		}
+		totals.Tip = *checkoutBody.Tip
+	}
+
+	totals.SubTotal = utils.RoundToKobo(totals.SubTotal)
+	totals.DeliveryFee = utils.RoundToKobo(totals.DeliveryFee)
+	totals.ServiceCharge = utils.RoundToKobo(totals.ServiceCharge)
+	totals.CouponPrice = utils.RoundToKobo(totals.CouponPrice)
+	totals.Tip = utils.RoundToKobo(totals.Tip)
+	totals.TotalPrice = utils.RoundToKobo(totals.SubTotal + totals.DeliveryFee + totals.ServiceCharge - totals.CouponPrice + totals.Tip)
+
+	return &totals, nil
+}
+
+// LineItems snapshots the priced cart items for storing on the order.
+func (t *CheckoutTotals) LineItems() []data.OrderLineItem {
+	lineItems := make([]data.OrderLineItem, 0, len(t.Items))
+	for _, pricedItem := range t.Items {
+		lineItems = append(lineItems, data.OrderLineItem{
+			ItemID:    pricedItem.Item.ID,
+			Name:      itemName(&pricedItem.Item),
+			UnitPrice: *pricedItem.Item.Price,
+			Quantity:  pricedItem.CartItem.Quantity,
+			Image:     pricedItem.Item.Image,
+			Category:  pricedItem.Item.Category,
+		})
+	}
+	return lineItems
+}
+
+// TipAmount returns the checkout tip for storing on the order, or nil when there is none.
+func (t *CheckoutTotals) TipAmount() *float64 {
+	if t.Tip <= 0 {
+		return nil
+	}
+	tip := t.Tip
+	return &tip
+}
+
+// MatchesClientTotal reports whether the total the client displayed is the one we will charge.
+func (t *CheckoutTotals) MatchesClientTotal(clientTotal float64) bool {
+	return math.Abs(t.TotalPrice-clientTotal) <= priceTolerance
+}
+
+func computeDeliveryFee(c *gin.Context, db *mongo.Database, store *data.Store, deliveryMapLocation *string) (float64, error) {
+
+	if deliveryMapLocation == nil || len(*deliveryMapLocation) == 0 {
+		return 0, fmt.Errorf("deliveryMapLocation cannot be empty")
+	}
+
+	if store.MapLocation == nil {
+		return 0, fmt.Errorf("store has no map location")
+	}
+
+	storeCoordinates, err := utils.ParseMapLocation(*store.MapLocation)
+	if err != nil {
+		return 0, fmt.Errorf("store has an invalid map location")
+	}
+
+	deliveryCoordinates, err := utils.ParseMapLocation(*deliveryMapLocation)
+	if err != nil {
+		return 0, err
+	}
+
+	deliveryFee, err := DeliveryFeeBetween(c, db, *storeCoordinates, *deliveryCoordinates)
+	if errors.Is(err, ErrOutOfDeliveryRange) {
+		return 0, fmt.Errorf("delivery location is outside the store's delivery range")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return deliveryFee, nil
+}
+
+// DeliveryFeeBetween looks up the configured delivery fee for the distance between two points,
+// using the smallest distance band that covers it.
+func DeliveryFeeBetween(c *gin.Context, db *mongo.Database, from utils.Coordinates, to utils.Coordinates) (float64, error) {
+
+	cursor, err := db.Collection(utils.DELIVERY_FEE).Find(c, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(c)
+
+	var deliveryFees []data.DeliveryFee
+	if err := cursor.All(c, &deliveryFees); err != nil {
+		return 0, err
+	}
+
+	if len(deliveryFees) == 0 {
+		return 0, fmt.Errorf("no delivery fees configured")
+	}
+
+	sort.Slice(deliveryFees, func(i, j int) bool {
+		return deliveryFeeDistanceInKm(deliveryFees[i]) < deliveryFeeDistanceInKm(deliveryFees[j])
+	})
+
+	distance := utils.DistanceInKm(from, to)
+
+	for _, deliveryFee := range deliveryFees {
+		if distance <= deliveryFeeDistanceInKm(deliveryFee) {
+			return deliveryFee.Fee, nil
+		}
+	}
+
+	return 0, ErrOutOfDeliveryRange
+}
+
+func deliveryFeeDistanceInKm(deliveryFee data.DeliveryFee) float64 {
+	switch strings.ToLower(deliveryFee.DistanceUnit) {
+	case "m", "meter", "meters", "metre", "metres":
+		return deliveryFee.Distance / 1000
+	default:
+		return deliveryFee.Distance
+	}
+}
+
+func computeServiceCharge(c *gin.Context, db *mongo.Database, store *data.Store) (float64, error) {
+
+	serviceFeeCollection := db.Collection(utils.SERVICE_FEE)
+
+	var serviceFee data.ServiceFee
+
+	if store.Address != nil {
+		err := serviceFeeCollection.FindOne(c, bson.M{"location": *store.Address}).Decode(&serviceFee)
+		if err == nil {
+			return serviceFee.Fee, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return 0, err
+		}
+	}
+
+	err := serviceFeeCollection.FindOne(c, bson.M{"$or": []bson.M{
+		{"location": bson.M{"$exists": false}},
+		{"location": nil},
+	}}).Decode(&serviceFee)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return serviceFee.Fee, nil
+}
+
+func findApplicableCoupon(c *gin.Context, db *mongo.Database, code string, store *data.Store) (*data.Coupon, error) {
+
+	var coupon data.Coupon
+	if err := db.Collection(utils.COUPON).FindOne(c, bson.M{"code": code, "isActive": true}).Decode(&coupon); err != nil {
+		return nil, fmt.Errorf("invalid or inactive coupon")
+	}
+
+	if coupon.Type == "store" && (coupon.StoreID == nil || *coupon.StoreID != store.ID) {
+		return nil, fmt.Errorf("coupon is not valid for this store")
+	}
+
+	return &coupon, nil
+}
+
+func itemName(item *data.Item) string {
+	if item.Name != nil {
+		return *item.Name
+	}
+	return item.ID.Hex()
+}
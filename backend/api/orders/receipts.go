@@ -0,0 +1,90 @@
+package orders
+
+import (
+	"log/slog"
+	"net/http"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetOrderReceipt godoc
+// @Summary Download an order receipt
+// @Description Get the receipt of a completed order as an HTML page, or as a PDF with format=pdf
+// @Tags Orders
+// @Produce html
+// @Produce application/pdf
+// @Param id path string true "Order ID"
+// @Param format query string false "html or pdf" default(html)
+// @Success 200 {file} file
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/receipt [get]
+// @Security BearerAuth
+func GetOrderReceipt(c *gin.Context, db *mongo.Database) {
+
+	orderObjectId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	format := c.DefaultQuery("format", "html")
+	if format != "html" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be html or pdf"})
+		return
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if order.CustomerID.Hex() != c.GetString("userId") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "order does not belong to user"})
+		return
+	}
+
+	if order.CurrentStatus() != data.OrderStatusCompleted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "receipts are only available for completed orders"})
+		return
+	}
+
+	receipt, err := utils.BuildOrderReceipt(c, db, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build receipt. " + err.Error()})
+		slog.Error("Failed to build receipt", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	if format == "pdf" {
+		c.Header("Content-Disposition", `attachment; filename="receipt-`+receipt.OrderID+`.pdf"`)
+		c.Data(http.StatusOK, "application/pdf", utils.RenderOrderReceiptPDF(receipt))
+		return
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(utils.RenderOrderReceiptHTML(receipt)))
+
+}
+
+// sendOrderReceipt emails the customer the receipt of an order that has just been completed.
+func sendOrderReceipt(c *gin.Context, db *mongo.Database, order *data.Order) {
+
+	receipt, err := utils.BuildOrderReceipt(c, db, order)
+	if err != nil {
+		slog.Error("Failed to build receipt", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	if err := utils.SendOrderReceiptMail(receipt); err != nil {
+		slog.Error("Failed to send receipt", "orderId", order.ID.Hex(), "error", err.Error())
+	}
+}
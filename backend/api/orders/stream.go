@@ -0,0 +1,139 @@
+package orders
+
+import (
+	"net/http"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// streamHeartbeatInterval keeps idle streams from being closed by proxies and load balancers.
+const streamHeartbeatInterval = 25 * time.Second
+
+// CreateStreamToken godoc
+// @Summary Get a token to track an order live
+// @Description Issue a token that opens GET /orders/{id}/stream for this order only. It expires after a minute, so fetch a new one whenever the stream is opened or reconnected
+// @Tags Orders
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {object} object{token=string,expiresAt=string}
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/stream/token [post]
+// @Security BearerAuth
+func CreateStreamToken(c *gin.Context, db *mongo.Database) {
+
+	orderObjectId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	userId := c.GetString("userId")
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if _, _, err := utils.ResolveOrderActor(c, db, userId, &order); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, expiresAt, err := utils.GenerateStreamToken(userId, order.ID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create stream token. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "expiresAt": expiresAt})
+
+}
+
+// StreamOrder godoc
+// @Summary Track an order live
+// @Description Server-Sent Events stream of an order. An "order" event with the current order is sent straight away and again whenever it changes, "riderLocation" events follow the rider, "message" and "messagesRead" events follow the order's conversation, and "substitution" events carry the store's changes to the items when they are proposed and answered. The stream ends after the order is completed or cancelled. The stream is opened with a stream token from POST /orders/{id}/stream/token in the token query parameter, not the login JWT.
+// @Tags Orders
+// @Produce text/event-stream
+// @Param id path string true "Order ID"
+// @Param token query string true "Stream token"
+// @Success 200 {object} utils.OrderEvent
+// @Failure 400 {object} object{error=string}
+// @Failure 401 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Router /orders/{id}/stream [get]
+func StreamOrder(c *gin.Context, db *mongo.Database) {
+
+	orderObjectId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	userId := c.GetString("userId")
+
+	// Subscribe before reading the order so no change can slip in between the two.
+	events, unsubscribe := utils.OrderEvents.Subscribe(orderObjectId)
+	defer unsubscribe()
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if _, _, err := utils.ResolveOrderActor(c, db, userId, &order); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	send := func(event utils.OrderEvent) {
+		if event.Order != nil {
+			redacted := *event.Order
+			redacted.HideCodeFrom(userId)
+			event.Order = &redacted
+		}
+		c.SSEvent(event.Type, event)
+		c.Writer.Flush()
+	}
+
+	send(utils.OrderEvent{Type: utils.OrderEventUpdated, OrderID: order.ID, Order: &order, At: time.Now()})
+	if order.CurrentStatus() != data.OrderStatusOngoing {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		case event := <-events:
+			send(event)
+			if event.Order != nil && event.Order.CurrentStatus() != data.OrderStatusOngoing {
+				return
+			}
+		}
+	}
+
+}
@@ -0,0 +1,690 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"firebase.google.com/go/messaging"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrSubstitutionAnswered = errors.New("substitution has already been answered")
+
+type SubstitutionChangeBody struct {
+	ItemID           string  `json:"itemId"`
+	Action           string  `json:"action"` // replace, remove
+	SubstituteItemID *string `json:"substituteItemId"`
+	Quantity         *int    `json:"quantity"` // of the substitute, defaults to the quantity ordered
+}
+
+type SubstitutionBody struct {
+	Changes []SubstitutionChangeBody `json:"changes"`
+	Note    *string                  `json:"note"`
+}
+
+// substitutionTimeout is how long the customer has to answer a substitution, set with
+// SUBSTITUTION_TIMEOUT_MINUTES.
+func substitutionTimeout() time.Duration {
+	return time.Duration(utils.GetEnvInt("SUBSTITUTION_TIMEOUT_MINUTES", 5)) * time.Minute
+}
+
+// substitutionTimeoutApproves reports whether unanswered substitutions are approved rather than
+// rejected once they time out, set with SUBSTITUTION_TIMEOUT_ACTION. Rejecting is the default so the
+// customer is never charged more without saying yes.
+func substitutionTimeoutApproves() bool {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("SUBSTITUTION_TIMEOUT_ACTION"))) == "approve"
+}
+
+// ProposeSubstitution godoc
+// @Summary Propose substitutes for out-of-stock items
+// @Description Lets the store's merchant replace or remove line items of an open order it can't fulfil. The customer approves or rejects the changes; if they don't answer within SUBSTITUTION_TIMEOUT_MINUTES, SUBSTITUTION_TIMEOUT_ACTION applies. An order can only have one pending substitution, and the rider can't pick the order up until it is answered
+// @Tags Orders
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param substitution body SubstitutionBody true "Changes"
+// @Success 201 {object} data.Substitution
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/substitutions [post]
+// @Security BearerAuth
+func ProposeSubstitution(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	var body SubstitutionBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body " + err.Error()})
+		return
+	}
+
+	if len(body.Changes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one change is required"})
+		return
+	}
+
+	var note *string
+	if body.Note != nil && len(strings.TrimSpace(*body.Note)) > 0 {
+		trimmed := strings.TrimSpace(*body.Note)
+		if len(trimmed) > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "note cannot be longer than 500 characters"})
+			return
+		}
+		note = &trimmed
+	}
+
+	order, actorId, ok := getOrderForVendor(c, db)
+	if !ok {
+		return
+	}
+
+	if !canSubstitute(order) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "items can no longer be changed once the rider has picked up the order"})
+		return
+	}
+
+	if len(order.LineItems) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has no line items to change"})
+		return
+	}
+
+	changes, err := buildSubstitutionChanges(c, db, order, body.Changes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, priceDifference := settleSubstitution(order, changes, true)
+
+	now := time.Now()
+	substitution := data.Substitution{
+		ID:              primitive.NewObjectID(),
+		OrderID:         order.ID,
+		StoreID:         order.StoreID,
+		CustomerID:      order.CustomerID,
+		ProposedBy:      *actorId,
+		Changes:         changes,
+		Note:            note,
+		PriceDifference: priceDifference,
+		Status:          data.SubstitutionPending,
+		ExpiresAt:       now.Add(substitutionTimeout()),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	if _, err := db.Collection(utils.SUBSTITUTION).InsertOne(c, substitution); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "order already has a substitution waiting for the customer"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to propose substitution. " + err.Error()})
+		slog.Error("Failed to propose substitution", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, substitution)
+
+	publishSubstitution(&substitution)
+
+	utils.SendSubstitutionNotificationToCustomer(c, db, fcm, &substitution)
+
+}
+
+// GetOrderSubstitutions godoc
+// @Summary Get an order's substitutions
+// @Description Lists the substitutions proposed on an order, newest first, to its customer, rider and store
+// @Tags Orders
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {array} data.Substitution
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/substitutions [get]
+// @Security BearerAuth
+func GetOrderSubstitutions(c *gin.Context, db *mongo.Database) {
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if _, _, err := utils.ResolveOrderActor(c, db, c.GetString("userId"), &order); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you are not part of this order"})
+		return
+	}
+
+	cursor, err := db.Collection(utils.SUBSTITUTION).Find(c, bson.M{"orderId": order.ID}, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get substitutions. " + err.Error()})
+		return
+	}
+	defer cursor.Close(c)
+
+	substitutions := []data.Substitution{}
+	if err := cursor.All(c, &substitutions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode substitutions. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, substitutions)
+
+}
+
+// ApproveSubstitution godoc
+// @Summary Approve the store's substitution
+// @Description Applies the store's changes to the order. The price difference is taken from or refunded to the customer's wallet
+// @Tags Orders
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param substitutionId path string true "Substitution ID"
+// @Success 200 {object} data.Order
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/substitutions/{substitutionId}/approve [patch]
+// @Security BearerAuth
+func ApproveSubstitution(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+	respondToSubstitution(c, db, fcm, true)
+}
+
+// RejectSubstitution godoc
+// @Summary Reject the store's substitution
+// @Description Takes every item the store couldn't fulfil off the order, without the substitutes, and refunds what they cost to the customer's wallet. An order left with no items is cancelled and refunded in full
+// @Tags Orders
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param substitutionId path string true "Substitution ID"
+// @Success 200 {object} data.Order
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/substitutions/{substitutionId}/reject [patch]
+// @Security BearerAuth
+func RejectSubstitution(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+	respondToSubstitution(c, db, fcm, false)
+}
+
+func respondToSubstitution(c *gin.Context, db *mongo.Database, fcm *messaging.Client, approve bool) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	substitutionId, err := primitive.ObjectIDFromHex(c.Param("substitutionId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid substitution id. " + err.Error()})
+		return
+	}
+
+	var substitution data.Substitution
+	if err := db.Collection(utils.SUBSTITUTION).FindOne(c, bson.M{"_id": substitutionId, "orderId": orderId}).Decode(&substitution); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "substitution not found. " + err.Error()})
+		return
+	}
+
+	if substitution.CustomerID != userId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the customer can answer the store's changes"})
+		return
+	}
+
+	if substitution.Status != data.SubstitutionPending {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrSubstitutionAnswered.Error()})
+		return
+	}
+
+	order, err := ApplySubstitution(c, db, &substitution, approve, data.ActorCustomer, &userId)
+	if errors.Is(err, ErrSubstitutionAnswered) || errors.Is(err, ErrOrderNotOngoing) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, utils.ErrInsufficientWalletBalance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "top up your wallet to approve these changes or reject them. " + err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to answer substitution. " + err.Error()})
+		slog.Error("Failed to answer substitution", "substitutionId", substitution.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	order.HideCodeFrom(userId.Hex())
+	c.JSON(http.StatusOK, order)
+
+	utils.SendSubstitutionAnsweredNotificationToMerchant(c, db, fcm, &substitution)
+
+}
+
+// ExpireSubstitutions answers the substitutions customers haven't answered in time with
+// SUBSTITUTION_TIMEOUT_ACTION. An approval the customer can't pay for, or whose substitutes have run
+// out in the meantime, is rejected instead.
+func ExpireSubstitutions(ctx context.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	cursor, err := db.Collection(utils.SUBSTITUTION).Find(ctx, bson.M{
+		"status":    data.SubstitutionPending,
+		"expiresAt": bson.M{"$lte": time.Now()},
+	})
+	if err != nil {
+		slog.Error("Failed to get expired substitutions", "error", err.Error())
+		return
+	}
+
+	var substitutions []data.Substitution
+	if err := cursor.All(ctx, &substitutions); err != nil {
+		slog.Error("Failed to decode expired substitutions", "error", err.Error())
+		return
+	}
+
+	approve := substitutionTimeoutApproves()
+
+	for _, substitution := range substitutions {
+		order, err := ApplySubstitution(ctx, db, &substitution, approve, data.ActorSystem, nil)
+		if approve && err != nil && !errors.Is(err, ErrSubstitutionAnswered) && !errors.Is(err, ErrOrderNotOngoing) {
+			slog.Info("Rejecting expired substitution that could not be approved", "substitutionId", substitution.ID.Hex(), "error", err.Error())
+			order, err = ApplySubstitution(ctx, db, &substitution, false, data.ActorSystem, nil)
+		}
+		if errors.Is(err, ErrSubstitutionAnswered) || errors.Is(err, ErrOrderNotOngoing) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to expire substitution", "substitutionId", substitution.ID.Hex(), "error", err.Error())
+			continue
+		}
+
+		if order.CurrentStatus() == data.OrderStatusCancelled {
+			utils.SendOrderCancelledNotificationToCustomer(ctx, db, fcm, order)
+		} else {
+			utils.SendSubstitutionExpiredNotificationToCustomer(ctx, db, fcm, &substitution)
+		}
+		utils.SendSubstitutionAnsweredNotificationToMerchant(ctx, db, fcm, &substitution)
+
+		slog.Info("Expired substitution", "substitutionId", substitution.ID.Hex(), "status", substitution.Status)
+	}
+}
+
+// ApplySubstitution settles a pending substitution. Approving swaps in the substitutes and drops
+// the removed items; rejecting drops every affected item. Stock is moved, the order's price is
+// changed and the difference is taken from or refunded to the customer's wallet in one transaction,
+// and also added to substitutionWalletDelta so a cancellation can tell it apart from the card
+// charge. An order left with no items is cancelled and refunded in full instead. It returns
+// ErrSubstitutionAnswered if the substitution was answered in the meantime, ErrOrderNotOngoing if
+// the order was cancelled or picked up, and utils.ErrInsufficientWalletBalance if the customer
+// can't pay for the approved changes.
+func ApplySubstitution(ctx context.Context, db *mongo.Database, substitution *data.Substitution, approve bool, respondedBy data.ActorRole, actorId *primitive.ObjectID) (*data.Order, error) {
+
+	substitutionCollection := db.Collection(utils.SUBSTITUTION)
+	orderCollection := db.Collection(utils.ORDER)
+
+	var order data.Order
+	if err := orderCollection.FindOne(ctx, bson.M{"_id": substitution.OrderID}).Decode(&order); err != nil {
+		return nil, err
+	}
+
+	status := data.SubstitutionRejected
+	if approve {
+		status = data.SubstitutionApproved
+	}
+
+	// Nothing to settle on an order that was cancelled while the substitution was pending.
+	if order.CurrentStatus() != data.OrderStatusOngoing {
+		if _, err := substitutionCollection.UpdateOne(ctx, bson.M{"_id": substitution.ID, "status": data.SubstitutionPending}, bson.M{"$set": bson.M{
+			"status":      data.SubstitutionRejected,
+			"respondedBy": data.ActorSystem,
+			"respondedAt": time.Now(),
+			"updatedAt":   time.Now(),
+		}}); err != nil {
+			return nil, err
+		}
+		return nil, ErrOrderNotOngoing
+	}
+
+	lineItems, difference := settleSubstitution(&order, substitution.Changes, approve)
+
+	if len(lineItems) == 0 {
+		reason := "None of the items on your order are available"
+		if err := CancelAndRefundOrder(ctx, db, &order, data.ActorSystem, nil, &reason); err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		result, err := substitutionCollection.UpdateOne(ctx, bson.M{"_id": substitution.ID, "status": data.SubstitutionPending}, bson.M{"$set": bson.M{
+			"status":      status,
+			"respondedBy": respondedBy,
+			"respondedAt": now,
+			"updatedAt":   now,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, ErrSubstitutionAnswered
+		}
+
+		substitution.Status = status
+		substitution.RespondedBy = &respondedBy
+		substitution.RespondedAt = &now
+		publishSubstitution(substitution)
+
+		return &order, nil
+	}
+
+	var removed, added []data.OrderLineItem
+	for _, change := range substitution.Changes {
+		removed = append(removed, change.Original)
+		if approve && change.Substitute != nil {
+			added = append(added, *change.Substitute)
+		}
+	}
+
+	note := "The customer rejected the store's changes, so the items it couldn't fulfil were taken off the order"
+	if approve {
+		note = "The customer approved the store's changes to the items"
+	}
+	if respondedBy == data.ActorSystem {
+		note = "The customer didn't answer the store's changes in time, so they were " + string(status)
+	}
+
+	previousStatus := order.CurrentStatus()
+	progressStatus := order.CurrentProgressStatus()
+	now := time.Now()
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		result, err := substitutionCollection.UpdateOne(sessCtx, bson.M{"_id": substitution.ID, "status": data.SubstitutionPending}, bson.M{"$set": bson.M{
+			"status":        status,
+			"respondedBy":   respondedBy,
+			"respondedAt":   now,
+			"settledAmount": difference,
+			"updatedAt":     now,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, ErrSubstitutionAnswered
+		}
+
+		result, err = orderCollection.UpdateOne(sessCtx, bson.M{
+			"_id":                 order.ID,
+			"status":              data.OrderStatusOngoing,
+			"orderProgressStatus": bson.M{"$nin": bson.A{data.RiderOnHisWay, data.RiderAtUserLocation}},
+		}, bson.M{
+			"$set": bson.M{
+				"lineItems": lineItems,
+				"price":     utils.RoundToKobo(order.Price + difference),
+				"updatedAt": now,
+			},
+			"$inc": bson.M{"substitutionWalletDelta": difference},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, ErrOrderNotOngoing
+		}
+
+		if err := restoreLineItemStock(sessCtx, db, removed); err != nil {
+			return nil, err
+		}
+
+		if err := reserveLineItemStock(sessCtx, db, added); err != nil {
+			return nil, err
+		}
+
+		if difference > 0 {
+			if err := utils.DebitCustomerWallet(sessCtx, db, order.CustomerID, order.ID, difference, "order substitution"); err != nil {
+				return nil, err
+			}
+		} else if difference < 0 {
+			if err := utils.CreditCustomerWallet(sessCtx, db, order.CustomerID, order.ID, -difference, "order substitution refund"); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := utils.RecordOrderTransition(sessCtx, db, data.OrderTimelineEntry{
+			OrderID:                order.ID,
+			ActorID:                actorId,
+			ActorRole:              respondedBy,
+			PreviousProgressStatus: &progressStatus,
+			ProgressStatus:         progressStatus,
+			PreviousStatus:         &previousStatus,
+			Status:                 previousStatus,
+			Note:                   &note,
+		}); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	order.LineItems = lineItems
+	order.Price = utils.RoundToKobo(order.Price + difference)
+	walletDelta := utils.RoundToKobo(order.SubstitutionWalletAmount() + difference)
+	order.SubstitutionWalletDelta = &walletDelta
+
+	substitution.Status = status
+	substitution.RespondedBy = &respondedBy
+	substitution.RespondedAt = &now
+	substitution.SettledAmount = &difference
+	publishSubstitution(substitution)
+
+	return &order, nil
+}
+
+// canSubstitute reports whether the order's items can still be changed, which they can until the
+// rider leaves the store with them.
+func canSubstitute(order *data.Order) bool {
+	progressStatus := order.CurrentProgressStatus()
+	return progressStatus != data.RiderOnHisWay && progressStatus != data.RiderAtUserLocation
+}
+
+// buildSubstitutionChanges checks the requested changes against the order and the store's items,
+// and snapshots the substitutes at their current price.
+func buildSubstitutionChanges(c *gin.Context, db *mongo.Database, order *data.Order, body []SubstitutionChangeBody) ([]data.SubstitutionChange, error) {
+
+	itemCollection := db.Collection(utils.ITEM)
+
+	changes := make([]data.SubstitutionChange, 0, len(body))
+	changedItems := map[primitive.ObjectID]bool{}
+	substituteItems := map[primitive.ObjectID]bool{}
+
+	for _, changeBody := range body {
+		itemId, err := primitive.ObjectIDFromHex(changeBody.ItemID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid itemId %s", changeBody.ItemID)
+		}
+
+		original := findLineItem(order.LineItems, itemId)
+		if original == nil {
+			return nil, fmt.Errorf("item %s is not on the order", changeBody.ItemID)
+		}
+
+		if changedItems[itemId] {
+			return nil, fmt.Errorf("item %s is changed more than once", original.Name)
+		}
+		changedItems[itemId] = true
+
+		change := data.SubstitutionChange{
+			Original: *original,
+			Action:   data.SubstitutionAction(changeBody.Action),
+		}
+
+		switch change.Action {
+		case data.SubstitutionRemove:
+		case data.SubstitutionReplace:
+			if changeBody.SubstituteItemID == nil {
+				return nil, fmt.Errorf("substituteItemId is required to replace item %s", original.Name)
+			}
+
+			substituteId, err := primitive.ObjectIDFromHex(*changeBody.SubstituteItemID)
+			if err != nil {
+				return nil, fmt.Errorf("invalid substituteItemId %s", *changeBody.SubstituteItemID)
+			}
+
+			quantity := original.Quantity
+			if changeBody.Quantity != nil {
+				quantity = *changeBody.Quantity
+			}
+			if quantity < 1 {
+				return nil, fmt.Errorf("quantity of the substitute for item %s must be at least 1", original.Name)
+			}
+
+			// Offering fewer of the same item covers partial shortages; it keeps the price it was ordered at.
+			if substituteId == itemId {
+				if quantity >= original.Quantity {
+					return nil, fmt.Errorf("only fewer of item %s can be offered in its place", original.Name)
+				}
+
+				substitute := *original
+				substitute.Quantity = quantity
+				change.Substitute = &substitute
+				break
+			}
+
+			if findLineItem(order.LineItems, substituteId) != nil || substituteItems[substituteId] {
+				return nil, fmt.Errorf("substitute %s is already on the order", *changeBody.SubstituteItemID)
+			}
+			substituteItems[substituteId] = true
+
+			var item data.Item
+			if err := itemCollection.FindOne(c, bson.M{"_id": substituteId}).Decode(&item); err != nil {
+				return nil, fmt.Errorf("substitute %s not found", *changeBody.SubstituteItemID)
+			}
+
+			if item.Status != nil && *item.Status != "active" {
+				return nil, fmt.Errorf("substitute %s is not available", itemName(&item))
+			}
+
+			if item.StoreID == nil || *item.StoreID != order.StoreID {
+				return nil, fmt.Errorf("substitute %s does not belong to store", itemName(&item))
+			}
+
+			if item.Price == nil {
+				return nil, fmt.Errorf("substitute %s has no price", itemName(&item))
+			}
+
+			if item.CurrentInventory != nil && quantity > *item.CurrentInventory {
+				return nil, fmt.Errorf("only %d of substitute %s left in stock", *item.CurrentInventory, itemName(&item))
+			}
+
+			change.Substitute = &data.OrderLineItem{
+				ItemID:    item.ID,
+				Name:      itemName(&item),
+				UnitPrice: *item.Price,
+				Quantity:  quantity,
+				Image:     item.Image,
+				Category:  item.Category,
+			}
+		default:
+			return nil, fmt.Errorf("action for item %s must be replace or remove", original.Name)
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// settleSubstitution works out the order's line items once the changes are approved or rejected,
+// and what that adds to its price. A refund never takes the price below the delivery fee, service
+// charge and tip, so a discounted order can't be refunded more than was paid for its items.
+func settleSubstitution(order *data.Order, changes []data.SubstitutionChange, approve bool) ([]data.OrderLineItem, float64) {
+
+	lineItems := []data.OrderLineItem{}
+	difference := 0.0
+
+	for _, lineItem := range order.LineItems {
+		var change *data.SubstitutionChange
+		for i := range changes {
+			if changes[i].Original.ItemID == lineItem.ItemID {
+				change = &changes[i]
+				break
+			}
+		}
+
+		if change == nil {
+			lineItems = append(lineItems, lineItem)
+			continue
+		}
+
+		difference -= lineItem.UnitPrice * float64(lineItem.Quantity)
+		if approve && change.Substitute != nil {
+			lineItems = append(lineItems, *change.Substitute)
+			difference += change.Substitute.UnitPrice * float64(change.Substitute.Quantity)
+		}
+	}
+
+	if difference < 0 {
+		floor := order.CheckoutTip()
+		if order.DeliveryFee != nil {
+			floor += *order.DeliveryFee
+		}
+		if order.ServiceCharge != nil {
+			floor += *order.ServiceCharge
+		}
+		difference = -math.Min(-difference, math.Max(order.Price-floor, 0))
+	}
+
+	return lineItems, utils.RoundToKobo(difference)
+}
+
+func findLineItem(lineItems []data.OrderLineItem, itemId primitive.ObjectID) *data.OrderLineItem {
+	for i := range lineItems {
+		if lineItems[i].ItemID == itemId {
+			return &lineItems[i]
+		}
+	}
+	return nil
+}
+
+func publishSubstitution(substitution *data.Substitution) {
+	utils.OrderEvents.Publish(utils.OrderEvent{
+		Type:         utils.OrderEventSubstitution,
+		OrderID:      substitution.OrderID,
+		Substitution: substitution,
+	})
+}
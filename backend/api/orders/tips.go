@@ -0,0 +1,265 @@
+package orders
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"useboi-boi/backend/api/payments"
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"firebase.google.com/go/messaging"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errAlreadyTipped = errors.New("rider has already been tipped for this order")
+
+type TipBody struct {
+	Amount       float64  `json:"amount"`
+	CheckoutType string   `json:"checkoutType"` // card, wallet
+	CardId       *float64 `json:"cardId"`
+}
+
+// maxRiderTip is the largest tip a customer can give on an order, set with RIDER_TIP_MAX.
+func maxRiderTip() float64 {
+	return float64(utils.GetEnvInt("RIDER_TIP_MAX", 10000))
+}
+
+func validateTip(amount float64, allowZero bool) error {
+	if amount < 0 || (amount == 0 && !allowZero) {
+		return errors.New("tip must be more than 0")
+	}
+	if amount > maxRiderTip() {
+		return errors.New("tip cannot be more than " + strconv.FormatFloat(maxRiderTip(), 'f', 0, 64))
+	}
+	return nil
+}
+
+// TipRider godoc
+// @Summary Tip the rider after delivery
+// @Description Tip the rider of a completed order from the wallet or a saved card. The tip is paid to the rider in full, with no service fee, and an order can be tipped once after delivery
+// @Tags Orders
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param tip body TipBody true "Tip"
+// @Success 200 {object} data.Order
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /orders/{id}/tip [post]
+// @Security BearerAuth
+func TipRider(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	var body TipBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	body.Amount = utils.RoundToKobo(body.Amount)
+	if err := validateTip(body.Amount, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if body.CheckoutType != "card" && body.CheckoutType != "wallet" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad request. invalid checkout type"})
+		return
+	}
+
+	if body.CheckoutType == "card" && body.CardId == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cardId cannot be empty"})
+		return
+	}
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request. " + err.Error()})
+		return
+	}
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	orderCollection := db.Collection(utils.ORDER)
+
+	var order data.Order
+	if err := orderCollection.FindOne(c, bson.M{"_id": orderId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if order.CustomerID != userId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "order does not belong to user"})
+		return
+	}
+
+	if order.CurrentStatus() != data.OrderStatusCompleted || order.RiderID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "riders can only be tipped on delivered orders"})
+		return
+	}
+
+	if order.PostDeliveryTip != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": errAlreadyTipped.Error()})
+		return
+	}
+
+	var customer data.User
+	if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": userId}).Decode(&customer); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found. " + err.Error()})
+		return
+	}
+
+	// Only one tip may be claimed on the order, so a repeated request can't charge the customer twice.
+	tipFilter := bson.M{"_id": order.ID, "postDeliveryTip": bson.M{"$exists": false}}
+
+	if body.CheckoutType == "wallet" {
+		err = tipFromWallet(c, db, &order, &customer, body.Amount, tipFilter)
+	} else {
+		err = tipFromCard(c, db, &order, &customer, body.Amount, *body.CardId, tipFilter)
+	}
+	if errors.Is(err, errAlreadyTipped) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, utils.ErrInsufficientWalletBalance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to tip rider. " + err.Error()})
+		slog.Error("Failed to tip rider", "orderId", order.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	order.PostDeliveryTip = &body.Amount
+
+	utils.SendTipNotificationToRider(c, db, fcm, &order, body.Amount)
+
+	order.HideCodeFrom(userId.Hex())
+	c.JSON(http.StatusOK, order)
+
+}
+
+func tipFromWallet(c *gin.Context, db *mongo.Database, order *data.Order, customer *data.User, amount float64, tipFilter bson.M) error {
+
+	if customer.VirtualBankAccount == nil {
+		return errors.New("no wallet created for user")
+	}
+
+	reference := utils.GeneratePaymentReference()
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(c)
+
+	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		result, err := db.Collection(utils.ORDER).UpdateOne(sessCtx, tipFilter, bson.M{"$set": bson.M{
+			"postDeliveryTip":    amount,
+			"postDeliveryTipRef": reference,
+			"updatedAt":          time.Now(),
+		}})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, errAlreadyTipped
+		}
+
+		// The balance is checked as part of the debit, so concurrent spends can't take the wallet below its minimum.
+		if err := utils.DebitCustomerWallet(sessCtx, db, customer.ID, order.ID, amount, "rider tip"); err != nil {
+			return nil, err
+		}
+
+		return nil, utils.TipRider(sessCtx, db, *order.RiderID, order.ID, amount)
+	})
+
+	if err == nil {
+		order.PostDeliveryTipRef = &reference
+	}
+
+	return err
+}
+
+func tipFromCard(c *gin.Context, db *mongo.Database, order *data.Order, customer *data.User, amount float64, cardId float64, tipFilter bson.M) error {
+
+	var selectedCard *data.Card
+	for _, card := range customer.Cards {
+		if card.ID == cardId {
+			selectedCard = &card
+			break
+		}
+	}
+
+	if selectedCard == nil {
+		return errors.New("selected card doesn't exist")
+	}
+
+	orderCollection := db.Collection(utils.ORDER)
+
+	// Claim the tip before charging the card so two requests can't both be charged.
+	result, err := orderCollection.UpdateOne(c, tipFilter, bson.M{"$set": bson.M{
+		"postDeliveryTip": amount,
+		"updatedAt":       time.Now(),
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errAlreadyTipped
+	}
+
+	releaseClaim := func() {
+		if _, err := orderCollection.UpdateOne(c, bson.M{"_id": order.ID}, bson.M{"$unset": bson.M{"postDeliveryTip": ""}}); err != nil {
+			slog.Error("Failed to release tip claim", "orderId", order.ID.Hex(), "error", err.Error())
+		}
+	}
+
+	reference, err := payments.ChargeAuthorization(customer.Email, selectedCard.AuthorizationCode, amount)
+	if err != nil {
+		releaseClaim()
+		return err
+	}
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		releaseClaim()
+		refundFailedCheckout(c, db, customer.ID, reference, amount)
+		return err
+	}
+	defer session.EndSession(c)
+
+	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		if _, err := orderCollection.UpdateOne(sessCtx, bson.M{"_id": order.ID}, bson.M{"$set": bson.M{
+			"postDeliveryTipRef": reference,
+		}}); err != nil {
+			return nil, err
+		}
+
+		return nil, utils.TipRider(sessCtx, db, *order.RiderID, order.ID, amount)
+	})
+	if err != nil {
+		releaseClaim()
+		refundFailedCheckout(c, db, customer.ID, reference, amount)
+		return err
+	}
+
+	order.PostDeliveryTipRef = &reference
+	return nil
+}
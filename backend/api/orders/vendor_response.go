@@ -0,0 +1,187 @@
+package orders
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"useboi-boi/backend/api/dispatch"
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"firebase.google.com/go/messaging"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type VendorAcceptBody struct {
+	EstimatedPrepMinutes *int `json:"estimatedPrepMinutes"`
+}
+
+type VendorRejectBody struct {
+	Reason *string `json:"reason"`
+}
+
+func VendorAcceptOrder(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	// The body is optional, so a request without one is treated as empty.
+	var body VendorAcceptBody
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body " + err.Error()})
+		return
+	}
+
+	if body.EstimatedPrepMinutes != nil && *body.EstimatedPrepMinutes < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "estimatedPrepMinutes must be at least 1"})
+		return
+	}
+
+	order, actorId, ok := getOrderForVendor(c, db)
+	if !ok {
+		return
+	}
+
+	previousProgressStatus := order.CurrentProgressStatus()
+	if err := previousProgressStatus.CanTransitionTo(data.OrderReceivedByVendor, data.ActorVendor); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	update := bson.M{
+		"orderProgressStatus": data.OrderReceivedByVendor,
+		"updatedAt":           time.Now(),
+	}
+	if body.EstimatedPrepMinutes != nil {
+		update["estimatedPrepMinutes"] = *body.EstimatedPrepMinutes
+	}
+
+	orderCollection := db.Collection(utils.ORDER)
+
+	result, err := orderCollection.UpdateOne(c, bson.M{
+		"_id":                 order.ID,
+		"status":              data.OrderStatusOngoing,
+		"orderProgressStatus": previousProgressStatus,
+	}, bson.M{"$set": update})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to accept order. " + err.Error()})
+		slog.Error("Failed to accept order", "error", err.Error())
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "order can no longer be accepted"})
+		return
+	}
+
+	orderStatus := order.CurrentStatus()
+	if err := utils.RecordOrderTransition(c, db, data.OrderTimelineEntry{
+		OrderID:                order.ID,
+		ActorID:                actorId,
+		ActorRole:              data.ActorVendor,
+		PreviousProgressStatus: &previousProgressStatus,
+		ProgressStatus:         data.OrderReceivedByVendor,
+		PreviousStatus:         &orderStatus,
+		Status:                 orderStatus,
+	}); err != nil {
+		slog.Error("Failed to record order transition", "error", err)
+	}
+
+	if err := orderCollection.FindOne(c, bson.M{"_id": order.ID}).Decode(order); err != nil {
+		slog.Info("error fetching order", "error", err.Error())
+	}
+
+	order.HideCodeFrom(c.GetString("userId"))
+	c.JSON(http.StatusOK, order)
+
+	utils.SendOrderUpdateToCustomer(c, db, fcm, order)
+	if err := dispatch.DispatchNextWave(c, db, fcm, order); err != nil {
+		slog.Error("Failed to dispatch order", "orderId", order.ID.Hex(), "error", err.Error())
+	}
+
+}
+
+func VendorRejectOrder(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
+
+	// The body is optional, so a request without one is treated as empty.
+	var body VendorRejectBody
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body " + err.Error()})
+		return
+	}
+
+	order, actorId, ok := getOrderForVendor(c, db)
+	if !ok {
+		return
+	}
+
+	if order.CurrentProgressStatus() != data.OrderCreated {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only orders that haven't been accepted can be rejected"})
+		return
+	}
+
+	reason := "The vendor could not take your order"
+	if body.Reason != nil && len(strings.TrimSpace(*body.Reason)) > 0 {
+		reason = "The vendor could not take your order: " + strings.TrimSpace(*body.Reason)
+	}
+
+	err := CancelAndRefundOrder(c, db, order, data.ActorVendor, actorId, &reason)
+	if err == ErrCancellationNotAllowed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err == ErrOrderNotOngoing {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reject order. " + err.Error()})
+		slog.Error("Failed to reject order", "error", err.Error())
+		return
+	}
+
+	order.HideCodeFrom(c.GetString("userId"))
+	c.JSON(http.StatusOK, order)
+
+	utils.SendOrderCancelledNotificationToCustomer(c, db, fcm, order)
+
+}
+
+// getOrderForVendor loads the order in the path and checks that it is an ongoing order of the
+// requesting merchant's store. It writes the error response itself and returns false on failure.
+func getOrderForVendor(c *gin.Context, db *mongo.Database) (*data.Order, *primitive.ObjectID, bool) {
+
+	orderObjectId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to create order object id. " + err.Error()})
+		return nil, nil, false
+	}
+
+	var order data.Order
+	if err := db.Collection(utils.ORDER).FindOne(c, bson.M{"_id": orderObjectId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return nil, nil, false
+	}
+
+	actorRole, actorId, err := utils.ResolveOrderActor(c, db, c.GetString("userId"), &order)
+	if err != nil || actorRole != data.ActorVendor {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the store's merchant can respond to this order"})
+		return nil, nil, false
+	}
+
+	if order.CurrentStatus() != data.OrderStatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has been marked as " + string(order.CurrentStatus()) + " already"})
+		return nil, nil, false
+	}
+
+	if order.DispatchedAt == nil && order.ScheduledFor != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order is scheduled and not yet open to the vendor"})
+		return nil, nil, false
+	}
+
+	return &order, actorId, true
+}
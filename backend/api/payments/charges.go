@@ -0,0 +1,73 @@
+package payments
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"useboi-boi/backend/utils"
+)
+
+// ChargeAuthorization charges amount to a card the user has saved with us and returns the
+// Paystack reference of the charge.
+func ChargeAuthorization(email string, authorizationCode string, amount float64) (string, error) {
+
+	chargeRequestBody := map[string]interface{}{
+		"email":              email,
+		"amount":             strconv.FormatFloat(amount*100, 'f', 2, 64),
+		"authorization_code": authorizationCode,
+		"metadata": map[string]interface{}{
+			"type": "card",
+		},
+	}
+
+	payload, err := json.Marshal(chargeRequestBody)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling JSON: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", utils.PAYSTACK_BASE_URL+"transaction/charge_authorization", bytes.NewBuffer(payload))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("PAYSTACK_SECRET_KEY"))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %v", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := result["message"].(string)
+		return "", fmt.Errorf("paystack charge failed with status %d: %s", resp.StatusCode, message)
+	}
+
+	responseData, _ := result["data"].(map[string]interface{})
+	status, _ := responseData["status"].(string)
+	gatewayResponse, _ := responseData["gateway_response"].(string)
+	reference, _ := responseData["reference"].(string)
+
+	if status != "success" && gatewayResponse != "Approved" {
+		return "", fmt.Errorf("card charge was not approved: %s", gatewayResponse)
+	}
+
+	return reference, nil
+}
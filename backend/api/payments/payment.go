@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"useboi-boi/backend/internal/data"
@@ -580,6 +581,17 @@ func CapturePayment(ctx *gin.Context, db *mongo.Database) {
 
 		slog.Info("message", "webhook event successful", "👍🏾")
 
+	} else if strings.HasPrefix(event, "refund.") {
+
+		eventData, _ := paymentPayload["data"].(map[string]interface{})
+		if err := handleRefundEvent(ctx, db, event, eventData); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update refund " + err.Error()})
+			slog.Info("payment", "failed to update refund", err.Error())
+			return
+		}
+
+		ctx.Data(http.StatusOK, "application/json", nil)
+
 	} else if event == "transfer.success" {
 
 		ctx.Data(http.StatusOK, "application/json", nil)
@@ -0,0 +1,279 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewCardRefund builds a pending refund of a card payment. Insert it alongside the change that
+// caused it, then hand it to RequestRefund once that change is committed.
+func NewCardRefund(userId primitive.ObjectID, orderId *primitive.ObjectID, paymentReference string, amount float64) data.Refund {
+	now := time.Now()
+	return data.Refund{
+		ID:               primitive.NewObjectID(),
+		OrderID:          orderId,
+		UserID:           userId,
+		Amount:           amount,
+		PaymentReference: paymentReference,
+		Status:           "pending",
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+}
+
+// RequestRefund asks Paystack to send a refund back to the card it was paid with and records
+// the outcome. Paystack settles refunds asynchronously, so a successful request only moves the
+// refund to processing; the refund webhooks finish it off.
+func RequestRefund(ctx context.Context, db *mongo.Database, refund *data.Refund) error {
+
+	refundCollection := db.Collection(utils.REFUND)
+
+	requestBody := map[string]interface{}{
+		"transaction": refund.PaymentReference,
+		"amount":      int64(math.Round(refund.Amount * 100)),
+	}
+
+	paystackRefundId, err := postRefund(requestBody)
+
+	update := bson.M{
+		"updatedAt": time.Now(),
+	}
+
+	if err != nil {
+		reason := err.Error()
+		refund.Status = "failed"
+		refund.FailureReason = &reason
+		update["status"] = refund.Status
+		update["failureReason"] = reason
+	} else {
+		refund.Status = "processing"
+		refund.PaystackRefundID = paystackRefundId
+		refund.FailureReason = nil
+		update["status"] = refund.Status
+		if paystackRefundId != nil {
+			update["paystackRefundId"] = *paystackRefundId
+		}
+	}
+
+	if _, dbErr := refundCollection.UpdateOne(ctx, bson.M{"_id": refund.ID}, bson.M{
+		"$set": update,
+		"$inc": bson.M{"attempts": 1},
+	}); dbErr != nil {
+		slog.Error("Failed to update refund", "refundId", refund.ID.Hex(), "error", dbErr.Error())
+	}
+	refund.Attempts++
+
+	return err
+}
+
+func postRefund(requestBody map[string]interface{}) (*string, error) {
+
+	payload, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling JSON: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", utils.PAYSTACK_BASE_URL+"refund", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("PAYSTACK_SECRET_KEY"))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := result["message"].(string)
+		return nil, fmt.Errorf("paystack refund failed with status %d: %s", resp.StatusCode, message)
+	}
+
+	responseData, ok := result["data"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	return paystackId(responseData["id"]), nil
+}
+
+// paystackId reads an id that Paystack sends as either a number or a string.
+func paystackId(value interface{}) *string {
+	switch id := value.(type) {
+	case float64:
+		idStr := strconv.FormatInt(int64(id), 10)
+		return &idStr
+	case string:
+		return &id
+	}
+	return nil
+}
+
+// handleRefundEvent applies a refund.* webhook to the matching refund record.
+func handleRefundEvent(ctx context.Context, db *mongo.Database, event string, eventData map[string]interface{}) error {
+
+	var status string
+	switch event {
+	case "refund.processed":
+		status = "processed"
+	case "refund.failed":
+		status = "failed"
+	case "refund.pending", "refund.processing":
+		status = "processing"
+	default:
+		return nil
+	}
+
+	refundCollection := db.Collection(utils.REFUND)
+	transactionReference := eventData["transaction_reference"]
+
+	// A transaction can have several partial refunds, so the refund id is the only safe match. The
+	// reference is only trusted when the event has no id and a single refund is still unsettled.
+	filter := bson.M{"status": bson.M{"$ne": "processed"}}
+	if refundId := paystackId(eventData["id"]); refundId != nil {
+		filter["paystackRefundId"] = *refundId
+	} else {
+		filter["paymentReference"] = transactionReference
+
+		unsettled, err := refundCollection.CountDocuments(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if unsettled != 1 {
+			slog.Warn("no single refund found for webhook event", "event", event, "transactionReference", transactionReference, "unsettledRefunds", unsettled)
+			return nil
+		}
+	}
+
+	update := bson.M{
+		"status":    status,
+		"updatedAt": time.Now(),
+	}
+	if status == "failed" {
+		update["failureReason"] = "refund failed at paystack"
+	}
+
+	result, err := refundCollection.UpdateOne(ctx, filter, bson.M{"$set": update})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		slog.Warn("no refund found for webhook event", "event", event, "transactionReference", transactionReference, "refundId", eventData["id"])
+	}
+
+	return nil
+}
+
+// GetRefunds godoc
+// @Summary Get refunds
+// @Description Get card refunds, newest first, optionally filtered by status
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param status query string false "pending, processing, processed or failed"
+// @Success 200 {array} data.Refund
+// @Failure 500 {object} object{error=string}
+// @Router /admin/refunds [get]
+// @Security BearerAuth
+func GetRefunds(c *gin.Context, db *mongo.Database) {
+
+	filter := bson.M{}
+	if status := c.Query("status"); len(status) > 0 {
+		filter["status"] = status
+	}
+
+	cursor, err := db.Collection(utils.REFUND).Find(c, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get refunds. " + err.Error()})
+		return
+	}
+	defer cursor.Close(c)
+
+	refunds := []data.Refund{}
+	if err := cursor.All(c, &refunds); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode refunds. " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, refunds)
+
+}
+
+// RetryRefund godoc
+// @Summary Retry a failed refund
+// @Description Ask Paystack again to refund a card payment whose refund failed
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Refund ID"
+// @Success 200 {object} data.Refund
+// @Failure 400 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 502 {object} object{error=string}
+// @Router /admin/refunds/{id}/retry [post]
+// @Security BearerAuth
+func RetryRefund(c *gin.Context, db *mongo.Database) {
+
+	refundId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid refund id. " + err.Error()})
+		return
+	}
+
+	refundCollection := db.Collection(utils.REFUND)
+
+	// Move the refund out of failed first so two retries can't both go to Paystack.
+	var refund data.Refund
+	if err := refundCollection.FindOneAndUpdate(c, bson.M{"_id": refundId, "status": "failed"}, bson.M{
+		"$set": bson.M{"status": "pending", "updatedAt": time.Now()},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&refund); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no failed refund found with this id"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get refund. " + err.Error()})
+		return
+	}
+
+	if err := RequestRefund(c, db, &refund); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "refund failed again. " + err.Error(), "refund": refund})
+		slog.Error("Refund retry failed", "refundId", refund.ID.Hex(), "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+
+}
@@ -0,0 +1,511 @@
+package reviews
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errAlreadyReviewed = errors.New("you have already reviewed this order")
+	errReviewChanged   = errors.New("review can no longer be edited or was changed in the meantime, please refresh and try again")
+)
+
+type CreateReviewBody struct {
+	Target      string  `json:"target"` // store, rider
+	Rating      int     `json:"rating"`
+	Description *string `json:"description"`
+}
+
+type UpdateReviewBody struct {
+	Rating      *int    `json:"rating"`
+	Description *string `json:"description"`
+}
+
+type ReplyBody struct {
+	Reply string `json:"reply"`
+}
+
+type StoreReview struct {
+	data.Review `bson:",inline"`
+	Customer    struct {
+		FirstName string `bson:"firstName" json:"firstName"`
+	} `bson:"customer" json:"customer"`
+}
+
+// reviewEditWindow is how long a customer has to change a review, set with REVIEW_EDIT_WINDOW_HOURS.
+func reviewEditWindow() time.Duration {
+	return time.Duration(utils.GetEnvInt("REVIEW_EDIT_WINDOW_HOURS", 48)) * time.Hour
+}
+
+// orderReviewFields returns the order fields that hold the review and rating for target.
+func orderReviewFields(target string) (reviewIdField string, ratingField string) {
+	if target == "rider" {
+		return "riderReviewId", "riderRating"
+	}
+	return "vendorReviewId", "vendorRating"
+}
+
+// CreateReview godoc
+// @Summary Review an order
+// @Description Rate and review the store or the rider of a completed order. Each can be reviewed once per order
+// @Tags Reviews
+// @Accept json
+// @Produce json
+// @Param id path string true "Order ID"
+// @Param review body CreateReviewBody true "Review"
+// @Success 200 {object} data.Review
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Failure 409 {object} object{error=string}
+// @Router /orders/{id}/reviews [post]
+// @Security BearerAuth
+func CreateReview(c *gin.Context, db *mongo.Database) {
+
+	orderId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id. " + err.Error()})
+		return
+	}
+
+	var body CreateReviewBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if body.Target != "store" && body.Target != "rider" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target must be either store or rider"})
+		return
+	}
+
+	if body.Rating < 1 || body.Rating > 5 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rating must be between 1 and 5"})
+		return
+	}
+
+	orderCollection := db.Collection(utils.ORDER)
+	reviewCollection := db.Collection(utils.REVIEW)
+
+	var order data.Order
+	if err := orderCollection.FindOne(c, bson.M{"_id": orderId}).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found. " + err.Error()})
+		return
+	}
+
+	if order.CustomerID.Hex() != c.GetString("userId") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the customer who placed the order can review it"})
+		return
+	}
+
+	if order.CurrentStatus() != data.OrderStatusCompleted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only completed orders can be reviewed"})
+		return
+	}
+
+	if body.Target == "rider" && order.RiderID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order has no rider to review"})
+		return
+	}
+
+	now := time.Now()
+	review := data.Review{
+		ID:          primitive.NewObjectID(),
+		CustomerID:  order.CustomerID,
+		Target:      body.Target,
+		Rating:      body.Rating,
+		Description: trimmed(body.Description),
+		OrderID:     order.ID,
+		StoreID:     order.StoreID,
+		CreatedAt:   &now,
+		UpdatedAt:   &now,
+	}
+	if body.Target == "rider" {
+		review.RiderID = order.RiderID
+	}
+
+	reviewIdField, ratingField := orderReviewFields(body.Target)
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start db transaction session: " + err.Error()})
+		return
+	}
+	defer session.EndSession(c)
+
+	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		// Claiming the review slot on the order is what stops a second review of the same target.
+		result, err := orderCollection.UpdateOne(sessCtx, bson.M{"_id": order.ID, reviewIdField: nil}, bson.M{
+			"$set": bson.M{
+				reviewIdField: review.ID,
+				ratingField:   review.Rating,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, errAlreadyReviewed
+		}
+
+		if _, err := reviewCollection.InsertOne(sessCtx, review); err != nil {
+			return nil, err
+		}
+
+		if err := applyRating(sessCtx, db, &review, float64(review.Rating), 1); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	})
+	if err == errAlreadyReviewed {
+		c.JSON(http.StatusConflict, gin.H{"error": "you have already reviewed the " + body.Target + " for this order"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create review. " + err.Error()})
+		slog.Error("Failed to create review", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+
+}
+
+// UpdateReview godoc
+// @Summary Edit a review
+// @Description Change the rating or description of a review within the edit window
+// @Tags Reviews
+// @Accept json
+// @Produce json
+// @Param id path string true "Review ID"
+// @Param review body UpdateReviewBody true "Review changes"
+// @Success 200 {object} data.Review
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Router /reviews/{id} [patch]
+// @Security BearerAuth
+func UpdateReview(c *gin.Context, db *mongo.Database) {
+
+	reviewId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid review id. " + err.Error()})
+		return
+	}
+
+	var body UpdateReviewBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	if body.Rating == nil && body.Description == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to update"})
+		return
+	}
+
+	if body.Rating != nil && (*body.Rating < 1 || *body.Rating > 5) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rating must be between 1 and 5"})
+		return
+	}
+
+	orderCollection := db.Collection(utils.ORDER)
+	reviewCollection := db.Collection(utils.REVIEW)
+
+	var review data.Review
+	if err := reviewCollection.FindOne(c, bson.M{"_id": reviewId}).Decode(&review); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "review not found. " + err.Error()})
+		return
+	}
+
+	if review.CustomerID.Hex() != c.GetString("userId") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only edit your own reviews"})
+		return
+	}
+
+	editCutoff := time.Now().Add(-reviewEditWindow())
+	if review.CreatedAt != nil && review.CreatedAt.Before(editCutoff) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "this review can no longer be edited"})
+		return
+	}
+
+	previousRating := review.Rating
+
+	now := time.Now()
+	update := bson.M{"updatedAt": now}
+	if body.Rating != nil {
+		review.Rating = *body.Rating
+		update["rating"] = review.Rating
+	}
+	if body.Description != nil {
+		review.Description = trimmed(body.Description)
+		update["description"] = review.Description
+	}
+	review.UpdatedAt = &now
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start db transaction session: " + err.Error()})
+		return
+	}
+	defer session.EndSession(c)
+
+	_, err = session.WithTransaction(c, func(sessCtx mongo.SessionContext) (interface{}, error) {
+
+		// The window and the rating the delta is worked out from are checked again as the edit lands,
+		// so a late or concurrent edit can't slip through or skew the store's average.
+		filter := bson.M{"_id": review.ID, "customerId": review.CustomerID, "rating": previousRating}
+		if review.CreatedAt != nil {
+			filter["createdAt"] = bson.M{"$gte": editCutoff}
+		}
+
+		result, err := reviewCollection.UpdateOne(sessCtx, filter, bson.M{"$set": update})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, errReviewChanged
+		}
+
+		if review.Rating != previousRating {
+			_, ratingField := orderReviewFields(review.Target)
+			if _, err := orderCollection.UpdateOne(sessCtx, bson.M{"_id": review.OrderID}, bson.M{
+				"$set": bson.M{ratingField: review.Rating},
+			}); err != nil {
+				return nil, err
+			}
+
+			if err := applyRating(sessCtx, db, &review, float64(review.Rating-previousRating), 0); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+	if errors.Is(err, errReviewChanged) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update review. " + err.Error()})
+		slog.Error("Failed to update review", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+
+}
+
+// GetStoreReviews godoc
+// @Summary Get a store's reviews
+// @Description Get the reviews customers have left for a store, newest first, with pagination
+// @Tags Reviews
+// @Accept json
+// @Produce json
+// @Param id path string true "Store ID"
+// @Param page query int false "Page number" default(1)
+// @Success 200 {object} object{data=[]StoreReview,page=int,pageSize=int,totalCount=int}
+// @Failure 400 {object} object{error=string}
+// @Failure 500 {object} object{error=string}
+// @Router /public/stores/{id}/reviews [get]
+func GetStoreReviews(c *gin.Context, db *mongo.Database) {
+
+	storeId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid store id. " + err.Error()})
+		return
+	}
+
+	const pageSize int64 = 20
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	skip := (page - 1) * pageSize
+
+	// Reviews whose customer is gone are dropped before the facet, so they are left out of the
+	// count as well as the page.
+	pipeline := []bson.M{
+		{"$match": bson.M{"storeId": storeId, "target": "store"}},
+		{"$sort": bson.M{"createdAt": -1}},
+		{"$lookup": bson.M{
+			"from":         utils.USER,
+			"localField":   "customerId",
+			"foreignField": "_id",
+			"as":           "customer",
+		}},
+		{"$unwind": "$customer"},
+		{"$facet": bson.M{
+			"data": []bson.M{
+				{"$skip": skip},
+				{"$limit": pageSize},
+				{"$project": bson.M{
+					"_id":         1,
+					"customerId":  1,
+					"target":      1,
+					"rating":      1,
+					"description": 1,
+					"orderId":     1,
+					"storeId":     1,
+					"reply":       1,
+					"repliedAt":   1,
+					"createdAt":   1,
+					"updatedAt":   1,
+					"customer": bson.M{
+						"firstName": "$customer.firstName",
+					},
+				}},
+			},
+			"totalCount": []bson.M{
+				{"$count": "count"},
+			},
+		}},
+	}
+
+	cursor, err := db.Collection(utils.REVIEW).Aggregate(c, pipeline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get reviews. " + err.Error()})
+		slog.Error("Failed to get reviews", "error", err.Error())
+		return
+	}
+	defer cursor.Close(c)
+
+	var result struct {
+		Data       []StoreReview `bson:"data"`
+		TotalCount []struct {
+			Count int64 `bson:"count"`
+		} `bson:"totalCount"`
+	}
+
+	if cursor.Next(c) {
+		if err := cursor.Decode(&result); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode reviews. " + err.Error()})
+			slog.Error("Failed to decode reviews", "error", err.Error())
+			return
+		}
+	}
+
+	if result.Data == nil {
+		result.Data = []StoreReview{}
+	}
+
+	var total int64
+	if len(result.TotalCount) > 0 {
+		total = result.TotalCount[0].Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": result.Data, "page": page, "pageSize": pageSize, "totalCount": total})
+
+}
+
+// ReplyToReview godoc
+// @Summary Reply to a review
+// @Description Let the merchant of a store reply to a review of their store. Replying again replaces the reply
+// @Tags Reviews
+// @Accept json
+// @Produce json
+// @Param id path string true "Review ID"
+// @Param reply body ReplyBody true "Reply"
+// @Success 200 {object} data.Review
+// @Failure 400 {object} object{error=string}
+// @Failure 403 {object} object{error=string}
+// @Failure 404 {object} object{error=string}
+// @Router /reviews/{id}/reply [post]
+// @Security BearerAuth
+func ReplyToReview(c *gin.Context, db *mongo.Database) {
+
+	reviewId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid review id. " + err.Error()})
+		return
+	}
+
+	var body ReplyBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	reply := strings.TrimSpace(body.Reply)
+	if len(reply) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reply cannot be empty"})
+		return
+	}
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid userId associated with request"})
+		return
+	}
+
+	var user data.User
+	if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": userId}).Decode(&user); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return
+	}
+
+	reviewCollection := db.Collection(utils.REVIEW)
+
+	var review data.Review
+	if err := reviewCollection.FindOne(c, bson.M{"_id": reviewId}).Decode(&review); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "review not found. " + err.Error()})
+		return
+	}
+
+	if review.Target != "store" || user.Type != "merchant" || user.StoreId == nil || *user.StoreId != review.StoreID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the store's merchant can reply to this review"})
+		return
+	}
+
+	now := time.Now()
+	if _, err := reviewCollection.UpdateOne(c, bson.M{"_id": review.ID}, bson.M{
+		"$set": bson.M{
+			"reply":     reply,
+			"repliedAt": now,
+		},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reply to review. " + err.Error()})
+		slog.Error("Failed to reply to review", "error", err.Error())
+		return
+	}
+
+	review.Reply = &reply
+	review.RepliedAt = &now
+
+	c.JSON(http.StatusOK, review)
+
+}
+
+// applyRating feeds a new or changed rating into the running rating of the review's target.
+func applyRating(ctx context.Context, db *mongo.Database, review *data.Review, sumDelta float64, countDelta int) error {
+	if review.Target == "rider" {
+		return utils.ApplyRiderRating(ctx, db, *review.RiderID, sumDelta, countDelta)
+	}
+	return utils.ApplyStoreRating(ctx, db, review.StoreID, sumDelta, countDelta)
+}
+
+func trimmed(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	t := strings.TrimSpace(*s)
+	if len(t) == 0 {
+		return nil
+	}
+	return &t
+}
@@ -10,12 +10,17 @@ import (
 	"useboi-boi/backend/api/admin/manage_orders"
 	"useboi-boi/backend/api/auth"
 	"useboi-boi/backend/api/carts"
+	"useboi-boi/backend/api/conversations"
 	"useboi-boi/backend/api/coupons"
+	"useboi-boi/backend/api/dispatch"
+	"useboi-boi/backend/api/disputes"
+	"useboi-boi/backend/api/errands"
 	"useboi-boi/backend/api/inventories"
 	"useboi-boi/backend/api/notifications"
 	"useboi-boi/backend/api/orders"
 	"useboi-boi/backend/api/payments"
 	"useboi-boi/backend/api/public"
+	"useboi-boi/backend/api/reviews"
 	"useboi-boi/backend/api/users"
 	"useboi-boi/backend/api/vendors"
 
@@ -40,7 +45,7 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 		}
 
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if c.Request.Method == "OPTIONS" {
@@ -64,6 +69,9 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	mainRoute := r.Group("api")
 	mainRoute.Use(AuthMiddleware(db))
 
+	streamRoute := r.Group("api")
+	streamRoute.Use(StreamTokenMiddleware(db))
+
 	// Admin
 	authRoute.POST("/admin/login", func(ctx *gin.Context) {
 		admin.AdminLogin(ctx, db)
@@ -97,6 +105,9 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	adminRoute.PATCH("/riders/:id", func(ctx *gin.Context) {
 		admin.ChangeRiderStatus(ctx, db)
 	})
+	adminRoute.GET("/dispatch/acceptanceRates", func(ctx *gin.Context) {
+		dispatch.GetAcceptanceRates(ctx, db)
+	})
 
 	adminRoute.GET("/orders", func(ctx *gin.Context) {
 		manage_orders.GetAllOrders(ctx, db)
@@ -104,6 +115,66 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	adminRoute.GET("/orders/:id", func(ctx *gin.Context) {
 		manage_orders.GetOrder(ctx, db)
 	})
+	adminRoute.GET("/orders/:id/timeline", func(ctx *gin.Context) {
+		manage_orders.GetOrderTimeline(ctx, db)
+	})
+	adminRoute.POST("/orders/:id/code", func(ctx *gin.Context) {
+		manage_orders.RegenerateOrderCode(ctx, db, fcm)
+	})
+	adminRoute.POST("/errands/:id/code", func(ctx *gin.Context) {
+		errands.RegenerateErrandCode(ctx, db, fcm)
+	})
+	adminRoute.PATCH("/errands/:id/cancel", func(ctx *gin.Context) {
+		errands.AdminCancelErrand(ctx, db, fcm)
+	})
+	adminRoute.PATCH("/errands/:id/reassign", func(ctx *gin.Context) {
+		errands.ReassignErrand(ctx, db, fcm)
+	})
+	adminRoute.GET("/cancellationPolicies", func(ctx *gin.Context) {
+		manage_orders.GetCancellationPolicies(ctx, db)
+	})
+	adminRoute.PATCH("/cancellationPolicies", func(ctx *gin.Context) {
+		manage_orders.UpdateCancellationPolicy(ctx, db)
+	})
+	adminRoute.GET("/deliveryFees", func(ctx *gin.Context) {
+		manage_orders.GetDeliveryFees(ctx, db)
+	})
+	adminRoute.POST("/deliveryFees", func(ctx *gin.Context) {
+		manage_orders.CreateDeliveryFee(ctx, db)
+	})
+	adminRoute.PATCH("/deliveryFees/:id", func(ctx *gin.Context) {
+		manage_orders.UpdateDeliveryFee(ctx, db)
+	})
+	adminRoute.DELETE("/deliveryFees/:id", func(ctx *gin.Context) {
+		manage_orders.DeleteDeliveryFee(ctx, db)
+	})
+	adminRoute.GET("/serviceFees", func(ctx *gin.Context) {
+		manage_orders.GetServiceFees(ctx, db)
+	})
+	adminRoute.POST("/serviceFees", func(ctx *gin.Context) {
+		manage_orders.CreateServiceFee(ctx, db)
+	})
+	adminRoute.PATCH("/serviceFees/:id", func(ctx *gin.Context) {
+		manage_orders.UpdateServiceFee(ctx, db)
+	})
+	adminRoute.DELETE("/serviceFees/:id", func(ctx *gin.Context) {
+		manage_orders.DeleteServiceFee(ctx, db)
+	})
+	adminRoute.GET("/refunds", func(ctx *gin.Context) {
+		payments.GetRefunds(ctx, db)
+	})
+	adminRoute.POST("/refunds/:id/retry", func(ctx *gin.Context) {
+		payments.RetryRefund(ctx, db)
+	})
+	adminRoute.GET("/disputes", func(ctx *gin.Context) {
+		disputes.GetDisputes(ctx, db)
+	})
+	adminRoute.GET("/disputes/:id", func(ctx *gin.Context) {
+		disputes.GetDispute(ctx, db)
+	})
+	adminRoute.PATCH("/disputes/:id/resolve", func(ctx *gin.Context) {
+		disputes.ResolveDispute(ctx, db, fcm)
+	})
 
 	// Auth
 	authRoute.POST("/signup", func(ctx *gin.Context) {
@@ -153,6 +224,12 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	mainRoute.GET("/vendors/:id/items", func(ctx *gin.Context) {
 		vendors.GetVendorItems(ctx, db)
 	})
+	mainRoute.POST("/vendor/closures", func(ctx *gin.Context) {
+		vendors.AddStoreClosure(ctx, db)
+	})
+	mainRoute.DELETE("/vendor/closures/:id", func(ctx *gin.Context) {
+		vendors.RemoveStoreClosure(ctx, db)
+	})
 
 	// Vendor Inventories
 	mainRoute.GET("/inventories/", func(ctx *gin.Context) {
@@ -189,6 +266,24 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	mainRoute.GET("/carts/:id/items", func(ctx *gin.Context) {
 		carts.GetItemsInCart(ctx, db)
 	})
+	mainRoute.POST("/carts", func(ctx *gin.Context) {
+		carts.CreateCart(ctx, db)
+	})
+	mainRoute.GET("/carts/current", func(ctx *gin.Context) {
+		carts.GetCurrentCart(ctx, db)
+	})
+	mainRoute.POST("/carts/:id/items", func(ctx *gin.Context) {
+		carts.AddItemToCart(ctx, db)
+	})
+	mainRoute.PATCH("/carts/:id/items/:cartItemId", func(ctx *gin.Context) {
+		carts.UpdateCartItemQuantity(ctx, db)
+	})
+	mainRoute.DELETE("/carts/:id/items/:cartItemId", func(ctx *gin.Context) {
+		carts.RemoveItemFromCart(ctx, db)
+	})
+	mainRoute.DELETE("/carts/:id/items", func(ctx *gin.Context) {
+		carts.ClearCart(ctx, db)
+	})
 
 	// Orders
 	mainRoute.GET("/orders", func(ctx *gin.Context) {
@@ -197,7 +292,19 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	mainRoute.GET("/orders/:id", func(ctx *gin.Context) {
 		orders.GetOrder(ctx, db)
 	})
-	mainRoute.POST("/orders/checkout", func(ctx *gin.Context) {
+	mainRoute.GET("/orders/:id/receipt", func(ctx *gin.Context) {
+		orders.GetOrderReceipt(ctx, db)
+	})
+	mainRoute.POST("/orders/:id/stream/token", func(ctx *gin.Context) {
+		orders.CreateStreamToken(ctx, db)
+	})
+	streamRoute.GET("/orders/:id/stream", func(ctx *gin.Context) {
+		orders.StreamOrder(ctx, db)
+	})
+	mainRoute.GET("/orders/:id/timeline", func(ctx *gin.Context) {
+		orders.GetOrderTimeline(ctx, db)
+	})
+	mainRoute.POST("/orders/checkout", IdempotencyMiddleware(db), func(ctx *gin.Context) {
 		orders.Checkout(ctx, db, fcm)
 	})
 	mainRoute.POST("/orders/:id/complete", func(ctx *gin.Context) {
@@ -209,6 +316,98 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	mainRoute.PATCH("/orders/:id/orderProgress", func(ctx *gin.Context) {
 		orders.UpdateOrderState(ctx, db, fcm)
 	})
+	mainRoute.PATCH("/orders/:id/accept", func(ctx *gin.Context) {
+		orders.VendorAcceptOrder(ctx, db, fcm)
+	})
+	mainRoute.PATCH("/orders/:id/reject", func(ctx *gin.Context) {
+		orders.VendorRejectOrder(ctx, db, fcm)
+	})
+	mainRoute.GET("/orders/:id/substitutions", func(ctx *gin.Context) {
+		orders.GetOrderSubstitutions(ctx, db)
+	})
+	mainRoute.POST("/orders/:id/substitutions", func(ctx *gin.Context) {
+		orders.ProposeSubstitution(ctx, db, fcm)
+	})
+	mainRoute.PATCH("/orders/:id/substitutions/:substitutionId/approve", func(ctx *gin.Context) {
+		orders.ApproveSubstitution(ctx, db, fcm)
+	})
+	mainRoute.PATCH("/orders/:id/substitutions/:substitutionId/reject", func(ctx *gin.Context) {
+		orders.RejectSubstitution(ctx, db, fcm)
+	})
+	mainRoute.POST("/orders/:id/reorder", func(ctx *gin.Context) {
+		carts.Reorder(ctx, db)
+	})
+	mainRoute.POST("/orders/:id/tip", IdempotencyMiddleware(db), func(ctx *gin.Context) {
+		orders.TipRider(ctx, db, fcm)
+	})
+	mainRoute.POST("/orders/:id/reviews", func(ctx *gin.Context) {
+		reviews.CreateReview(ctx, db)
+	})
+	mainRoute.PATCH("/reviews/:id", func(ctx *gin.Context) {
+		reviews.UpdateReview(ctx, db)
+	})
+	mainRoute.POST("/reviews/:id/reply", func(ctx *gin.Context) {
+		reviews.ReplyToReview(ctx, db)
+	})
+
+	// Errands
+	mainRoute.GET("/errands", func(ctx *gin.Context) {
+		errands.GetErrands(ctx, db)
+	})
+	mainRoute.GET("/errands/:id", func(ctx *gin.Context) {
+		errands.GetErrand(ctx, db)
+	})
+	mainRoute.POST("/errands/checkout", IdempotencyMiddleware(db), func(ctx *gin.Context) {
+		errands.Checkout(ctx, db, fcm)
+	})
+	mainRoute.PATCH("/errands/:id/progress", func(ctx *gin.Context) {
+		errands.UpdateErrandProgress(ctx, db, fcm)
+	})
+	mainRoute.PATCH("/errands/:id/spend", func(ctx *gin.Context) {
+		errands.ReportErrandSpend(ctx, db)
+	})
+	mainRoute.POST("/errands/:id/complete", func(ctx *gin.Context) {
+		errands.MarkErrandAsComplete(ctx, db, fcm)
+	})
+	mainRoute.PATCH("/errands/:id/cancel", func(ctx *gin.Context) {
+		errands.CancelErrand(ctx, db)
+	})
+
+	// Disputes
+	mainRoute.POST("/orders/:id/dispute", func(ctx *gin.Context) {
+		disputes.OpenDispute(ctx, db)
+	})
+	mainRoute.GET("/orders/:id/dispute", func(ctx *gin.Context) {
+		disputes.GetOrderDispute(ctx, db)
+	})
+
+	// Conversations
+	mainRoute.GET("/orders/:id/conversation", func(ctx *gin.Context) {
+		conversations.GetConversation(ctx, db)
+	})
+	mainRoute.GET("/orders/:id/messages", func(ctx *gin.Context) {
+		conversations.GetMessages(ctx, db)
+	})
+	mainRoute.POST("/orders/:id/messages", func(ctx *gin.Context) {
+		conversations.SendMessage(ctx, db, fcm)
+	})
+	mainRoute.PATCH("/orders/:id/messages/read", func(ctx *gin.Context) {
+		conversations.MarkMessagesAsRead(ctx, db)
+	})
+
+	// Dispatch
+	mainRoute.PATCH("/dispatch/availability", func(ctx *gin.Context) {
+		dispatch.UpdateRiderAvailability(ctx, db)
+	})
+	mainRoute.GET("/dispatch/offers", func(ctx *gin.Context) {
+		dispatch.GetMyOffers(ctx, db)
+	})
+	mainRoute.PATCH("/dispatch/offers/:id/decline", func(ctx *gin.Context) {
+		dispatch.DeclineOffer(ctx, db)
+	})
+	mainRoute.POST("/dispatch/location", func(ctx *gin.Context) {
+		dispatch.RecordRiderLocation(ctx, db)
+	})
 
 	// Payments
 	mainRoute.POST("/createBankAccount", func(ctx *gin.Context) {
@@ -262,6 +461,9 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 	publicRoute.GET("/latestAppVersion", func(ctx *gin.Context) {
 		public.GetCustomerAppVersion(ctx, db)
 	})
+	publicRoute.GET("/stores/:id/reviews", func(ctx *gin.Context) {
+		reviews.GetStoreReviews(ctx, db)
+	})
 
 	// Health check endpoint
 	r.GET("/api/ping", func(c *gin.Context) {
@@ -276,7 +478,15 @@ func SetupRoutes(r *gin.Engine, db *mongo.Database, fcm *messaging.Client) {
 
 	go VirtualAccountProcessor(db)
 
-	go RatingComputer(db)
+	go ScheduledOrderDispatcher(db, fcm)
+
+	go VendorResponseTimeoutProcessor(db, fcm)
+
+	go RiderDispatchProcessor(db, fcm)
+
+	go SubstitutionTimeoutProcessor(db, fcm)
+
+	go OrderChangeWatcher(db)
 
 	go func() {
 		for {
@@ -46,6 +46,7 @@ func GetUser(c *gin.Context, db *mongo.Database) {
 	type ResponseUser struct {
 		data.User
 		VirtualBankAccount *ResponseVirtualBankAccount `json:"virtualBankAccount,omitempty"`
+		Rating             *data.RiderRating           `json:"rating,omitempty"`
 	}
 
 	responseUser := ResponseUser{
@@ -60,6 +61,15 @@ func GetUser(c *gin.Context, db *mongo.Database) {
 		}
 	}
 
+	if user.Type == "rider" {
+		riderRatings, err := utils.GetRiderRatings(c, db, []primitive.ObjectID{user.ID})
+		if err != nil {
+			slog.Error("failed to fetch rider rating", "error", err)
+		} else if riderRating, ok := riderRatings[user.ID]; ok {
+			responseUser.Rating = &riderRating
+		}
+	}
+
 	c.JSON(http.StatusOK, responseUser)
 
 }
@@ -92,6 +102,7 @@ func GetMe(c *gin.Context, db *mongo.Database) {
 	type ResponseUser struct {
 		data.User
 		VirtualBankAccount *ResponseVirtualBankAccount `json:"virtualBankAccount,omitempty"`
+		Rating             *data.RiderRating           `json:"rating,omitempty"`
 	}
 
 	responseUser := ResponseUser{
@@ -106,6 +117,15 @@ func GetMe(c *gin.Context, db *mongo.Database) {
 		}
 	}
 
+	if user.Type == "rider" {
+		riderRatings, err := utils.GetRiderRatings(c, db, []primitive.ObjectID{user.ID})
+		if err != nil {
+			slog.Error("failed to fetch rider rating", "error", err)
+		} else if riderRating, ok := riderRatings[user.ID]; ok {
+			responseUser.Rating = &riderRating
+		}
+	}
+
 	c.JSON(http.StatusOK, responseUser)
 }
 
@@ -10,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"useboi-boi/backend/internal/data"
 	"useboi-boi/backend/utils"
@@ -22,12 +23,39 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// VendorResponse is a store along with whether it is taking orders right now.
+type VendorResponse struct {
+	data.Store
+	IsOpenNow   bool       `json:"isOpenNow"`
+	NextOpensAt *time.Time `json:"nextOpensAt,omitempty"`
+}
+
+func toVendorResponse(store data.Store, now time.Time) VendorResponse {
+	response := VendorResponse{Store: store, IsOpenNow: true}
+
+	isOpen, err := utils.IsStoreOpenAt(&store, now)
+	if err != nil {
+		slog.Error("Failed to evaluate store hours", "storeId", store.ID.Hex(), "error", err.Error())
+		return response
+	}
+	response.IsOpenNow = isOpen
+
+	if !isOpen {
+		response.NextOpensAt, err = utils.NextStoreOpening(&store, now)
+		if err != nil {
+			slog.Error("Failed to compute next store opening", "storeId", store.ID.Hex(), "error", err.Error())
+		}
+	}
+
+	return response
+}
+
 // @Summary Get all vendors
 // @Description Get a list of all active vendors
 // @Tags Vendors
 // @Accept json
 // @Produce json
-// @Success 200 {array} data.Store "List of active vendors"
+// @Success 200 {array} VendorResponse "List of active vendors"
 // @Failure 500 {object} object "Failed to decode stores"
 // @Router /vendors [get]
 // @Security BearerAuth
@@ -43,14 +71,16 @@ func GetAllVendors(c *gin.Context, db *mongo.Database) {
 
 	defer cursor.Close(c)
 
-	vendors := []data.Store{}
+	now := time.Now()
+
+	vendors := []VendorResponse{}
 	for cursor.Next(c) {
 		var vendor data.Store
 		if err := cursor.Decode(&vendor); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		vendors = append(vendors, vendor)
+		vendors = append(vendors, toVendorResponse(vendor, now))
 	}
 
 	if err := cursor.Err(); err != nil {
@@ -173,7 +203,7 @@ func UpdateStoreImage(c *gin.Context, db *mongo.Database) {
 // @Accept json
 // @Produce json
 // @Param id path string true "Vendor ID"
-// @Success 200 {object} data.Store "Vendor object"
+// @Success 200 {object} VendorResponse "Vendor object"
 // @Failure 400 {object} object "Invalid vendor ID"
 // @Failure 500 {object} object "Error fetching store"
 // @Router /vendors/{id} [get]
@@ -198,7 +228,7 @@ func GetVendor(c *gin.Context, db *mongo.Database) {
 	}
 
 	if !store.ID.IsZero() {
-		c.JSON(http.StatusOK, store)
+		c.JSON(http.StatusOK, toVendorResponse(store, time.Now()))
 		return
 	} else {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "No store found with this id"})
@@ -234,6 +264,13 @@ func UpdateVendor(c *gin.Context, db *mongo.Database) {
 		return
 	}
 
+	if len(updateRequest.Timezone) > 0 {
+		if _, err := utils.StoreLocation(&updateRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	vendorsCollection := db.Collection(utils.STORE)
 
 	update := bson.M{"$set": updateRequest}
@@ -250,6 +287,131 @@ func UpdateVendor(c *gin.Context, db *mongo.Database) {
 
 }
 
+type StoreClosureRequest struct {
+	StartDate string  `json:"startDate" validate:"required"`
+	EndDate   string  `json:"endDate" validate:"required"`
+	Reason    *string `json:"reason"`
+}
+
+// @Summary Add a store closure
+// @Description Close the merchant's store for a run of days, e.g. a public holiday. Dates are inclusive and in the store's timezone.
+// @Tags Vendors
+// @Accept json
+// @Produce json
+// @Param request body StoreClosureRequest true "Closure dates"
+// @Success 201 {object} data.StoreClosure "Created closure"
+// @Failure 400 {object} object "Invalid request body"
+// @Failure 403 {object} object "User is not a merchant"
+// @Failure 500 {object} object "Failed to add closure"
+// @Router /vendor/closures [post]
+// @Security BearerAuth
+func AddStoreClosure(c *gin.Context, db *mongo.Database) {
+
+	var request StoreClosureRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body. " + err.Error()})
+		return
+	}
+
+	storeId, err := getMerchantStoreId(c, db)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	closure := data.StoreClosure{
+		ID:        primitive.NewObjectID(),
+		StartDate: request.StartDate,
+		EndDate:   request.EndDate,
+		Reason:    request.Reason,
+	}
+
+	if err := utils.ValidateStoreClosure(&closure); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := db.Collection(utils.STORE).UpdateOne(c, bson.M{"_id": storeId}, bson.M{
+		"$push": bson.M{"closures": closure},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add closure. " + err.Error()})
+		slog.Error("Failed to add store closure", "error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, closure)
+
+}
+
+// @Summary Remove a store closure
+// @Description Remove one of the merchant's store closures
+// @Tags Vendors
+// @Accept json
+// @Produce json
+// @Param id path string true "Closure ID"
+// @Success 200 {object} object "Successfully removed closure"
+// @Failure 400 {object} object "Invalid closure ID"
+// @Failure 403 {object} object "User is not a merchant"
+// @Failure 404 {object} object "Closure not found"
+// @Router /vendor/closures/{id} [delete]
+// @Security BearerAuth
+func RemoveStoreClosure(c *gin.Context, db *mongo.Database) {
+
+	closureId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid closure id. " + err.Error()})
+		return
+	}
+
+	storeId, err := getMerchantStoreId(c, db)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := db.Collection(utils.STORE).UpdateOne(c, bson.M{"_id": storeId, "closures._id": closureId}, bson.M{
+		"$pull": bson.M{"closures": bson.M{"_id": closureId}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove closure. " + err.Error()})
+		slog.Error("Failed to remove store closure", "error", err.Error())
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "closure not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "successfully removed closure"})
+
+}
+
+func getMerchantStoreId(c *gin.Context, db *mongo.Database) (primitive.ObjectID, error) {
+
+	userId, err := primitive.ObjectIDFromHex(c.GetString("userId"))
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("invalid userId associated with request")
+	}
+
+	var user data.User
+	if err := db.Collection(utils.USER).FindOne(c, bson.M{"_id": userId}).Decode(&user); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("user not found")
+	}
+
+	if user.Type != "merchant" || user.StoreId == nil {
+		return primitive.NilObjectID, fmt.Errorf("only merchants can manage store closures")
+	}
+
+	return *user.StoreId, nil
+}
+
 // type CategoryRequest struct {
 // 	Name    string `json:"name" validate:"required"`
 // 	StoreId string `json:"storeId" validate:"required"`
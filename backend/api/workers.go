@@ -5,10 +5,13 @@ import (
 	"log/slog"
 	"time"
 
+	"useboi-boi/backend/api/dispatch"
+	"useboi-boi/backend/api/orders"
 	"useboi-boi/backend/api/payments"
 	"useboi-boi/backend/internal/data"
 	"useboi-boi/backend/utils"
 
+	"firebase.google.com/go/messaging"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -65,107 +68,219 @@ func WithdrawalProcessor(db *mongo.Database) {
 	}
 }
 
-func RatingComputer(db *mongo.Database) {
+// ScheduledOrderDispatcher tells vendors about scheduled orders once their slot is
+// within SCHEDULED_ORDER_LEAD_MINUTES (default 45).
+func ScheduledOrderDispatcher(db *mongo.Database, fcm *messaging.Client) {
+	slog.Info("message", "ScheduledOrderDispatcher", "👍🏾")
 
-	slog.Info("message", "starting ratings compute operation", "👍🏾")
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		DispatchScheduledOrders(db, fcm)
+	}
+}
+
+func DispatchScheduledOrders(db *mongo.Database, fcm *messaging.Client) {
 
-	userCollection := db.Collection(utils.USER)
-	storeCollection := db.Collection(utils.STORE)
 	orderCollection := db.Collection(utils.ORDER)
-	riderRatingCollection := db.Collection(utils.RIDER_RATING)
 
-	ticker := time.NewTicker(24 * time.Hour)
+	leadTime := time.Duration(utils.GetEnvInt("SCHEDULED_ORDER_LEAD_MINUTES", 45)) * time.Minute
+
+	cursor, err := orderCollection.Find(context.TODO(), bson.M{
+		"status":       data.OrderStatusOngoing,
+		"scheduledFor": bson.M{"$lte": time.Now().Add(leadTime)},
+		"dispatchedAt": bson.M{"$exists": false},
+	})
+	if err != nil {
+		slog.Error("Failed to get scheduled orders", "error", err.Error())
+		return
+	}
+
+	var orders []data.Order
+	if err := cursor.All(context.TODO(), &orders); err != nil {
+		slog.Error("Failed to decode scheduled orders", "error", err.Error())
+		return
+	}
+
+	for _, order := range orders {
+		now := time.Now()
+
+		// Claim the order first so it is only ever dispatched once.
+		vendorResponseDeadline := now.Add(utils.VendorResponseTimeout())
+		result, err := orderCollection.UpdateOne(context.TODO(), bson.M{
+			"_id":          order.ID,
+			"dispatchedAt": bson.M{"$exists": false},
+		}, bson.M{"$set": bson.M{
+			"dispatchedAt":           now,
+			"vendorResponseDeadline": vendorResponseDeadline,
+			"updatedAt":              now,
+		}})
+		if err != nil {
+			slog.Error("Failed to dispatch scheduled order", "orderId", order.ID.Hex(), "error", err.Error())
+			continue
+		}
+		if result.MatchedCount == 0 {
+			continue
+		}
+
+		order.DispatchedAt = &now
+		order.VendorResponseDeadline = &vendorResponseDeadline
+
+		utils.SendNewOrderNotificationToMerchant(context.TODO(), db, fcm, &order)
+
+		slog.Info("Dispatched scheduled order", "orderId", order.ID.Hex())
+	}
+}
+
+// VendorResponseTimeoutProcessor cancels and refunds orders the vendor has not accepted in time.
+func VendorResponseTimeoutProcessor(db *mongo.Database, fcm *messaging.Client) {
+	slog.Info("message", "VendorResponseTimeoutProcessor", "👍🏾")
+
+	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
+		CancelUnacceptedOrders(db, fcm)
+	}
+}
+
+func CancelUnacceptedOrders(db *mongo.Database, fcm *messaging.Client) {
+
+	cursor, err := db.Collection(utils.ORDER).Find(context.TODO(), bson.M{
+		"status":                 data.OrderStatusOngoing,
+		"orderProgressStatus":    data.OrderCreated,
+		"vendorResponseDeadline": bson.M{"$lte": time.Now()},
+	})
+	if err != nil {
+		slog.Error("Failed to get unaccepted orders", "error", err.Error())
+		return
+	}
+
+	var unacceptedOrders []data.Order
+	if err := cursor.All(context.TODO(), &unacceptedOrders); err != nil {
+		slog.Error("Failed to decode unaccepted orders", "error", err.Error())
+		return
+	}
 
-		startTime := time.Now()
+	reason := "The vendor did not accept your order in time"
 
-		var riders []data.User
-		riderCursor, err := userCollection.Find(context.TODO(), bson.M{"type": "rider"})
+	for _, order := range unacceptedOrders {
+		err := orders.CancelAndRefundOrder(context.TODO(), db, &order, data.ActorSystem, nil, &reason)
+		if err == orders.ErrOrderNotOngoing {
+			continue
+		}
 		if err != nil {
-			slog.Info("Failed to get riders", "error", err.Error())
-			return
+			slog.Error("Failed to cancel unaccepted order", "orderId", order.ID.Hex(), "error", err.Error())
+			continue
 		}
-		riderCursor.All(context.Background(), &riders)
 
-		for _, rider := range riders {
+		utils.SendOrderCancelledNotificationToCustomer(context.TODO(), db, fcm, &order)
 
-			var riderOrders []data.Order
-			riderOrdersCursor, err := orderCollection.Find(context.TODO(), bson.M{"riderId": rider.ID, "status": "completed"}, options.Find().SetLimit(30))
-			if err != nil {
-				slog.Info("Failed to get rider's orders", "error", err.Error())
-				continue
-			}
+		slog.Info("Cancelled order not accepted by vendor", "orderId", order.ID.Hex())
+	}
+}
 
-			riderOrdersCursor.All(context.TODO(), &riderOrders)
+// SubstitutionTimeoutProcessor settles the substitutions customers haven't answered in time.
+func SubstitutionTimeoutProcessor(db *mongo.Database, fcm *messaging.Client) {
+	slog.Info("message", "SubstitutionTimeoutProcessor", "👍🏾")
 
-			var riderRatings []int
-			for _, order := range riderOrders {
-				if order.RiderRating != nil {
-					riderRatings = append(riderRatings, *order.RiderRating)
-				}
-			}
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
 
-			riderRatingAverage := utils.Average(riderRatings)
+	for range ticker.C {
+		orders.ExpireSubstitutions(context.TODO(), db, fcm)
+	}
+}
 
-			_, err = riderRatingCollection.UpdateOne(context.TODO(), bson.M{"userId": rider.ID}, bson.M{
-				"$set": bson.M{
-					"value":     riderRatingAverage,
-					"updatedAt": time.Now(),
-				},
-			}, options.Update().SetUpsert(true))
+// RiderDispatchProcessor keeps offering orders to riders in waves until one accepts, and cancels
+// and refunds the orders no rider accepted in DISPATCH_MAX_WAVES waves.
+func RiderDispatchProcessor(db *mongo.Database, fcm *messaging.Client) {
+	slog.Info("message", "RiderDispatchProcessor", "👍🏾")
 
-			if err != nil {
-				slog.Info("Failed to update rider rating", "error", err.Error())
-				continue
-			}
-		}
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
 
-		var stores []data.Store
-		storesCursor, err := storeCollection.Find(context.TODO(), bson.M{"status": "active"})
+	for range ticker.C {
+		unassignedOrders := dispatch.ProcessPendingDispatches(context.TODO(), db, fcm)
+		CancelUnassignedOrders(db, fcm, unassignedOrders)
+	}
+}
+
+func CancelUnassignedOrders(db *mongo.Database, fcm *messaging.Client, unassignedOrders []data.Order) {
+
+	reason := "No rider was available to deliver your order"
+
+	for _, order := range unassignedOrders {
+		err := orders.CancelAndRefundOrder(context.TODO(), db, &order, data.ActorSystem, nil, &reason)
+		if err == orders.ErrOrderNotOngoing {
+			continue
+		}
 		if err != nil {
-			slog.Info("Failed to get stores", "error", err.Error())
-			return
+			slog.Error("Failed to cancel order no rider accepted", "orderId", order.ID.Hex(), "error", err.Error())
+			continue
 		}
-		storesCursor.All(context.TODO(), &stores)
 
-		for _, store := range stores {
+		utils.SendOrderCancelledNotificationToCustomer(context.TODO(), db, fcm, &order)
 
-			var storeOrders []data.Order
-			storeOrdersCursor, err := orderCollection.Find(context.TODO(), bson.M{"storeId": store.ID, "status": "completed"}, options.Find().SetLimit(30))
-			if err != nil {
-				slog.Info("Failed to get stores's orders", "error", err.Error())
-				continue
-			}
+		slog.Info("Cancelled order no rider accepted", "orderId", order.ID.Hex(), "waves", order.DispatchWave)
+	}
+}
 
-			storeOrdersCursor.All(context.TODO(), &storeOrders)
+// OrderChangeWatcher follows the Order collection's change stream and publishes every order change
+// on the order event bus, so tracking streams hear about changes made by any handler, worker or
+// server instance. It picks up where it left off after an error.
+func OrderChangeWatcher(db *mongo.Database) {
+	slog.Info("message", "OrderChangeWatcher", "👍🏾")
 
-			var storeRatings []int
-			for _, order := range storeOrders {
-				if order.VendorRating != nil {
-					storeRatings = append(storeRatings, *order.VendorRating)
-				}
-			}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}}}}},
+	}
 
-			storeRatingAverage := utils.Average(storeRatings)
+	var resumeToken bson.Raw
 
-			_, err = storeCollection.UpdateOne(context.TODO(), bson.M{"_id": store.ID}, bson.M{
-				"$set": bson.M{
-					"ratings": storeRatingAverage,
-				},
-			})
+	for {
+		streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+		if resumeToken != nil {
+			streamOptions.SetResumeAfter(resumeToken)
+		}
 
-			if err != nil {
-				slog.Info("Failed to update store's rating", "error", err.Error())
+		stream, err := db.Collection(utils.ORDER).Watch(context.TODO(), pipeline, streamOptions)
+		if err != nil {
+			slog.Error("Failed to watch order changes", "error", err.Error())
+			resumeToken = nil
+			time.Sleep(30 * time.Second)
+			continue
+		}
+
+		for stream.Next(context.TODO()) {
+			resumeToken = stream.ResumeToken()
+
+			var change struct {
+				FullDocument *data.Order `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				slog.Error("Failed to decode order change", "error", err.Error())
+				continue
+			}
+
+			if change.FullDocument == nil || !utils.OrderEvents.HasSubscribers(change.FullDocument.ID) {
 				continue
 			}
+
+			utils.OrderEvents.Publish(utils.OrderEvent{
+				Type:    utils.OrderEventUpdated,
+				OrderID: change.FullDocument.ID,
+				Order:   change.FullDocument,
+			})
 		}
 
-		duration := time.Since(startTime)
-		slog.Info("message", "finished ratings compute operation. took ", duration)
+		if err := stream.Err(); err != nil {
+			slog.Error("Order change stream stopped", "error", err.Error())
+		}
+		stream.Close(context.TODO())
+		time.Sleep(5 * time.Second)
 	}
-
 }
 
 func VirtualAccountProcessor(db *mongo.Database) {
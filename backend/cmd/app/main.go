@@ -8,6 +8,7 @@ import (
 	"useboi-boi/backend/api"
 	"useboi-boi/backend/api/admin"
 	"useboi-boi/backend/internal/data"
+	"useboi-boi/backend/utils"
 
 	_ "useboi-boi/backend/cmd/app/docs"
 
@@ -27,7 +28,8 @@ import (
 // @name Authorization
 func main() {
 
-	server := gin.Default()
+	server := gin.New()
+	server.Use(api.RequestLogger(), gin.Recovery())
 
 	client, err := data.ConnectToMongoDB(&gin.Context{})
 	if err != nil {
@@ -70,6 +72,22 @@ func main() {
 
 	admin.SetupAdmin(db)
 
+	if err := utils.EnsureCartIndexes(context.Background(), db); err != nil {
+		slog.Error("error creating cart indexes", "err", err)
+	}
+
+	if err := utils.EnsureRiderLocationIndexes(context.Background(), db); err != nil {
+		slog.Error("error creating rider location indexes", "err", err)
+	}
+
+	if err := utils.EnsureConversationIndexes(context.Background(), db); err != nil {
+		slog.Error("error creating conversation indexes", "err", err)
+	}
+
+	if err := utils.EnsureSubstitutionIndexes(context.Background(), db); err != nil {
+		slog.Error("error creating substitution indexes", "err", err)
+	}
+
 	server.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	api.SetupRoutes(server, db, notificationClient)
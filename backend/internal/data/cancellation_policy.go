@@ -0,0 +1,105 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CancellationPolicy says whether a role may cancel an order at a given progress status and how the
+// order's price is split when it does. Whatever is not refunded or paid to the store or rider is kept
+// by the platform.
+type CancellationPolicy struct {
+	ID             primitive.ObjectID  `bson:"_id,omitempty" json:"id,omitempty"`
+	ProgressStatus OrderProgressStatus `bson:"progressStatus" json:"progressStatus"`
+	ActorRole      ActorRole           `bson:"actorRole" json:"actorRole"`
+	CanCancel      bool                `bson:"canCancel" json:"canCancel"`
+	RefundPercent  float64             `bson:"refundPercent" json:"refundPercent"`
+	StorePercent   float64             `bson:"storePercent" json:"storePercent"`
+	RiderPercent   float64             `bson:"riderPercent" json:"riderPercent"`
+	UpdatedAt      *time.Time          `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// CancellationSplit is how much of a cancelled order goes to each party.
+type CancellationSplit struct {
+	Refund   float64 `bson:"refund" json:"refund"`
+	Store    float64 `bson:"store" json:"store"`
+	Rider    float64 `bson:"rider" json:"rider"`
+	Platform float64 `bson:"platform" json:"platform"`
+}
+
+// DefaultCancellationPolicies apply to any progress status and role that has no policy stored.
+// Customers pay for the work the store and rider have already put in; anyone else cancelling
+// gives the customer their money back in full.
+var DefaultCancellationPolicies = []CancellationPolicy{
+	{ProgressStatus: OrderCreated, ActorRole: ActorCustomer, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: OrderReceivedByVendor, ActorRole: ActorCustomer, CanCancel: true, RefundPercent: 80, StorePercent: 20},
+	{ProgressStatus: OrderAcceptedByRider, ActorRole: ActorCustomer, CanCancel: true, RefundPercent: 70, StorePercent: 20, RiderPercent: 10},
+	{ProgressStatus: RiderAtVendor, ActorRole: ActorCustomer, CanCancel: true, RefundPercent: 50, StorePercent: 40, RiderPercent: 10},
+	{ProgressStatus: RiderOnHisWay, ActorRole: ActorCustomer},
+	{ProgressStatus: RiderAtUserLocation, ActorRole: ActorCustomer},
+
+	{ProgressStatus: OrderCreated, ActorRole: ActorVendor, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: OrderReceivedByVendor, ActorRole: ActorVendor, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: OrderAcceptedByRider, ActorRole: ActorVendor, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderAtVendor, ActorRole: ActorVendor, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderOnHisWay, ActorRole: ActorVendor},
+	{ProgressStatus: RiderAtUserLocation, ActorRole: ActorVendor},
+
+	{ProgressStatus: OrderCreated, ActorRole: ActorRider},
+	{ProgressStatus: OrderReceivedByVendor, ActorRole: ActorRider},
+	{ProgressStatus: OrderAcceptedByRider, ActorRole: ActorRider, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderAtVendor, ActorRole: ActorRider, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderOnHisWay, ActorRole: ActorRider},
+	{ProgressStatus: RiderAtUserLocation, ActorRole: ActorRider},
+
+	{ProgressStatus: OrderCreated, ActorRole: ActorSystem, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: OrderReceivedByVendor, ActorRole: ActorSystem, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: OrderAcceptedByRider, ActorRole: ActorSystem, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderAtVendor, ActorRole: ActorSystem, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderOnHisWay, ActorRole: ActorSystem, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderAtUserLocation, ActorRole: ActorSystem, CanCancel: true, RefundPercent: 100},
+
+	{ProgressStatus: OrderCreated, ActorRole: ActorAdmin, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: OrderReceivedByVendor, ActorRole: ActorAdmin, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: OrderAcceptedByRider, ActorRole: ActorAdmin, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderAtVendor, ActorRole: ActorAdmin, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderOnHisWay, ActorRole: ActorAdmin, CanCancel: true, RefundPercent: 100},
+	{ProgressStatus: RiderAtUserLocation, ActorRole: ActorAdmin, CanCancel: true, RefundPercent: 100},
+}
+
+// DefaultCancellationPolicy returns the built-in policy for a progress status and role. Anything not
+// listed may not cancel.
+func DefaultCancellationPolicy(progressStatus OrderProgressStatus, role ActorRole) CancellationPolicy {
+	for _, policy := range DefaultCancellationPolicies {
+		if policy.ProgressStatus == progressStatus && policy.ActorRole == role {
+			return policy
+		}
+	}
+	return CancellationPolicy{ProgressStatus: progressStatus, ActorRole: role}
+}
+
+func (p *CancellationPolicy) Validate() error {
+	if !p.ProgressStatus.IsValid() {
+		return fmt.Errorf("not a valid order progress status")
+	}
+
+	switch p.ActorRole {
+	case ActorCustomer, ActorVendor, ActorRider, ActorAdmin, ActorSystem:
+	default:
+		return fmt.Errorf("not a valid actor role")
+	}
+
+	for _, percent := range []float64{p.RefundPercent, p.StorePercent, p.RiderPercent} {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("percentages must be between 0 and 100")
+		}
+	}
+
+	if p.RefundPercent+p.StorePercent+p.RiderPercent > 100 {
+		return fmt.Errorf("refund, store and rider percentages cannot add up to more than 100")
+	}
+
+	return nil
+}
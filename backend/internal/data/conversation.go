@@ -0,0 +1,53 @@
+package data
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MessageType string
+
+const (
+	MessageText  MessageType = "text"
+	MessageImage MessageType = "image"
+)
+
+// Conversation is the chat thread of an order between its customer, its rider and the store.
+// There is at most one per order, and it is locked once the order is no longer ongoing.
+type Conversation struct {
+	ID            primitive.ObjectID  `bson:"_id" json:"id"`
+	OrderID       primitive.ObjectID  `bson:"orderId" json:"orderId"`
+	CustomerID    primitive.ObjectID  `bson:"customerId" json:"customerId"`
+	StoreID       primitive.ObjectID  `bson:"storeId" json:"storeId"`
+	RiderID       *primitive.ObjectID `bson:"riderId,omitempty" json:"riderId,omitempty"`
+	IsLocked      bool                `bson:"isLocked" json:"isLocked"`
+	LockedAt      *time.Time          `bson:"lockedAt,omitempty" json:"lockedAt,omitempty"`
+	LastMessage   *Message            `bson:"lastMessage,omitempty" json:"lastMessage,omitempty"`
+	LastMessageAt *time.Time          `bson:"lastMessageAt,omitempty" json:"lastMessageAt,omitempty"`
+	CreatedAt     time.Time           `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time           `bson:"updatedAt" json:"updatedAt"`
+}
+
+// MessageReceipt records when a participant read a message.
+type MessageReceipt struct {
+	UserID primitive.ObjectID `bson:"userId" json:"userId"`
+	ReadAt time.Time          `bson:"readAt" json:"readAt"`
+}
+
+type Message struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	ConversationID primitive.ObjectID `bson:"conversationId" json:"conversationId"`
+	OrderID        primitive.ObjectID `bson:"orderId" json:"orderId"`
+	SenderID       primitive.ObjectID `bson:"senderId" json:"senderId"`
+	SenderRole     ActorRole          `bson:"senderRole" json:"senderRole"`
+	Type           MessageType        `bson:"type" json:"type"`
+	Text           *string            `bson:"text,omitempty" json:"text,omitempty"`         // caption for images
+	ImageURL       *string            `bson:"imageUrl,omitempty" json:"imageUrl,omitempty"` // image messages only
+	ReadBy         []MessageReceipt   `bson:"readBy" json:"readBy"`
+	CreatedAt      time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+func (t MessageType) IsValid() bool {
+	return t == MessageText || t == MessageImage
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type DisputeReason string
+
+const (
+	DisputeMissingItem  DisputeReason = "missingItem"
+	DisputeWrongItem    DisputeReason = "wrongItem"
+	DisputeDamagedItem  DisputeReason = "damagedItem"
+	DisputeQualityIssue DisputeReason = "qualityIssue"
+	DisputeOther        DisputeReason = "other"
+)
+
+type DisputeStatus string
+
+const (
+	DisputeOpen     DisputeStatus = "open"
+	DisputeResolved DisputeStatus = "resolved"
+	DisputeRejected DisputeStatus = "rejected"
+)
+
+func (r DisputeReason) IsValid() bool {
+	switch r {
+	case DisputeMissingItem, DisputeWrongItem, DisputeDamagedItem, DisputeQualityIssue, DisputeOther:
+		return true
+	}
+	return false
+}
+
+// DisputedItem is a line item of the order the complaint is about, and how many of it.
+type DisputedItem struct {
+	ItemID    primitive.ObjectID `bson:"itemId" json:"itemId"`
+	Name      string             `bson:"name" json:"name"`
+	UnitPrice float64            `bson:"unitPrice" json:"unitPrice"`
+	Quantity  int                `bson:"quantity" json:"quantity"`
+}
+
+// Dispute is a customer's complaint about a completed order. An admin resolves it with a refund to
+// the customer's wallet, taken out of the store's share of the order, or rejects it.
+type Dispute struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	OrderID        primitive.ObjectID `bson:"orderId" json:"orderId"`
+	CustomerID     primitive.ObjectID `bson:"customerId" json:"customerId"`
+	StoreID        primitive.ObjectID `bson:"storeId" json:"storeId"`
+	Reason         DisputeReason      `bson:"reason" json:"reason"`
+	Description    string             `bson:"description" json:"description"`
+	Evidence       []string           `bson:"evidence" json:"evidence"` // image urls
+	Items          []DisputedItem     `bson:"items" json:"items"`
+	ClaimedAmount  float64            `bson:"claimedAmount" json:"claimedAmount"` // what the disputed items cost
+	Status         DisputeStatus      `bson:"status" json:"status"`
+	RefundAmount   *float64           `bson:"refundAmount,omitempty" json:"refundAmount,omitempty"`
+	StoreDebit     *float64           `bson:"storeDebit,omitempty" json:"storeDebit,omitempty"` // the part of the refund taken from the store
+	ResolutionNote *string            `bson:"resolutionNote,omitempty" json:"resolutionNote,omitempty"`
+	ResolvedAt     *time.Time         `bson:"resolvedAt,omitempty" json:"resolvedAt,omitempty"`
+	CreatedAt      time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt      time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
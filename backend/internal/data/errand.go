@@ -0,0 +1,98 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ErrandProgressStatus string
+
+const (
+	ErrandCreated             ErrandProgressStatus = "errandCreated"
+	ErrandReceivedByRider     ErrandProgressStatus = "errandReceivedByRider"
+	ErrandRiderOnHisWay       ErrandProgressStatus = "riderOnHisWay"
+	ErrandRiderAtUserLocation ErrandProgressStatus = "riderAtUserLocation"
+)
+
+// errandProgressTransitions lists, for every errand progress status, the status it may move to.
+// Errands have no vendor, so only the rider ever moves one forward.
+var errandProgressTransitions = map[ErrandProgressStatus]ErrandProgressStatus{
+	ErrandCreated:         ErrandReceivedByRider,
+	ErrandReceivedByRider: ErrandRiderOnHisWay,
+	ErrandRiderOnHisWay:   ErrandRiderAtUserLocation,
+}
+
+// Errand is a customer's request for a rider to pick things up or run tasks at one address and
+// bring them to another. The customer pays the estimated budget plus the delivery fee up front;
+// whatever the rider doesn't spend is given back when the errand is completed.
+type Errand struct {
+	ID                 primitive.ObjectID    `bson:"_id,omitempty" json:"id,omitempty"`
+	CustomerID         primitive.ObjectID    `bson:"customerId" json:"customerId"`
+	RiderID            *primitive.ObjectID   `bson:"riderId,omitempty" json:"riderId,omitempty"`
+	PickupAddress      string                `bson:"pickupAddress" json:"pickupAddress"`
+	PickupMapLocation  string                `bson:"pickupMapLocation" json:"pickupMapLocation"`
+	DropoffAddress     string                `bson:"dropoffAddress" json:"dropoffAddress"`
+	DropoffMapLocation string                `bson:"dropoffMapLocation" json:"dropoffMapLocation"`
+	Tasks              []string              `bson:"tasks" json:"tasks"`
+	Instructions       *string               `bson:"instructions,omitempty" json:"instructions,omitempty"`
+	EstimatedBudget    float64               `bson:"estimatedBudget" json:"estimatedBudget"`
+	ActualSpend        *float64              `bson:"actualSpend,omitempty" json:"actualSpend,omitempty"`
+	ReceiptImage       *string               `bson:"receiptImage,omitempty" json:"receiptImage,omitempty"`
+	DeliveryFee        float64               `bson:"deliveryFee" json:"deliveryFee"`
+	Price              float64               `bson:"price" json:"price"`         // estimatedBudget + deliveryFee
+	Code               string                `bson:"code" json:"code,omitempty"` // only ever shown to the customer
+	CodeAttempts       int                   `bson:"codeAttempts,omitempty" json:"codeAttempts,omitempty"`
+	Status             *OrderStatus          `bson:"status,omitempty" json:"status,omitempty"`
+	ProgressStatus     *ErrandProgressStatus `bson:"progressStatus,omitempty" json:"progressStatus,omitempty"`
+	PaymentMethod      string                `bson:"paymentMethod,omitempty" json:"paymentMethod,omitempty"` // card, wallet
+	PaymentReference   *string               `bson:"paymentReference,omitempty" json:"paymentReference,omitempty"`
+	Refunded           *float64              `bson:"refunded,omitempty" json:"refunded,omitempty"`
+	CancellationReason *string               `bson:"cancellationReason,omitempty" json:"cancellationReason,omitempty"`
+	CompletedAt        *time.Time            `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+	CreatedAt          time.Time             `bson:"createdAt" json:"createdAt"`
+	UpdatedAt          time.Time             `bson:"updatedAt" json:"updatedAt"`
+}
+
+func (s ErrandProgressStatus) IsValid() bool {
+	switch s {
+	case ErrandCreated, ErrandReceivedByRider, ErrandRiderOnHisWay, ErrandRiderAtUserLocation:
+		return true
+	}
+	return false
+}
+
+// CanTransitionTo returns an error when role may not move an errand from s to next.
+func (s ErrandProgressStatus) CanTransitionTo(next ErrandProgressStatus, role ActorRole) error {
+	if errandProgressTransitions[s] != next {
+		return fmt.Errorf("errand cannot move from %s to %s", s, next)
+	}
+
+	if role != ActorRider {
+		return fmt.Errorf("a %s cannot move an errand from %s to %s", role, s, next)
+	}
+
+	return nil
+}
+
+func (e *Errand) CurrentStatus() OrderStatus {
+	if e.Status == nil {
+		return OrderStatusOngoing
+	}
+	return *e.Status
+}
+
+func (e *Errand) CurrentProgressStatus() ErrandProgressStatus {
+	if e.ProgressStatus == nil {
+		return ErrandCreated
+	}
+	return *e.ProgressStatus
+}
+
+// HideCodeFrom blanks the delivery code unless userId is the customer who requested the errand.
+func (e *Errand) HideCodeFrom(userId string) {
+	if e.CustomerID.Hex() != userId {
+		e.Code = ""
+	}
+}
@@ -22,6 +22,10 @@ type User struct {
 	Cards              []Card              `bson:"cards,omitempty" json:"cards,omitempty"`
 	Banks              []WithdrawalBank    `bson:"banks,omitempty" json:"banks,omitempty"`
 	P2PBalance         float64             `bson:"p2pBalance,omitempty" json:"p2pBalance,omitempty"`
+	CurrentCartID      *primitive.ObjectID `bson:"currentCartId,omitempty" json:"currentCartId,omitempty"`
+	IsOnline           *bool               `bson:"isOnline,omitempty" json:"isOnline,omitempty"`                   // riders only
+	LastKnownLocation  *string             `bson:"lastKnownLocation,omitempty" json:"lastKnownLocation,omitempty"` // riders only, "lat,lng"
+	LastSeenAt         *time.Time          `bson:"lastSeenAt,omitempty" json:"lastSeenAt,omitempty"`
 }
 
 type VirtualBankAccount struct {
@@ -121,10 +125,22 @@ type Store struct {
 	LikedByUserIds []primitive.ObjectID `bson:"likedByUserIds" json:"likedByUserIds"`
 	MapLocation    *string              `bson:"mapLocation,omitempty" json:"mapLocation,omitempty"`
 	Ratings        *float64             `bson:"ratings,omitempty" json:"ratings,omitempty"`
+	RatingCount    int                  `bson:"ratingCount,omitempty" json:"ratingCount,omitempty"`
+	RatingSum      float64              `bson:"ratingSum,omitempty" json:"-"`
 	Type           string               `bson:"type" json:"type"`
 	OpeningTime    string               `bson:"openingTime,omitempty" json:"openingTime,omitempty"`
 	ClosingTime    string               `bson:"closingTime,omitempty" json:"closingTime,omitempty"`
 	AvailableDays  []string             `bson:"availableDays,omitempty" json:"availableDays,omitempty"`
+	Timezone       string               `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Closures       []StoreClosure       `bson:"closures,omitempty" json:"closures,omitempty"`
+}
+
+// StoreClosure is a run of days, inclusive and in the store's timezone, on which the store is shut.
+type StoreClosure struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	StartDate string             `bson:"startDate" json:"startDate"` // 2006-01-02
+	EndDate   string             `bson:"endDate" json:"endDate"`     // 2006-01-02
+	Reason    *string            `bson:"reason,omitempty" json:"reason,omitempty"`
 }
 
 type OrderTransaction struct {
@@ -198,29 +214,57 @@ type Notification struct {
 // Errand Progress Statuses: errandCreated, errandReceivedByRider, riderOnHisWay, riderAtUserLocation
 
 type Order struct {
-	ID                  primitive.ObjectID  `bson:"_id,omitempty" json:"id,omitempty"`
-	CartID              primitive.ObjectID  `bson:"cartId" json:"cartId"`
-	CustomerID          primitive.ObjectID  `bson:"customerId" json:"customerId"`
-	StoreID             primitive.ObjectID  `bson:"storeId" json:"storeId"`
-	DeliveryInstruction *string             `bson:"deliveryInstruction,omitempty" json:"deliveryInstruction,omitempty"`
-	DeliveryLocation    *string             `bson:"deliveryLocation,omitempty" json:"deliveryLocation,omitempty"`
-	Code                string              `bson:"code" json:"code"`
-	DeliveryMapLocation *string             `bson:"deliveryMapLocation,omitempty" json:"deliveryMapLocation,omitempty"`
-	Status              *string             `bson:"status,omitempty" json:"status,omitempty"`
-	OrderProgressStatus *string             `bson:"orderProgressStatus,omitempty" json:"orderProgressStatus,omitempty"`
-	Price               float64             `bson:"price" json:"price"`
-	DeliveryFee         *float64            `bson:"deliveryFee,omitempty" json:"deliveryFee,omitempty"`
-	ServiceCharge       *float64            `bson:"serviceCharge,omitempty" json:"serviceCharge,omitempty"`
-	CouponPrice         *float64            `bson:"couponPrice,omitempty" json:"couponPrice,omitempty"`
-	IsPaidFor           bool                `bson:"isPaidFor" json:"isPaidFor"`
-	OrderTransactionID  *primitive.ObjectID `bson:"orderTransactionId,omitempty" json:"orderTransactionId,omitempty"`
-	RiderID             *primitive.ObjectID `bson:"riderId,omitempty" json:"riderId,omitempty"`
-	RiderRating         *int                `bson:"riderRating,omitempty" json:"riderRating,omitempty"`
-	RiderReviewID       *primitive.ObjectID `bson:"riderReviewId,omitempty" json:"riderReviewId,omitempty"`
-	VendorRating        *int                `bson:"vendorRating,omitempty" json:"vendorRating,omitempty"`
-	VendorReviewID      *primitive.ObjectID `bson:"vendorReviewId,omitempty" json:"vendorReviewId,omitempty"`
-	CreatedAt           *time.Time          `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
-	UpdatedAt           *time.Time          `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	ID                      primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
+	CartID                  primitive.ObjectID   `bson:"cartId" json:"cartId"`
+	CustomerID              primitive.ObjectID   `bson:"customerId" json:"customerId"`
+	StoreID                 primitive.ObjectID   `bson:"storeId" json:"storeId"`
+	DeliveryInstruction     *string              `bson:"deliveryInstruction,omitempty" json:"deliveryInstruction,omitempty"`
+	DeliveryLocation        *string              `bson:"deliveryLocation,omitempty" json:"deliveryLocation,omitempty"`
+	Code                    string               `bson:"code" json:"code,omitempty"` // only ever shown to the customer
+	CodeAttempts            int                  `bson:"codeAttempts,omitempty" json:"codeAttempts,omitempty"`
+	DeliveryMapLocation     *string              `bson:"deliveryMapLocation,omitempty" json:"deliveryMapLocation,omitempty"`
+	Status                  *OrderStatus         `bson:"status,omitempty" json:"status,omitempty"`
+	OrderProgressStatus     *OrderProgressStatus `bson:"orderProgressStatus,omitempty" json:"orderProgressStatus,omitempty"`
+	Price                   float64              `bson:"price" json:"price"`
+	DeliveryFee             *float64             `bson:"deliveryFee,omitempty" json:"deliveryFee,omitempty"`
+	ServiceCharge           *float64             `bson:"serviceCharge,omitempty" json:"serviceCharge,omitempty"`
+	CouponPrice             *float64             `bson:"couponPrice,omitempty" json:"couponPrice,omitempty"`
+	CouponType              *string              `bson:"couponType,omitempty" json:"couponType,omitempty"` // generic coupons are paid for by Boiboi, store coupons by the store
+	Tip                     *float64             `bson:"tip,omitempty" json:"tip,omitempty"`               // added at checkout and included in price
+	PostDeliveryTip         *float64             `bson:"postDeliveryTip,omitempty" json:"postDeliveryTip,omitempty"`
+	PostDeliveryTipRef      *string              `bson:"postDeliveryTipRef,omitempty" json:"postDeliveryTipRef,omitempty"` // payment reference of the post-delivery tip
+	LineItems               []OrderLineItem      `bson:"lineItems,omitempty" json:"lineItems,omitempty"`
+	SubstitutionWalletDelta *float64             `bson:"substitutionWalletDelta,omitempty" json:"substitutionWalletDelta,omitempty"` // net price change from substitutions, settled against the wallet
+	PaymentMethod           string               `bson:"paymentMethod,omitempty" json:"paymentMethod,omitempty"`                     // card, wallet
+	PaymentReference        *string              `bson:"paymentReference,omitempty" json:"paymentReference,omitempty"`
+	IsPaidFor               bool                 `bson:"isPaidFor" json:"isPaidFor"`
+	OrderTransactionID      *primitive.ObjectID  `bson:"orderTransactionId,omitempty" json:"orderTransactionId,omitempty"`
+	RiderID                 *primitive.ObjectID  `bson:"riderId,omitempty" json:"riderId,omitempty"`
+	RiderRating             *int                 `bson:"riderRating,omitempty" json:"riderRating,omitempty"`
+	RiderReviewID           *primitive.ObjectID  `bson:"riderReviewId,omitempty" json:"riderReviewId,omitempty"`
+	VendorRating            *int                 `bson:"vendorRating,omitempty" json:"vendorRating,omitempty"`
+	VendorReviewID          *primitive.ObjectID  `bson:"vendorReviewId,omitempty" json:"vendorReviewId,omitempty"`
+	ScheduledFor            *time.Time           `bson:"scheduledFor,omitempty" json:"scheduledFor,omitempty"`
+	VendorResponseDeadline  *time.Time           `bson:"vendorResponseDeadline,omitempty" json:"vendorResponseDeadline,omitempty"`
+	EstimatedPrepMinutes    *int                 `bson:"estimatedPrepMinutes,omitempty" json:"estimatedPrepMinutes,omitempty"`
+	CancellationReason      *string              `bson:"cancellationReason,omitempty" json:"cancellationReason,omitempty"`
+	CancellationSplit       *CancellationSplit   `bson:"cancellationSplit,omitempty" json:"cancellationSplit,omitempty"`
+	DispatchWave            int                  `bson:"dispatchWave,omitempty" json:"dispatchWave,omitempty"`
+	DispatchWaveExpiresAt   *time.Time           `bson:"dispatchWaveExpiresAt,omitempty" json:"dispatchWaveExpiresAt,omitempty"`
+	DispatchedAt            *time.Time           `bson:"dispatchedAt,omitempty" json:"dispatchedAt,omitempty"` // when the vendor was told about the order
+	CreatedAt               *time.Time           `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	UpdatedAt               *time.Time           `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// OrderLineItem is a copy of an item as it was when the order was placed, so later edits
+// to the item don't change what the customer bought.
+type OrderLineItem struct {
+	ItemID    primitive.ObjectID `bson:"itemId" json:"itemId"`
+	Name      string             `bson:"name" json:"name"`
+	UnitPrice float64            `bson:"unitPrice" json:"unitPrice"`
+	Quantity  int                `bson:"quantity" json:"quantity"`
+	Image     *string            `bson:"image,omitempty" json:"image,omitempty"`
+	Category  *string            `bson:"category,omitempty" json:"category,omitempty"`
 }
 
 type Location struct {
@@ -253,19 +297,26 @@ type Category struct {
 }
 
 type Review struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	CustomerID  primitive.ObjectID `bson:"customerId" json:"customerId"`
-	Description *string            `bson:"description,omitempty" json:"description,omitempty"`
-	OrderID     primitive.ObjectID `bson:"orderId" json:"orderId"`
-	StoreID     primitive.ObjectID `bson:"storeId" json:"storeId"`
-	CreatedAt   *time.Time         `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
-	UpdatedAt   *time.Time         `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id,omitempty"`
+	CustomerID  primitive.ObjectID  `bson:"customerId" json:"customerId"`
+	Target      string              `bson:"target" json:"target"` // store, rider
+	Rating      int                 `bson:"rating" json:"rating"`
+	Description *string             `bson:"description,omitempty" json:"description,omitempty"`
+	OrderID     primitive.ObjectID  `bson:"orderId" json:"orderId"`
+	StoreID     primitive.ObjectID  `bson:"storeId" json:"storeId"`
+	RiderID     *primitive.ObjectID `bson:"riderId,omitempty" json:"riderId,omitempty"`
+	Reply       *string             `bson:"reply,omitempty" json:"reply,omitempty"` // the merchant's reply to a store review
+	RepliedAt   *time.Time          `bson:"repliedAt,omitempty" json:"repliedAt,omitempty"`
+	CreatedAt   *time.Time          `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	UpdatedAt   *time.Time          `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
 }
 
 type RiderRating struct {
 	ID        primitive.ObjectID `bson:"_id" json:"id"`
-	UserId    primitive.ObjectID `bson:"customerId" json:"customerId"`
+	UserId    primitive.ObjectID `bson:"userId" json:"userId"`
 	Value     float64            `bson:"value" json:"value"`
+	Count     int                `bson:"count" json:"count"`
+	Sum       float64            `bson:"sum" json:"-"`
 	UpdatedAt *time.Time         `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
 }
 
@@ -294,12 +345,14 @@ type Customer struct {
 }
 
 type WalletTransactions struct {
-	ID                   primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	PaymentTransactionId string             `bson:"paymentTransactionId" json:"paymentTransactionId"`
-	UserId               primitive.ObjectID `bson:"userId" json:"userId"`
-	Amount               float64            `bson:"amount" json:"amount"`
-	Type                 string             `bson:"type" json:"type"` // debit, credit
-	CreatedAt            time.Time          `bson:"createdAt" json:"createdAt"`
+	ID                   primitive.ObjectID  `bson:"_id,omitempty" json:"id,omitempty"`
+	PaymentTransactionId string              `bson:"paymentTransactionId" json:"paymentTransactionId"`
+	UserId               primitive.ObjectID  `bson:"userId" json:"userId"`
+	Amount               float64             `bson:"amount" json:"amount"`
+	Type                 string              `bson:"type" json:"type"`                           // debit, credit, tip
+	OrderID              *primitive.ObjectID `bson:"orderId,omitempty" json:"orderId,omitempty"` // order or errand
+	Reason               *string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	CreatedAt            time.Time           `bson:"createdAt" json:"createdAt"`
 }
 
 type TransactionRequest struct {
@@ -385,3 +438,41 @@ type AppVersion struct {
 	AppName             string             `bson:"appName" json:"appName"`
 	Kind                string             `bson:"kind" json:"kind"`
 }
+
+type IdempotencyKey struct {
+	ID             string             `bson:"_id" json:"id"` // userId:key
+	UserID         primitive.ObjectID `bson:"userId" json:"userId"`
+	Key            string             `bson:"key" json:"key"`
+	RequestHash    string             `bson:"requestHash" json:"requestHash"`
+	Status         string             `bson:"status" json:"status"` // inProgress, completed
+	ResponseStatus int                `bson:"responseStatus,omitempty" json:"responseStatus,omitempty"`
+	ResponseBody   string             `bson:"responseBody,omitempty" json:"responseBody,omitempty"`
+	CreatedAt      time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt      time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+type DispatchOffer struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	OrderID     primitive.ObjectID `bson:"orderId" json:"orderId"`
+	RiderID     primitive.ObjectID `bson:"riderId" json:"riderId"`
+	Wave        int                `bson:"wave" json:"wave"`
+	DistanceKm  float64            `bson:"distanceKm" json:"distanceKm"`
+	Status      string             `bson:"status" json:"status"` // pending, accepted, declined, expired, withdrawn
+	OfferedAt   time.Time          `bson:"offeredAt" json:"offeredAt"`
+	ExpiresAt   time.Time          `bson:"expiresAt" json:"expiresAt"`
+	RespondedAt *time.Time         `bson:"respondedAt,omitempty" json:"respondedAt,omitempty"`
+}
+
+type Refund struct {
+	ID               primitive.ObjectID  `bson:"_id" json:"id"`
+	OrderID          *primitive.ObjectID `bson:"orderId,omitempty" json:"orderId,omitempty"` // order or errand
+	UserID           primitive.ObjectID  `bson:"userId" json:"userId"`
+	Amount           float64             `bson:"amount" json:"amount"`
+	PaymentReference string              `bson:"paymentReference" json:"paymentReference"`
+	PaystackRefundID *string             `bson:"paystackRefundId,omitempty" json:"paystackRefundId,omitempty"`
+	Status           string              `bson:"status" json:"status"` // pending, processing, processed, failed
+	FailureReason    *string             `bson:"failureReason,omitempty" json:"failureReason,omitempty"`
+	Attempts         int                 `bson:"attempts" json:"attempts"`
+	CreatedAt        time.Time           `bson:"createdAt" json:"createdAt"`
+	UpdatedAt        time.Time           `bson:"updatedAt" json:"updatedAt"`
+}
@@ -0,0 +1,148 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type OrderStatus string
+
+const (
+	OrderStatusOngoing   OrderStatus = "ongoing"
+	OrderStatusCompleted OrderStatus = "completed"
+	OrderStatusCancelled OrderStatus = "cancelled"
+)
+
+type OrderProgressStatus string
+
+const (
+	OrderCreated          OrderProgressStatus = "orderCreated"
+	OrderReceivedByVendor OrderProgressStatus = "orderReceivedByVendor"
+	OrderAcceptedByRider  OrderProgressStatus = "orderAcceptedByRider"
+	RiderAtVendor         OrderProgressStatus = "riderAtVendor"
+	RiderOnHisWay         OrderProgressStatus = "riderOnHisWay"
+	RiderAtUserLocation   OrderProgressStatus = "riderAtUserLocation"
+)
+
+type ActorRole string
+
+const (
+	ActorCustomer ActorRole = "customer"
+	ActorVendor   ActorRole = "vendor"
+	ActorRider    ActorRole = "rider"
+	ActorAdmin    ActorRole = "admin"
+	ActorSystem   ActorRole = "system"
+)
+
+// orderProgressTransitions lists, for every progress status, the statuses it may move to
+// and the roles allowed to make that move.
+var orderProgressTransitions = map[OrderProgressStatus]map[OrderProgressStatus][]ActorRole{
+	OrderCreated: {
+		OrderReceivedByVendor: {ActorVendor, ActorSystem},
+	},
+	OrderReceivedByVendor: {
+		OrderAcceptedByRider: {ActorRider},
+	},
+	OrderAcceptedByRider: {
+		RiderAtVendor: {ActorRider},
+	},
+	RiderAtVendor: {
+		RiderOnHisWay: {ActorRider},
+	},
+	RiderOnHisWay: {
+		RiderAtUserLocation: {ActorRider},
+	},
+}
+
+func (s OrderProgressStatus) IsValid() bool {
+	switch s {
+	case OrderCreated, OrderReceivedByVendor, OrderAcceptedByRider, RiderAtVendor, RiderOnHisWay, RiderAtUserLocation:
+		return true
+	}
+	return false
+}
+
+// CanTransitionTo returns an error when role may not move an order from s to next.
+func (s OrderProgressStatus) CanTransitionTo(next OrderProgressStatus, role ActorRole) error {
+	allowed, ok := orderProgressTransitions[s][next]
+	if !ok {
+		return fmt.Errorf("order cannot move from %s to %s", s, next)
+	}
+
+	for _, r := range allowed {
+		if r == role {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("a %s cannot move an order from %s to %s", role, s, next)
+}
+
+// CanComplete returns an error when role may not mark an order in progress status s as completed.
+func (s OrderProgressStatus) CanComplete(role ActorRole) error {
+	if role != ActorRider {
+		return fmt.Errorf("only the rider can complete an order")
+	}
+
+	if s != RiderAtUserLocation {
+		return fmt.Errorf("order cannot be completed from %s", s)
+	}
+
+	return nil
+}
+
+type OrderTimelineEntry struct {
+	ID                     primitive.ObjectID   `bson:"_id" json:"id"`
+	OrderID                primitive.ObjectID   `bson:"orderId" json:"orderId"`
+	ActorID                *primitive.ObjectID  `bson:"actorId,omitempty" json:"actorId,omitempty"`
+	ActorRole              ActorRole            `bson:"actorRole" json:"actorRole"`
+	PreviousProgressStatus *OrderProgressStatus `bson:"previousProgressStatus,omitempty" json:"previousProgressStatus,omitempty"`
+	ProgressStatus         OrderProgressStatus  `bson:"progressStatus" json:"progressStatus"`
+	PreviousStatus         *OrderStatus         `bson:"previousStatus,omitempty" json:"previousStatus,omitempty"`
+	Status                 OrderStatus          `bson:"status" json:"status"`
+	Note                   *string              `bson:"note,omitempty" json:"note,omitempty"`
+	CreatedAt              time.Time            `bson:"createdAt" json:"createdAt"`
+}
+
+func (o *Order) CurrentStatus() OrderStatus {
+	if o.Status == nil {
+		return OrderStatusOngoing
+	}
+	return *o.Status
+}
+
+func (o *Order) CurrentProgressStatus() OrderProgressStatus {
+	if o.OrderProgressStatus == nil {
+		return OrderCreated
+	}
+	return *o.OrderProgressStatus
+}
+
+// CheckoutTip is the tip the customer added at checkout, which is part of the order's price but
+// belongs to the rider in full.
+func (o *Order) CheckoutTip() float64 {
+	if o.Tip == nil {
+		return 0
+	}
+	return *o.Tip
+}
+
+// SubstitutionWalletAmount is the net amount substitutions settled against the customer's wallet:
+// positive when they paid more for substitutes, negative when items were refunded to the wallet.
+// It is part of the order's price but was never charged to the card the order was paid with.
+func (o *Order) SubstitutionWalletAmount() float64 {
+	if o.SubstitutionWalletDelta == nil {
+		return 0
+	}
+	return *o.SubstitutionWalletDelta
+}
+
+// HideCodeFrom blanks the delivery code unless userId is the customer who placed the order, who
+// reads it out to the rider on delivery.
+func (o *Order) HideCodeFrom(userId string) {
+	if o.CustomerID.Hex() != userId {
+		o.Code = ""
+	}
+}
@@ -0,0 +1,40 @@
+package data
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GeoPoint is a GeoJSON point. Coordinates are [longitude, latitude], the order MongoDB's
+// 2dsphere indexes expect.
+type GeoPoint struct {
+	Type        string    `bson:"type" json:"type"`
+	Coordinates []float64 `bson:"coordinates" json:"coordinates"`
+}
+
+func NewGeoPoint(lat float64, lng float64) GeoPoint {
+	return GeoPoint{Type: "Point", Coordinates: []float64{lng, lat}}
+}
+
+func (p GeoPoint) Lat() float64 {
+	return p.Coordinates[1]
+}
+
+func (p GeoPoint) Lng() float64 {
+	return p.Coordinates[0]
+}
+
+// RiderLocation is a GPS fix reported by a rider's app. Fixes are kept for a limited time as the
+// rider's location history.
+type RiderLocation struct {
+	ID         primitive.ObjectID  `bson:"_id" json:"id"`
+	RiderID    primitive.ObjectID  `bson:"riderId" json:"riderId"`
+	OrderID    *primitive.ObjectID `bson:"orderId,omitempty" json:"orderId,omitempty"` // the order the rider was carrying, if any
+	Location   GeoPoint            `bson:"location" json:"location"`
+	Accuracy   *float64            `bson:"accuracy,omitempty" json:"accuracy,omitempty"` // metres
+	Speed      *float64            `bson:"speed,omitempty" json:"speed,omitempty"`       // metres per second
+	Heading    *float64            `bson:"heading,omitempty" json:"heading,omitempty"`   // degrees from north
+	RecordedAt time.Time           `bson:"recordedAt" json:"recordedAt"`                 // when the device took the fix
+	CreatedAt  time.Time           `bson:"createdAt" json:"createdAt"`
+}
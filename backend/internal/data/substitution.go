@@ -0,0 +1,52 @@
+package data
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type SubstitutionAction string
+
+const (
+	SubstitutionReplace SubstitutionAction = "replace"
+	SubstitutionRemove  SubstitutionAction = "remove"
+)
+
+type SubstitutionStatus string
+
+const (
+	SubstitutionPending  SubstitutionStatus = "pending"
+	SubstitutionApproved SubstitutionStatus = "approved"
+	SubstitutionRejected SubstitutionStatus = "rejected"
+)
+
+// SubstitutionChange is what the vendor wants to do about a line item they can't fulfil: swap it
+// for another item of the store or take it off the order.
+type SubstitutionChange struct {
+	Original   OrderLineItem      `bson:"original" json:"original"`
+	Action     SubstitutionAction `bson:"action" json:"action"`
+	Substitute *OrderLineItem     `bson:"substitute,omitempty" json:"substitute,omitempty"` // replace only
+}
+
+// Substitution is a vendor's proposal to change the items of an open order. The customer approves
+// or rejects it; if they don't answer in time, SUBSTITUTION_TIMEOUT_ACTION decides. Rejecting keeps
+// none of the substitutes, so every affected line item is taken off the order. Either way the price
+// difference is settled against the customer's wallet.
+type Substitution struct {
+	ID              primitive.ObjectID   `bson:"_id" json:"id"`
+	OrderID         primitive.ObjectID   `bson:"orderId" json:"orderId"`
+	StoreID         primitive.ObjectID   `bson:"storeId" json:"storeId"`
+	CustomerID      primitive.ObjectID   `bson:"customerId" json:"customerId"`
+	ProposedBy      primitive.ObjectID   `bson:"proposedBy" json:"proposedBy"`
+	Changes         []SubstitutionChange `bson:"changes" json:"changes"`
+	Note            *string              `bson:"note,omitempty" json:"note,omitempty"`
+	PriceDifference float64              `bson:"priceDifference" json:"priceDifference"` // if approved; negative is owed to the customer
+	Status          SubstitutionStatus   `bson:"status" json:"status"`
+	ExpiresAt       time.Time            `bson:"expiresAt" json:"expiresAt"`
+	RespondedBy     *ActorRole           `bson:"respondedBy,omitempty" json:"respondedBy,omitempty"` // customer, or system when it timed out
+	SettledAmount   *float64             `bson:"settledAmount,omitempty" json:"settledAmount,omitempty"`
+	RespondedAt     *time.Time           `bson:"respondedAt,omitempty" json:"respondedAt,omitempty"`
+	CreatedAt       time.Time            `bson:"createdAt" json:"createdAt"`
+	UpdatedAt       time.Time            `bson:"updatedAt" json:"updatedAt"`
+}
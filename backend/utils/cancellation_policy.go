@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+
+	"useboi-boi/backend/internal/data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetCancellationPolicy returns the stored cancellation policy for a progress status and role,
+// falling back to the built-in default.
+func GetCancellationPolicy(ctx context.Context, db *mongo.Database, progressStatus data.OrderProgressStatus, role data.ActorRole) (data.CancellationPolicy, error) {
+
+	var policy data.CancellationPolicy
+	err := db.Collection(CANCELLATION_POLICY).FindOne(ctx, bson.M{
+		"progressStatus": progressStatus,
+		"actorRole":      role,
+	}).Decode(&policy)
+	if err == mongo.ErrNoDocuments {
+		return data.DefaultCancellationPolicy(progressStatus, role), nil
+	}
+	if err != nil {
+		return data.CancellationPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+// GetCancellationPolicies returns the policy in force for every progress status and role.
+func GetCancellationPolicies(ctx context.Context, db *mongo.Database) ([]data.CancellationPolicy, error) {
+
+	cursor, err := db.Collection(CANCELLATION_POLICY).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var stored []data.CancellationPolicy
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+
+	policies := make([]data.CancellationPolicy, 0, len(data.DefaultCancellationPolicies))
+	for _, policy := range data.DefaultCancellationPolicies {
+		for _, storedPolicy := range stored {
+			if storedPolicy.ProgressStatus == policy.ProgressStatus && storedPolicy.ActorRole == policy.ActorRole {
+				policy = storedPolicy
+				break
+			}
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+// SplitCancellation splits the price of an order being cancelled according to policy. The rider's
+// share goes back to the customer when no rider has been assigned yet.
+func SplitCancellation(policy data.CancellationPolicy, order *data.Order) data.CancellationSplit {
+
+	// The tip was for a delivery that never happened, so it goes back to the customer whatever the policy.
+	price := order.Price - order.CheckoutTip()
+
+	split := data.CancellationSplit{
+		Refund: RoundToKobo(price * policy.RefundPercent / 100),
+		Store:  RoundToKobo(price * policy.StorePercent / 100),
+		Rider:  RoundToKobo(price * policy.RiderPercent / 100),
+	}
+
+	if order.RiderID == nil {
+		split.Refund += split.Rider
+		split.Rider = 0
+	}
+
+	split.Platform = RoundToKobo(price - split.Refund - split.Store - split.Rider)
+	if split.Platform < 0 {
+		split.Platform = 0
+	}
+
+	split.Refund = RoundToKobo(split.Refund + order.CheckoutTip())
+
+	return split
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureCartIndexes creates the partial unique index that keeps a user to one open cart per store,
+// so two add-to-cart requests racing each other can't both open a cart, and the unique index that
+// keeps an item to one row per cart. Carts from before isCompleted was always set are marked open
+// first, since the partial index only covers carts where it is false.
+func EnsureCartIndexes(ctx context.Context, db *mongo.Database) error {
+
+	if _, err := db.Collection(CART).UpdateMany(ctx, bson.M{"isCompleted": nil}, bson.M{
+		"$set": bson.M{"isCompleted": false},
+	}); err != nil {
+		return err
+	}
+
+	if _, err := db.Collection(CART).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "storeId", Value: 1}},
+		Options: options.Index().
+			SetName("userId_storeId_open").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"isCompleted": false}),
+	}); err != nil {
+		return err
+	}
+
+	_, err := db.Collection(CART_ITEM).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "cartId", Value: 1}, {Key: "itemId", Value: 1}},
+		Options: options.Index().
+			SetName("cartId_itemId").
+			SetUnique(true),
+	})
+	return err
+}
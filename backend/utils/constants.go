@@ -27,6 +27,18 @@ const (
 	RESET_PASSWORD_TOKEN    = "ResetPasswordToken"
 	APP_VERSION             = "AppVersion"
 	COUPON                  = "Coupon"
+	SERVICE_FEE             = "ServiceFee"
+	DELIVERY_FEE            = "DeliveryFee"
+	ORDER_TIMELINE          = "OrderTimeline"
+	IDEMPOTENCY_KEY         = "IdempotencyKey"
+	DISPATCH_OFFER          = "DispatchOffer"
+	REFUND                  = "Refund"
+	CANCELLATION_POLICY     = "CancellationPolicy"
+	REVIEW                  = "Review"
+	ERRAND                  = "Errand"
+	RIDER_LOCATION          = "RiderLocation"
+	DISPUTE                 = "Dispute"
+	SUBSTITUTION            = "Substitution"
 )
 
 const (
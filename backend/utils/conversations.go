@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+
+	"firebase.google.com/go/messaging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureConversationIndexes makes sure an order has a single conversation and that a thread's
+// messages can be paged through quickly.
+func EnsureConversationIndexes(ctx context.Context, db *mongo.Database) error {
+
+	if _, err := db.Collection(CONVERSATION).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "orderId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return err
+	}
+
+	_, err := db.Collection(MESSAGE).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "conversationId", Value: 1}, {Key: "createdAt", Value: -1}},
+	})
+	return err
+}
+
+// GetOrderConversation returns the conversation of an order, starting it on first use. The
+// conversation follows the order: it picks up the rider once one is assigned and is locked as
+// soon as the order is no longer ongoing.
+func GetOrderConversation(ctx context.Context, db *mongo.Database, order *data.Order) (*data.Conversation, error) {
+
+	now := time.Now()
+
+	setOnInsert := bson.M{
+		"_id":        primitive.NewObjectID(),
+		"customerId": order.CustomerID,
+		"storeId":    order.StoreID,
+		"createdAt":  now,
+		"updatedAt":  now,
+	}
+	update := bson.M{"$setOnInsert": setOnInsert}
+
+	set := bson.M{}
+	if order.RiderID != nil {
+		set["riderId"] = *order.RiderID
+	}
+
+	// A conversation is never unlocked, even if it is read while the order's status is behind.
+	if order.CurrentStatus() != data.OrderStatusOngoing {
+		set["isLocked"] = true
+		update["$min"] = bson.M{"lockedAt": now}
+	} else {
+		setOnInsert["isLocked"] = false
+	}
+
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+
+	var conversation data.Conversation
+	err := db.Collection(CONVERSATION).FindOneAndUpdate(ctx, bson.M{"orderId": order.ID}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&conversation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conversation, nil
+}
+
+// LockOrderConversation stops any more messages being sent on an order's conversation.
+func LockOrderConversation(ctx context.Context, db *mongo.Database, orderId primitive.ObjectID) error {
+	_, err := db.Collection(CONVERSATION).UpdateOne(ctx, bson.M{"orderId": orderId, "isLocked": false}, bson.M{
+		"$set": bson.M{"isLocked": true, "lockedAt": time.Now()},
+	})
+	return err
+}
+
+// SendNewMessageNotification pushes a new message to everyone on the conversation except its sender.
+func SendNewMessageNotification(ctx context.Context, db *mongo.Database, fcm *messaging.Client, conversation *data.Conversation, message *data.Message) {
+
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	recipients := []primitive.ObjectID{conversation.CustomerID}
+	if conversation.RiderID != nil {
+		recipients = append(recipients, *conversation.RiderID)
+	}
+
+	merchantIds, err := db.Collection(USER).Distinct(ctx, "_id", bson.M{"type": "merchant", "storeId": conversation.StoreID})
+	if err != nil {
+		slog.Info("error", "error getting store merchants for notification", err.Error())
+	}
+	for _, merchantId := range merchantIds {
+		if id, ok := merchantId.(primitive.ObjectID); ok {
+			recipients = append(recipients, id)
+		}
+	}
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{
+		"userId": bson.M{"$in": recipients, "$ne": message.SenderID},
+	})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var deviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &deviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+		return
+	}
+
+	var title string
+	switch message.SenderRole {
+	case data.ActorCustomer:
+		title = "New Message from the Customer"
+	case data.ActorRider:
+		title = "New Message from the Rider"
+	default:
+		title = "New Message from the Store"
+	}
+
+	body := "Sent a photo"
+	if message.Text != nil && *message.Text != "" {
+		body = *message.Text
+	}
+
+	for _, token := range deviceTokens {
+		notification := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: title,
+				Body:  body,
+			},
+			Data: map[string]string{
+				"orderId":        message.OrderID.Hex(),
+				"conversationId": message.ConversationID.Hex(),
+				"messageId":      message.ID.Hex(),
+			},
+		}
+
+		SendNotification(fcm, notification, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"useboi-boi/backend/internal/data"
+
+	"firebase.google.com/go/messaging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SendDisputeResolvedNotificationToCustomer tells the customer how their complaint about an order was settled.
+func SendDisputeResolvedNotificationToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, dispute *data.Dispute) {
+
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": dispute.CustomerID})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var customerDeviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &customerDeviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+		return
+	}
+
+	title := "Your Complaint Has Been Reviewed"
+	body := "We looked into your complaint but couldn't approve a refund. Check the app for details"
+	if dispute.RefundAmount != nil && *dispute.RefundAmount > 0 {
+		title = "Your Complaint Has Been Resolved"
+		body = fmt.Sprintf("₦%s has been refunded to your wallet", formatAmount(*dispute.RefundAmount))
+	}
+
+	for _, token := range customerDeviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: title,
+				Body:  body,
+			},
+			Data: map[string]string{
+				"orderId":   dispute.OrderID.Hex(),
+				"disputeId": dispute.ID.Hex(),
+			},
+		}
+
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+
+}
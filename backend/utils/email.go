@@ -2,6 +2,7 @@ package utils
 
 import (
 	_ "embed"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -260,3 +261,28 @@ func SendForgotPasswordMail(email *string, firstName *string, link *string) erro
 	return nil
 
 }
+
+func SendOrderReceiptMail(receipt *OrderReceipt) error {
+
+	m := gomail.NewMessage()
+
+	pdf := RenderOrderReceiptPDF(receipt)
+
+	m.SetHeader("From", "Boiboi Team<hey@tackstry.com>")
+	m.SetHeader("To", receipt.CustomerEmail)
+	m.SetHeader("Subject", "Your Boiboi Order Receipt")
+	m.SetBody("text/html", RenderOrderReceiptHTML(receipt))
+	m.Attach("receipt-"+receipt.OrderID+".pdf", gomail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(pdf)
+		return err
+	}))
+
+	d := gomail.NewDialer("mail.privateemail.com", 465, "hey@tackstry.com", os.Getenv("BOIBOI_MAIL_PASSWORD"))
+
+	if err := d.DialAndSend(m); err != nil {
+		return err
+	}
+
+	return nil
+
+}
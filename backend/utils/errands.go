@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"useboi-boi/backend/internal/data"
+
+	"firebase.google.com/go/messaging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SendErrandUpdateToCustomer tells the customer how far the rider has got with their errand.
+func SendErrandUpdateToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, errand *data.Errand) {
+
+	var title, body string
+	switch errand.CurrentProgressStatus() {
+	case data.ErrandReceivedByRider:
+		title = "Your Errand Has Been Accepted!"
+		body = "A rider has picked up your errand and will start on it shortly"
+	case data.ErrandRiderOnHisWay:
+		title = "Your Errand is on the Way!"
+		body = "The rider has finished your errand and is on the way to you"
+	case data.ErrandRiderAtUserLocation:
+		title = "Rider at Your Location!"
+		body = "The rider has arrived with your errand. Please confirm it with the code " + errand.Code
+	default:
+		return
+	}
+
+	sendErrandNotification(ctx, db, fcm, errand, title, body)
+}
+
+// SendErrandCompletedNotificationToCustomer tells the customer their errand is done and how much
+// of the budget was given back.
+func SendErrandCompletedNotificationToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, errand *data.Errand) {
+	body := "Your errand has been completed. Thanks for using Boiboi!"
+	if errand.Refunded != nil && *errand.Refunded > 0 {
+		body = "Your errand has been completed and the unspent part of your budget has been refunded"
+	}
+
+	sendErrandNotification(ctx, db, fcm, errand, "Errand Completed!", body)
+}
+
+// SendErrandCodeToCustomer sends the customer the errand's new delivery code.
+func SendErrandCodeToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, errand *data.Errand) {
+	sendErrandNotification(ctx, db, fcm, errand, "Your Errand Code Has Changed", "Your new errand code is "+errand.Code+". Only share it with the rider when you receive your errand")
+}
+
+// SendErrandCancelledNotificationToCustomer tells the customer their errand was cancelled and what
+// was refunded.
+func SendErrandCancelledNotificationToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, errand *data.Errand) {
+	body := "Your errand has been cancelled"
+	if errand.CancellationReason != nil {
+		body = *errand.CancellationReason
+	}
+	if errand.Refunded != nil && *errand.Refunded > 0 {
+		body += fmt.Sprintf(". ₦%s has been refunded", formatAmount(*errand.Refunded))
+	}
+
+	sendErrandNotification(ctx, db, fcm, errand, "Your Errand Has Been Cancelled", body)
+}
+
+// SendNewErrandNotificationToRiders tells riders near the pickup about an errand waiting for a rider.
+func SendNewErrandNotificationToRiders(ctx context.Context, db *mongo.Database, fcm *messaging.Client, riderIds []primitive.ObjectID, errand *data.Errand) {
+
+	if len(riderIds) == 0 {
+		return
+	}
+
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": bson.M{"$in": riderIds}})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var riderDeviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &riderDeviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+		return
+	}
+
+	for _, token := range riderDeviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: "New Errand Alert!",
+				Body:  "New errand near you at " + errand.PickupAddress + ". Click to view",
+			},
+			Data: map[string]string{
+				"errandId": errand.ID.Hex(),
+			},
+		}
+
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+}
+
+func sendErrandNotification(ctx context.Context, db *mongo.Database, fcm *messaging.Client, errand *data.Errand, title string, body string) {
+
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": errand.CustomerID})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var customerDeviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &customerDeviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+		return
+	}
+
+	for _, token := range customerDeviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: title,
+				Body:  body,
+			},
+		}
+
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+}
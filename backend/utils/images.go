@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// UploadImage uploads a base64 encoded image to imgbb and returns its public url.
+func UploadImage(image string) (string, error) {
+
+	formData := url.Values{}
+	formData.Set("key", os.Getenv("IMGBB_API_KEY"))
+	formData.Set("image", image)
+
+	req, err := http.NewRequest("POST", "https://api.imgbb.com/1/upload?key=", strings.NewReader(formData.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload request. %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to make upload request. %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response. %v", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("error uploading image. %d", resp.StatusCode)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("error unmarshalling response. %v", err)
+	}
+
+	responseData, ok := result["data"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("invalid response data")
+	}
+
+	imageUrl, ok := responseData["url"].(string)
+	if !ok {
+		return "", fmt.Errorf("invalid image url")
+	}
+
+	return imageUrl, nil
+}
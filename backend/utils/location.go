@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusKm = 6371.0
+
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// ParseMapLocation reads a "lat,lng" map location as stored on stores and orders.
+func ParseMapLocation(mapLocation string) (*Coordinates, error) {
+	parts := strings.Split(mapLocation, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid map location %q", mapLocation)
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude in map location %q", mapLocation)
+	}
+
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude in map location %q", mapLocation)
+	}
+
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil, fmt.Errorf("map location %q is out of range", mapLocation)
+	}
+
+	return &Coordinates{Lat: lat, Lng: lng}, nil
+}
+
+// DistanceInKm returns the great-circle distance between two points.
+func DistanceInKm(from Coordinates, to Coordinates) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRadians(to.Lat - from.Lat)
+	dLng := toRadians(to.Lng - from.Lng)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(from.Lat))*math.Cos(toRadians(to.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	OrderEventUpdated       = "order"
+	OrderEventRiderLocation = "riderLocation"
+	OrderEventMessage       = "message"
+	OrderEventMessagesRead  = "messagesRead"
+	OrderEventSubstitution  = "substitution"
+)
+
+// orderEventBuffer is how many events a slow subscriber may fall behind by before newer events
+// are dropped for it.
+const orderEventBuffer = 16
+
+// OrderEvent is something that happened to an order that its tracking streams should be told about.
+// Updated events carry the order as it is after the change; rider location events carry where the
+// order's rider is; message events carry a new chat message and read events who caught up on the chat;
+// substitution events carry the store's proposed changes to the items, when made or answered.
+type OrderEvent struct {
+	Type         string              `json:"type"`
+	OrderID      primitive.ObjectID  `json:"orderId"`
+	Order        *data.Order         `json:"order,omitempty"`
+	Location     *RiderLocationEvent `json:"location,omitempty"`
+	Message      *data.Message       `json:"message,omitempty"`
+	Read         *MessagesReadEvent  `json:"read,omitempty"`
+	Substitution *data.Substitution  `json:"substitution,omitempty"`
+	At           time.Time           `json:"at"`
+}
+
+type RiderLocationEvent struct {
+	RiderID   primitive.ObjectID `json:"riderId"`
+	Latitude  float64            `json:"latitude"`
+	Longitude float64            `json:"longitude"`
+	ETA       *OrderETA          `json:"eta,omitempty"`
+}
+
+// MessagesReadEvent says a participant has read every message sent to them before ReadAt.
+type MessagesReadEvent struct {
+	UserID primitive.ObjectID `json:"userId"`
+	ReadAt time.Time          `json:"readAt"`
+}
+
+// OrderEventBus fans order events out to everyone tracking the order in this process.
+type OrderEventBus struct {
+	mu          sync.RWMutex
+	subscribers map[primitive.ObjectID]map[chan OrderEvent]struct{}
+}
+
+// OrderEvents is the bus order changes are published on.
+var OrderEvents = NewOrderEventBus()
+
+func NewOrderEventBus() *OrderEventBus {
+	return &OrderEventBus{subscribers: map[primitive.ObjectID]map[chan OrderEvent]struct{}{}}
+}
+
+// Subscribe returns a channel of the events for an order and a function that must be called to
+// stop listening.
+func (b *OrderEventBus) Subscribe(orderId primitive.ObjectID) (<-chan OrderEvent, func()) {
+
+	events := make(chan OrderEvent, orderEventBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[orderId] == nil {
+		b.subscribers[orderId] = map[chan OrderEvent]struct{}{}
+	}
+	b.subscribers[orderId][events] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers[orderId], events)
+			if len(b.subscribers[orderId]) == 0 {
+				delete(b.subscribers, orderId)
+			}
+			b.mu.Unlock()
+		})
+	}
+
+	return events, unsubscribe
+}
+
+// Publish sends an event to the order's subscribers without ever blocking the publisher.
+func (b *OrderEventBus) Publish(event OrderEvent) {
+
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for events := range b.subscribers[event.OrderID] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// HasSubscribers reports whether anyone is tracking the order, so publishers can skip work
+// nobody will see.
+func (b *OrderEventBus) HasSubscribers(orderId primitive.ObjectID) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subscribers[orderId]) > 0
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrOrderNotAssigned = errors.New("order is not assigned to you")
+
+// ResolveOrderActor works out which part a user plays on an order. A rider only takes part in an
+// order assigned to them; anyone else gets ErrOrderNotAssigned.
+func ResolveOrderActor(ctx context.Context, db *mongo.Database, userIdStr string, order *data.Order) (data.ActorRole, *primitive.ObjectID, error) {
+
+	actorRole, actorId, err := ResolveOrderClaimant(ctx, db, userIdStr, order)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if actorRole == data.ActorRider && (order.RiderID == nil || *order.RiderID != *actorId) {
+		return "", nil, ErrOrderNotAssigned
+	}
+
+	return actorRole, actorId, nil
+}
+
+// ResolveOrderClaimant is ResolveOrderActor for a rider claiming an order, which any rider may do
+// before it is assigned.
+func ResolveOrderClaimant(ctx context.Context, db *mongo.Database, userIdStr string, order *data.Order) (data.ActorRole, *primitive.ObjectID, error) {
+
+	userId, err := primitive.ObjectIDFromHex(userIdStr)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid userId associated with request")
+	}
+
+	if order.CustomerID == userId {
+		return data.ActorCustomer, &userId, nil
+	}
+
+	var user data.User
+	if err := db.Collection(USER).FindOne(ctx, bson.M{"_id": userId}).Decode(&user); err != nil {
+		return "", nil, fmt.Errorf("user not found")
+	}
+
+	if user.Type == "rider" {
+		return data.ActorRider, &userId, nil
+	}
+
+	if user.Type == "merchant" && user.StoreId != nil && *user.StoreId == order.StoreID {
+		return data.ActorVendor, &userId, nil
+	}
+
+	return "", nil, fmt.Errorf("user is not a participant of this order")
+}
+
+// RecordOrderTransition appends an entry to the order's timeline.
+func RecordOrderTransition(ctx context.Context, db *mongo.Database, entry data.OrderTimelineEntry) error {
+
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+
+	_, err := db.Collection(ORDER_TIMELINE).InsertOne(ctx, entry)
+	return err
+}
+
+// GetOrderTimeline returns the recorded transitions of an order, oldest first.
+func GetOrderTimeline(ctx context.Context, db *mongo.Database, orderId primitive.ObjectID) ([]data.OrderTimelineEntry, error) {
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+
+	cursor, err := db.Collection(ORDER_TIMELINE).Find(ctx, bson.M{"orderId": orderId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	timeline := []data.OrderTimelineEntry{}
+	if err := cursor.All(ctx, &timeline); err != nil {
+		return nil, err
+	}
+
+	return timeline, nil
+}
+
+// VendorResponseTimeout is how long a vendor has to accept a new order before it is cancelled,
+// set with VENDOR_ACCEPT_TIMEOUT_MINUTES.
+func VendorResponseTimeout() time.Duration {
+	return time.Duration(GetEnvInt("VENDOR_ACCEPT_TIMEOUT_MINUTES", 10)) * time.Minute
+}
+
+// GenerateDeliveryCode returns a random four digit code the customer gives the rider on delivery.
+func GenerateDeliveryCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", n.Int64()), nil
+}
+
+// DeliveryCodeMaxAttempts is how many wrong delivery codes a rider may enter before the order is
+// locked until an admin regenerates the code, set with DELIVERY_CODE_MAX_ATTEMPTS.
+func DeliveryCodeMaxAttempts() int {
+	return GetEnvInt("DELIVERY_CODE_MAX_ATTEMPTS", 5)
+}
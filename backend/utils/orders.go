@@ -1,28 +1,30 @@
 package utils
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 
 	"useboi-boi/backend/internal/data"
 
 	"firebase.google.com/go/messaging"
-	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func SendSuccessfulOrderNotificationToCustomer(c *gin.Context, db *mongo.Database, fcm *messaging.Client, user *data.User) {
+func SendSuccessfulOrderNotificationToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, user *data.User) {
 
 	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
 
-	cursor, err := deviceTokenCollection.Find(c, bson.M{"userId": user.ID})
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": user.ID})
 	if err != nil {
 		slog.Info("error", "error sending notification", err.Error())
 	}
-	defer cursor.Close(c)
+	defer cursor.Close(ctx)
 
 	var customerDeviceTokens []data.DeviceToken
-	if err = cursor.All(c, &customerDeviceTokens); err != nil {
+	if err = cursor.All(ctx, &customerDeviceTokens); err != nil {
 		slog.Info("error", "error decoding documents:", err.Error())
 	}
 
@@ -36,85 +38,37 @@ func SendSuccessfulOrderNotificationToCustomer(c *gin.Context, db *mongo.Databas
 		}
 
 		SendNotification(fcm, message, func() {
-			deviceTokenCollection.DeleteOne(c, bson.M{"_id": token.ID})
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
 		})
 	}
 
 }
 
-func SendNewOrderNotificationToRiders(c *gin.Context, db *mongo.Database, fcm *messaging.Client) {
-
-	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
-	userCollection := db.Collection(USER)
-
-	userCursor, err := userCollection.Find(c, bson.M{"type": "rider"})
-	if err != nil {
-		slog.Info("message", "Failed to get riders", err.Error())
-		return
-	}
-	defer userCursor.Close(c)
-
-	var riders []data.User
-	if err = userCursor.All(c, &riders); err != nil {
-		slog.Info("error", "error decoding documents:", err.Error())
-		return
-	}
-
-	for _, rider := range riders {
-		cursor, tErr := deviceTokenCollection.Find(c, bson.M{"userId": rider.ID})
-		if tErr != nil {
-			slog.Info("error", "error sending notification to user --> "+rider.ID.Hex(), tErr.Error())
-		}
-		defer cursor.Close(c)
-
-		var riderDeviceTokens []data.DeviceToken
-		if err = cursor.All(c, &riderDeviceTokens); err != nil {
-			slog.Info("error", "error decoding documents:", err.Error())
-			continue
-		}
-
-		for _, token := range riderDeviceTokens {
-			message := &messaging.Message{
-				Token: token.Token,
-				Notification: &messaging.Notification{
-					Title: "New Order Alert!",
-					Body:  "New Order placed by a Customer. Click to view",
-				},
-			}
-			SendNotification(fcm, message, func() {
-				deviceTokenCollection.DeleteOne(c, bson.M{"_id": token.ID})
-			})
-		}
-
-	}
-
-}
-
-func SendNewOrderNotificationToMerchant(c *gin.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order) {
+func SendNewOrderNotificationToMerchant(ctx context.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order) {
 
 	userCollection := db.Collection(USER)
 	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
 
 	var storeAdmin data.User
-	if err := userCollection.FindOne(c, bson.M{"isAdmin": true, "storeId": order.StoreID}).Decode(&storeAdmin); err != nil {
+	if err := userCollection.FindOne(ctx, bson.M{"isAdmin": true, "storeId": order.StoreID}).Decode(&storeAdmin); err != nil {
 		slog.Info("error", "error getting store admin for notification", err.Error())
 		return
 	}
 
 	var customer data.User
-	if err := userCollection.FindOne(c, bson.M{"_id": order.CustomerID}).Decode(&customer); err != nil {
+	if err := userCollection.FindOne(ctx, bson.M{"_id": order.CustomerID}).Decode(&customer); err != nil {
 		slog.Info("error", "error getting customer data for notification", err.Error())
 		return
 	}
 
-	cursor, err := deviceTokenCollection.Find(c, bson.M{"userId": storeAdmin.ID})
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": storeAdmin.ID})
 	if err != nil {
 		slog.Info("error", "error sending notification", err.Error())
 	}
-	defer cursor.Close(c)
+	defer cursor.Close(ctx)
 
 	var customerDeviceTokens []data.DeviceToken
-	if err = cursor.All(c, &customerDeviceTokens); err != nil {
+	if err = cursor.All(ctx, &customerDeviceTokens); err != nil {
 		slog.Info("error", "error decoding documents:", err.Error())
 	}
 
@@ -128,29 +82,51 @@ func SendNewOrderNotificationToMerchant(c *gin.Context, db *mongo.Database, fcm
 		}
 
 		SendNotification(fcm, message, func() {
-			deviceTokenCollection.DeleteOne(c, bson.M{"_id": token.ID})
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
 		})
 	}
 
 }
 
-func SendOrderUpdateToCustomer(c *gin.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order) {
+func SendOrderUpdateToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order) {
 	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
 
-	cursor, err := deviceTokenCollection.Find(c, bson.M{"userId": order.CustomerID})
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": order.CustomerID})
 	if err != nil {
 		slog.Info("error", "error sending notification", err.Error())
 	}
-	defer cursor.Close(c)
+	defer cursor.Close(ctx)
 
 	var customerDeviceTokens []data.DeviceToken
-	if err = cursor.All(c, &customerDeviceTokens); err != nil {
+	if err = cursor.All(ctx, &customerDeviceTokens); err != nil {
 		slog.Info("error", "error decoding documents:", err.Error())
 	}
 
+	if *order.OrderProgressStatus == data.OrderReceivedByVendor {
+		body := "The vendor is preparing your order. We'll let you know once a rider picks it up"
+		if order.EstimatedPrepMinutes != nil {
+			body = fmt.Sprintf("The vendor is preparing your order and expects it to be ready in about %d minutes", *order.EstimatedPrepMinutes)
+		}
+
+		for _, token := range customerDeviceTokens {
+			message := &messaging.Message{
+				Token: token.Token,
+				Notification: &messaging.Notification{
+					Title: "Your Order Has Been Accepted By The Vendor!",
+					Body:  body,
+				},
+			}
+
+			SendNotification(fcm, message, func() {
+				deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+			})
+		}
+		return
+	}
+
 	userCollection := db.Collection(USER)
 	var rider data.User
-	if err := userCollection.FindOne(c, bson.M{"_id": order.RiderID}).Decode(&rider); err != nil {
+	if err := userCollection.FindOne(ctx, bson.M{"_id": order.RiderID}).Decode(&rider); err != nil {
 		slog.Info("error", "error fetching rider", err.Error())
 		return
 	}
@@ -167,7 +143,7 @@ func SendOrderUpdateToCustomer(c *gin.Context, db *mongo.Database, fcm *messagin
 			}
 
 			SendNotification(fcm, message, func() {
-				deviceTokenCollection.DeleteOne(c, bson.M{"_id": token.ID})
+				deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
 			})
 		} else if *order.OrderProgressStatus == "riderAtVendor" {
 			message := &messaging.Message{
@@ -179,7 +155,7 @@ func SendOrderUpdateToCustomer(c *gin.Context, db *mongo.Database, fcm *messagin
 			}
 
 			SendNotification(fcm, message, func() {
-				deviceTokenCollection.DeleteOne(c, bson.M{"_id": token.ID})
+				deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
 			})
 		} else if *order.OrderProgressStatus == "riderOnHisWay" {
 			message := &messaging.Message{
@@ -191,7 +167,7 @@ func SendOrderUpdateToCustomer(c *gin.Context, db *mongo.Database, fcm *messagin
 			}
 
 			SendNotification(fcm, message, func() {
-				deviceTokenCollection.DeleteOne(c, bson.M{"_id": token.ID})
+				deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
 			})
 		} else if *order.OrderProgressStatus == "riderAtUserLocation" {
 			message := &messaging.Message{
@@ -203,9 +179,146 @@ func SendOrderUpdateToCustomer(c *gin.Context, db *mongo.Database, fcm *messagin
 			}
 
 			SendNotification(fcm, message, func() {
-				deviceTokenCollection.DeleteOne(c, bson.M{"_id": token.ID})
+				deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
 			})
 		}
 	}
 
 }
+
+func SendOrderCancelledNotificationToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order) {
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": order.CustomerID})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var customerDeviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &customerDeviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+	}
+
+	body := "Your order has been cancelled and the amount refunded to your wallet"
+	if order.CancellationReason != nil {
+		body = *order.CancellationReason + ". The amount has been refunded to your wallet"
+	}
+
+	for _, token := range customerDeviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: "Your Order Has Been Cancelled",
+				Body:  body,
+			},
+		}
+
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+
+}
+
+func SendDispatchOfferNotificationToRider(ctx context.Context, db *mongo.Database, fcm *messaging.Client, riderId primitive.ObjectID, offer *data.DispatchOffer) {
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": riderId})
+	if err != nil {
+		slog.Info("error", "error sending notification to user --> "+riderId.Hex(), err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var riderDeviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &riderDeviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+		return
+	}
+
+	for _, token := range riderDeviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: "New Order Alert!",
+				Body:  fmt.Sprintf("New order %.1fkm away. Accept within %d seconds", offer.DistanceKm, int(offer.ExpiresAt.Sub(offer.OfferedAt).Seconds())),
+			},
+			Data: map[string]string{
+				"orderId": offer.OrderID.Hex(),
+				"offerId": offer.ID.Hex(),
+			},
+		}
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+
+}
+
+func SendDeliveryCodeToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order) {
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": order.CustomerID})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var customerDeviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &customerDeviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+	}
+
+	for _, token := range customerDeviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: "Your Delivery Code Has Changed",
+				Body:  "Your new delivery code is " + order.Code + ". Only share it with the rider when you receive your order",
+			},
+		}
+
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+
+}
+
+func SendTipNotificationToRider(ctx context.Context, db *mongo.Database, fcm *messaging.Client, order *data.Order, amount float64) {
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": order.RiderID})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var riderDeviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &riderDeviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+		return
+	}
+
+	for _, token := range riderDeviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: "You Got a Tip!",
+				Body:  "A customer tipped you ₦" + formatAmount(amount) + " for your delivery",
+			},
+			Data: map[string]string{
+				"orderId": order.ID.Hex(),
+			},
+		}
+
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+
+}
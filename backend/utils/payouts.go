@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrInsufficientWalletBalance = errors.New("insufficient amount in wallet. Wallet balance cannot be less than 100")
+
+// OrderPayoutSplit works out how the price of a completed order is shared between the store, the
+// rider and Boiboi. The rider gets the delivery fee and Boiboi the service charge, plus a commission
+// on the store's sales that grows with the size of the order. A store coupon comes out of the
+// store's sales; any other coupon is paid for by Boiboi. The checkout tip is left out: it is paid to
+// the rider in full with TipRider.
+func OrderPayoutSplit(order *data.Order) (store float64, rider float64, platform float64) {
+
+	deliveryFee := 0.0
+	if order.DeliveryFee != nil {
+		deliveryFee = *order.DeliveryFee
+	}
+
+	serviceCharge := 0.0
+	if order.ServiceCharge != nil {
+		serviceCharge = *order.ServiceCharge
+	}
+
+	coupon := 0.0
+	if order.CouponPrice != nil {
+		coupon = *order.CouponPrice
+	}
+
+	// What the items sold for before any discount.
+	subTotalPrice := order.Price - deliveryFee - serviceCharge - order.CheckoutTip() + coupon
+
+	storeSales := subTotalPrice
+	platformCoupon := coupon
+	if order.CouponType != nil && *order.CouponType == "store" {
+		storeSales -= coupon
+		platformCoupon = 0
+	}
+
+	commission := 0.0
+	if storeSales <= 5000 {
+		commission = 0.03 * storeSales
+	} else if storeSales <= 9999 {
+		commission = 0.05 * storeSales
+	} else {
+		commission = 0.07 * storeSales
+	}
+
+	store = RoundToKobo(storeSales - commission)
+	rider = RoundToKobo(deliveryFee)
+	platform = RoundToKobo(commission + serviceCharge - platformCoupon)
+
+	return store, rider, platform
+}
+
+// CreditStore pays amount into the wallet of the store's vendor admin.
+func CreditStore(ctx context.Context, db *mongo.Database, storeId primitive.ObjectID, orderId primitive.ObjectID, amount float64, reason string) error {
+
+	userCollection := db.Collection(USER)
+
+	var vendorAdmin data.User
+	if err := userCollection.FindOne(ctx, bson.M{"storeId": storeId}).Decode(&vendorAdmin); err != nil {
+		return fmt.Errorf("no vendor admin connected to store. " + err.Error())
+	}
+
+	if _, err := userCollection.UpdateOne(ctx, bson.M{"_id": vendorAdmin.ID}, bson.M{
+		"$inc": bson.M{
+			"virtualBankAccount.balance": amount,
+		},
+	}); err != nil {
+		return err
+	}
+
+	return insertOrderTransaction(ctx, db, vendorAdmin.ID, orderId, amount, "credit", reason)
+}
+
+// DebitStore takes amount back out of the wallet of the store's vendor admin.
+func DebitStore(ctx context.Context, db *mongo.Database, storeId primitive.ObjectID, orderId primitive.ObjectID, amount float64, reason string) error {
+
+	userCollection := db.Collection(USER)
+
+	var vendorAdmin data.User
+	if err := userCollection.FindOne(ctx, bson.M{"storeId": storeId}).Decode(&vendorAdmin); err != nil {
+		return fmt.Errorf("no vendor admin connected to store. " + err.Error())
+	}
+
+	if _, err := userCollection.UpdateOne(ctx, bson.M{"_id": vendorAdmin.ID}, bson.M{
+		"$inc": bson.M{
+			"virtualBankAccount.balance": -amount,
+		},
+	}); err != nil {
+		return err
+	}
+
+	return insertOrderTransaction(ctx, db, vendorAdmin.ID, orderId, amount, "debit", reason)
+}
+
+// CreditRider pays amount to a rider. Riders signed up through BBP2P are paid into their p2p
+// balance; everyone else is paid through their delivery service's admin.
+func CreditRider(ctx context.Context, db *mongo.Database, riderId primitive.ObjectID, orderId primitive.ObjectID, amount float64, reason string) error {
+	return payRider(ctx, db, riderId, orderId, amount, "credit", reason)
+}
+
+// TipRider pays a customer's tip to a rider the same way as CreditRider, without any service fee,
+// recorded as a tip so it stands apart from delivery earnings in wallet history.
+func TipRider(ctx context.Context, db *mongo.Database, riderId primitive.ObjectID, orderId primitive.ObjectID, amount float64) error {
+	return payRider(ctx, db, riderId, orderId, amount, "tip", "rider tip")
+}
+
+func payRider(ctx context.Context, db *mongo.Database, riderId primitive.ObjectID, orderId primitive.ObjectID, amount float64, transactionType string, reason string) error {
+
+	userCollection := db.Collection(USER)
+
+	var rider data.User
+	if err := userCollection.FindOne(ctx, bson.M{"_id": riderId}).Decode(&rider); err != nil {
+		return err
+	}
+
+	var deliveryService data.DeliveryService
+	if err := db.Collection(DELIVERY_SERVICE).FindOne(ctx, bson.M{"_id": rider.DeliveryService}).Decode(&deliveryService); err != nil {
+		return fmt.Errorf("no delivery service found. " + err.Error())
+	}
+
+	if deliveryService.SignupCode == "BBP2P" {
+		if _, err := userCollection.UpdateOne(ctx, bson.M{"_id": rider.ID}, bson.M{"$inc": bson.M{
+			"p2pBalance": amount,
+		}}); err != nil {
+			return fmt.Errorf("failed to update rider balance. " + err.Error())
+		}
+
+		return insertOrderTransaction(ctx, db, rider.ID, orderId, amount, transactionType, reason)
+	}
+
+	var deliveryAdmin data.User
+	if err := userCollection.FindOne(ctx, bson.M{"deliveryService": rider.DeliveryService, "isAdmin": true}).Decode(&deliveryAdmin); err != nil {
+		return fmt.Errorf("no delivery service admin connected to delivery service")
+	}
+
+	if _, err := userCollection.UpdateOne(ctx, bson.M{"_id": deliveryAdmin.ID}, bson.M{
+		"$inc": bson.M{
+			"virtualBankAccount.balance": amount,
+		},
+	}); err != nil {
+		return err
+	}
+
+	return insertOrderTransaction(ctx, db, deliveryAdmin.ID, orderId, amount, transactionType, reason)
+}
+
+// CreditCustomerWallet pays amount back into a customer's wallet.
+func CreditCustomerWallet(ctx context.Context, db *mongo.Database, customerId primitive.ObjectID, orderId primitive.ObjectID, amount float64, reason string) error {
+
+	if _, err := db.Collection(USER).UpdateOne(ctx, bson.M{"_id": customerId}, bson.M{
+		"$inc": bson.M{
+			"virtualBankAccount.balance": amount,
+		},
+	}); err != nil {
+		return err
+	}
+
+	return insertOrderTransaction(ctx, db, customerId, orderId, amount, "credit", reason)
+}
+
+// DebitCustomerWallet takes amount out of a customer's wallet. It fails with
+// ErrInsufficientWalletBalance rather than leave less than the minimum balance of 100.
+func DebitCustomerWallet(ctx context.Context, db *mongo.Database, customerId primitive.ObjectID, orderId primitive.ObjectID, amount float64, reason string) error {
+
+	result, err := db.Collection(USER).UpdateOne(ctx, bson.M{
+		"_id":                        customerId,
+		"virtualBankAccount.balance": bson.M{"$gte": amount + 100},
+	}, bson.M{
+		"$inc": bson.M{
+			"virtualBankAccount.balance": -amount,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrInsufficientWalletBalance
+	}
+
+	return insertOrderTransaction(ctx, db, customerId, orderId, amount, "debit", reason)
+}
+
+func CreditPlatform(ctx context.Context, db *mongo.Database, amount float64) error {
+	return db.Collection(BOIBOI_ACCOUNT).FindOneAndUpdate(ctx, bson.M{}, bson.M{
+		"$inc": bson.M{
+			"balance": amount,
+		},
+	}).Err()
+}
+
+func insertOrderTransaction(ctx context.Context, db *mongo.Database, userId primitive.ObjectID, orderId primitive.ObjectID, amount float64, transactionType string, reason string) error {
+
+	transaction := data.WalletTransactions{
+		ID:                   primitive.NewObjectID(),
+		PaymentTransactionId: GeneratePaymentReference(),
+		UserId:               userId,
+		Amount:               amount,
+		Type:                 transactionType,
+		OrderID:              &orderId,
+		Reason:               &reason,
+		CreatedAt:            time.Now(),
+	}
+
+	_, err := db.Collection(WALLET_TRANSACTIONS).InsertOne(ctx, transaction)
+	return err
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ratings are shown as a Bayesian average, (priorMean*priorVotes + sum) / (priorVotes + count):
+// every store and rider starts with ratingPriorVotes imaginary votes of ratingPriorMean, so one or
+// two early reviews can't put them at the top or bottom of the rankings.
+const (
+	ratingPriorMean  = 4.0
+	ratingPriorVotes = 5
+)
+
+// ApplyStoreRating adds sumDelta and countDelta to a store's running rating totals and recomputes
+// its displayed rating in the same update. Use a countDelta of 0 when a rating is edited.
+func ApplyStoreRating(ctx context.Context, db *mongo.Database, storeId primitive.ObjectID, sumDelta float64, countDelta int) error {
+	_, err := db.Collection(STORE).UpdateOne(ctx, bson.M{"_id": storeId}, ratingUpdatePipeline("ratingSum", "ratingCount", "ratings", sumDelta, countDelta))
+	return err
+}
+
+// ApplyRiderRating does the same as ApplyStoreRating for a rider's RiderRating record, creating it
+// on the rider's first rating.
+func ApplyRiderRating(ctx context.Context, db *mongo.Database, riderId primitive.ObjectID, sumDelta float64, countDelta int) error {
+	pipeline := append(ratingUpdatePipeline("sum", "count", "value", sumDelta, countDelta), bson.D{
+		{Key: "$set", Value: bson.M{"updatedAt": time.Now()}},
+	})
+	_, err := db.Collection(RIDER_RATING).UpdateOne(ctx, bson.M{"userId": riderId}, pipeline, options.Update().SetUpsert(true))
+	return err
+}
+
+// GetRiderRatings returns the rating records of the given riders keyed by rider id. Riders who
+// haven't been rated yet are left out.
+func GetRiderRatings(ctx context.Context, db *mongo.Database, riderIds []primitive.ObjectID) (map[primitive.ObjectID]data.RiderRating, error) {
+
+	cursor, err := db.Collection(RIDER_RATING).Find(ctx, bson.M{"userId": bson.M{"$in": riderIds}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var riderRatings []data.RiderRating
+	if err := cursor.All(ctx, &riderRatings); err != nil {
+		return nil, err
+	}
+
+	ratings := make(map[primitive.ObjectID]data.RiderRating, len(riderRatings))
+	for _, riderRating := range riderRatings {
+		ratings[riderRating.UserId] = riderRating
+	}
+
+	return ratings, nil
+}
+
+// ratingUpdatePipeline builds an update that works out the new totals and rating on the server,
+// so concurrent reviews never overwrite each other.
+func ratingUpdatePipeline(sumField, countField, valueField string, sumDelta float64, countDelta int) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			sumField:   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$" + sumField, 0}}, sumDelta}},
+			countField: bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$" + countField, 0}}, countDelta}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			valueField: bson.M{"$divide": bson.A{
+				bson.M{"$add": bson.A{ratingPriorMean * ratingPriorVotes, "$" + sumField}},
+				bson.M{"$add": bson.A{ratingPriorVotes, "$" + countField}},
+			}},
+		}}},
+	}
+}
@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//go:embed templates/order_receipt.html
+var orderReceiptTemplate string
+
+type ReceiptLine struct {
+	Name      string  `json:"name"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unitPrice"`
+	Total     float64 `json:"total"`
+}
+
+// OrderReceipt is everything printed on an order's receipt.
+type OrderReceipt struct {
+	OrderID          string        `json:"orderId"`
+	CustomerName     string        `json:"customerName"`
+	CustomerEmail    string        `json:"-"`
+	StoreName        string        `json:"storeName"`
+	DeliveryLocation string        `json:"deliveryLocation"`
+	Date             time.Time     `json:"date"`
+	Lines            []ReceiptLine `json:"lines"`
+	Subtotal         float64       `json:"subtotal"`
+	DeliveryFee      float64       `json:"deliveryFee"`
+	ServiceCharge    float64       `json:"serviceCharge"`
+	Coupon           float64       `json:"coupon"`
+	Tip              float64       `json:"tip"`
+	Total            float64       `json:"total"`
+	PaymentMethod    string        `json:"paymentMethod"`
+	PaymentReference string        `json:"paymentReference"`
+}
+
+// BuildOrderReceipt gathers the receipt of an order from the order, its customer and its store.
+// Orders placed before line items were recorded get a receipt without lines.
+func BuildOrderReceipt(ctx context.Context, db *mongo.Database, order *data.Order) (*OrderReceipt, error) {
+
+	var customer data.User
+	if err := db.Collection(USER).FindOne(ctx, bson.M{"_id": order.CustomerID}).Decode(&customer); err != nil {
+		return nil, fmt.Errorf("customer not found. " + err.Error())
+	}
+
+	var store data.Store
+	if err := db.Collection(STORE).FindOne(ctx, bson.M{"_id": order.StoreID}).Decode(&store); err != nil {
+		return nil, fmt.Errorf("store not found. " + err.Error())
+	}
+
+	receipt := OrderReceipt{
+		OrderID:       order.ID.Hex(),
+		CustomerName:  strings.TrimSpace(customer.FirstName + " " + customer.LastName),
+		CustomerEmail: customer.Email,
+		StoreName:     store.Name,
+		Lines:         []ReceiptLine{},
+		Total:         order.Price,
+		PaymentMethod: order.PaymentMethod,
+	}
+
+	if order.DeliveryLocation != nil {
+		receipt.DeliveryLocation = *order.DeliveryLocation
+	}
+	if order.CreatedAt != nil {
+		receipt.Date = *order.CreatedAt
+	}
+	if order.DeliveryFee != nil {
+		receipt.DeliveryFee = *order.DeliveryFee
+	}
+	if order.ServiceCharge != nil {
+		receipt.ServiceCharge = *order.ServiceCharge
+	}
+	if order.CouponPrice != nil {
+		receipt.Coupon = *order.CouponPrice
+	}
+	if order.Tip != nil {
+		receipt.Tip = *order.Tip
+	}
+	if order.PaymentReference != nil {
+		receipt.PaymentReference = *order.PaymentReference
+	}
+	if receipt.PaymentMethod == "" {
+		receipt.PaymentMethod = "wallet"
+	}
+
+	for _, lineItem := range order.LineItems {
+		line := ReceiptLine{
+			Name:      lineItem.Name,
+			Quantity:  lineItem.Quantity,
+			UnitPrice: lineItem.UnitPrice,
+			Total:     RoundToKobo(lineItem.UnitPrice * float64(lineItem.Quantity)),
+		}
+		receipt.Lines = append(receipt.Lines, line)
+		receipt.Subtotal += line.Total
+	}
+
+	if len(receipt.Lines) == 0 {
+		receipt.Subtotal = order.Price - receipt.DeliveryFee - receipt.ServiceCharge + receipt.Coupon - receipt.Tip
+	}
+	receipt.Subtotal = RoundToKobo(receipt.Subtotal)
+
+	return &receipt, nil
+}
+
+// RenderOrderReceiptHTML fills the receipt template, which is used both for the email and for
+// the downloadable receipt.
+func RenderOrderReceiptHTML(receipt *OrderReceipt) string {
+
+	var lines strings.Builder
+	for _, line := range receipt.Lines {
+		fmt.Fprintf(&lines, `<tr><td>%s</td><td class="amount">%d</td><td class="amount">₦%s</td><td class="amount">₦%s</td></tr>`,
+			html.EscapeString(line.Name), line.Quantity, formatAmount(line.UnitPrice), formatAmount(line.Total))
+		lines.WriteString("\n")
+	}
+
+	replacements := map[string]string{
+		"{{customer_name}}":     html.EscapeString(receipt.CustomerName),
+		"{{store_name}}":        html.EscapeString(receipt.StoreName),
+		"{{order_id}}":          receipt.OrderID,
+		"{{date}}":              receipt.Date.Format("02 Jan 2006, 15:04"),
+		"{{delivery_location}}": html.EscapeString(receipt.DeliveryLocation),
+		"{{line_items}}":        lines.String(),
+		"{{subtotal}}":          formatAmount(receipt.Subtotal),
+		"{{delivery_fee}}":      formatAmount(receipt.DeliveryFee),
+		"{{service_charge}}":    formatAmount(receipt.ServiceCharge),
+		"{{coupon}}":            formatAmount(receipt.Coupon),
+		"{{tip}}":               formatAmount(receipt.Tip),
+		"{{total}}":             formatAmount(receipt.Total),
+		"{{payment_method}}":    html.EscapeString(receipt.PaymentMethod),
+		"{{reference}}":         html.EscapeString(receipt.PaymentReference),
+		"{{year}}":              strconv.Itoa(time.Now().Year()),
+	}
+
+	result := orderReceiptTemplate
+	for placeholder, value := range replacements {
+		result = strings.ReplaceAll(result, placeholder, value)
+	}
+
+	return result
+}
+
+// Layout of the PDF receipt: A4 pages of Courier text, so the columns line up without any font metrics.
+const (
+	pdfPageWidth    = 595
+	pdfPageHeight   = 842
+	pdfMargin       = 50
+	pdfFontSize     = 10
+	pdfLineHeight   = 14
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+	pdfNameWidth    = 40
+)
+
+// RenderOrderReceiptPDF draws the receipt as a plain text PDF. It only needs the built-in Courier
+// font, so the PDF is written by hand rather than pulling in a PDF library.
+func RenderOrderReceiptPDF(receipt *OrderReceipt) []byte {
+
+	rule := strings.Repeat("-", 79)
+	amountLine := func(label string, amount string) string {
+		return fmt.Sprintf("%-60s %18s", label, amount)
+	}
+
+	lines := []string{
+		"BOIBOI - ORDER RECEIPT",
+		"",
+		"Order:         " + receipt.OrderID,
+		"Date:          " + receipt.Date.Format("02 Jan 2006, 15:04"),
+		"Customer:      " + receipt.CustomerName,
+		"Store:         " + receipt.StoreName,
+		"Delivered to:  " + receipt.DeliveryLocation,
+		"",
+		fmt.Sprintf("%-*s %8s %14s %14s", pdfNameWidth, "Item", "Qty", "Price", "Total"),
+		rule,
+	}
+
+	for _, line := range receipt.Lines {
+		name := []rune(line.Name)
+		if len(name) > pdfNameWidth {
+			name = append(name[:pdfNameWidth-3], []rune("...")...)
+		}
+		lines = append(lines, fmt.Sprintf("%-*s %8d %14s %14s", pdfNameWidth, string(name), line.Quantity, formatAmount(line.UnitPrice), formatAmount(line.Total)))
+	}
+
+	lines = append(lines,
+		rule,
+		amountLine("Subtotal", "NGN "+formatAmount(receipt.Subtotal)),
+		amountLine("Delivery fee", "NGN "+formatAmount(receipt.DeliveryFee)),
+		amountLine("Service charge", "NGN "+formatAmount(receipt.ServiceCharge)),
+		amountLine("Coupon", "-NGN "+formatAmount(receipt.Coupon)),
+		amountLine("Rider tip", "NGN "+formatAmount(receipt.Tip)),
+		amountLine("Total paid", "NGN "+formatAmount(receipt.Total)),
+		"",
+		"Payment method: "+receipt.PaymentMethod,
+		"Reference:      "+receipt.PaymentReference,
+		"",
+		"Questions? Contact us at hey@useboiboi.com",
+	)
+
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage {
+		pages = append(pages, lines[:pdfLinesPerPage])
+		lines = lines[pdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects 1-3 are the catalog, the page tree and the font; every page then takes two objects,
+	// the page itself and its content stream.
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	)
+
+	for i, page := range pages {
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xrefOffset)
+
+	return buf.Bytes()
+}
+
+// pdfEscape makes a line safe to put in a PDF string. Courier only covers Latin-1, so anything
+// outside printable ASCII is replaced rather than risk garbling the page.
+func pdfEscape(line string) string {
+	var escaped strings.Builder
+	for _, r := range line {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			escaped.WriteRune('?')
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+// formatAmount formats an amount in naira with thousands separators, e.g. 12,500.00.
+func formatAmount(amount float64) string {
+	formatted := strconv.FormatFloat(amount, 'f', 2, 64)
+
+	sign := ""
+	if strings.HasPrefix(formatted, "-") {
+		sign, formatted = "-", formatted[1:]
+	}
+
+	whole, fraction, _ := strings.Cut(formatted, ".")
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+
+	return sign + whole + "." + fraction
+}
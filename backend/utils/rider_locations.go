@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"useboi-boi/backend/internal/data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// roadDistanceFactor turns a straight-line distance into a rough distance by road.
+const roadDistanceFactor = 1.3
+
+// indexOptionsConflict is the error MongoDB returns when an index exists with other options.
+const indexOptionsConflict = 85
+
+// RiderLocationHistory is how long rider location fixes are kept before MongoDB deletes them.
+func RiderLocationHistory() time.Duration {
+	return time.Duration(GetEnvInt("RIDER_LOCATION_HISTORY_HOURS", 24)) * time.Hour
+}
+
+// RiderLocationMaxAge is how old a rider's latest fix may be and still be used for an ETA.
+func RiderLocationMaxAge() time.Duration {
+	return time.Duration(GetEnvInt("RIDER_LOCATION_MAX_AGE_MINUTES", 10)) * time.Minute
+}
+
+func riderAverageSpeedKmh() float64 {
+	return float64(GetEnvInt("RIDER_AVERAGE_SPEED_KMH", 20))
+}
+
+// EnsureRiderLocationIndexes creates the indexes of the rider location collection: a 2dsphere
+// index for geo queries, an index to find a rider's latest fix and a TTL index that expires
+// history. A changed RIDER_LOCATION_HISTORY_HOURS is applied to the existing TTL index.
+func EnsureRiderLocationIndexes(ctx context.Context, db *mongo.Database) error {
+
+	collection := db.Collection(RIDER_LOCATION)
+	historySeconds := int32(RiderLocationHistory().Seconds())
+
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "location", Value: "2dsphere"}}},
+		{Keys: bson.D{{Key: "riderId", Value: 1}, {Key: "recordedAt", Value: -1}}},
+	}); err != nil {
+		return err
+	}
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(historySeconds),
+	})
+
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Code == indexOptionsConflict {
+		return db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: RIDER_LOCATION},
+			{Key: "index", Value: bson.M{
+				"keyPattern":         bson.M{"createdAt": 1},
+				"expireAfterSeconds": historySeconds,
+			}},
+		}).Err()
+	}
+
+	return err
+}
+
+// LatestRiderLocation returns the rider's most recent fix, or nil if they have not reported one
+// recently enough to be trusted.
+func LatestRiderLocation(ctx context.Context, db *mongo.Database, riderId primitive.ObjectID) (*data.RiderLocation, error) {
+
+	var location data.RiderLocation
+	err := db.Collection(RIDER_LOCATION).FindOne(ctx, bson.M{
+		"riderId":    riderId,
+		"recordedAt": bson.M{"$gte": time.Now().Add(-RiderLocationMaxAge())},
+	}, options.FindOne().SetSort(bson.M{"recordedAt": -1})).Decode(&location)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &location, nil
+}
+
+// OrderETA is how far the rider is from the store and the customer, and roughly how long they will
+// take. The store leg is left out once the rider has picked the order up.
+type OrderETA struct {
+	RiderLocation     Coordinates `json:"riderLocation"`
+	ToStoreKm         *float64    `json:"toStoreKm,omitempty"`
+	ToStoreMinutes    *int        `json:"toStoreMinutes,omitempty"`
+	ToCustomerKm      float64     `json:"toCustomerKm"`
+	ToCustomerMinutes int         `json:"toCustomerMinutes"`
+	LocationUpdatedAt time.Time   `json:"locationUpdatedAt"`
+}
+
+// GetOrderETA works out the ETA of an order from its rider's latest fix. It returns nil when there
+// is nothing to estimate: no rider yet, no recent fix, or the order is no longer on its way.
+func GetOrderETA(ctx context.Context, db *mongo.Database, order *data.Order) (*OrderETA, error) {
+
+	if order.RiderID == nil || order.CurrentStatus() != data.OrderStatusOngoing {
+		return nil, nil
+	}
+
+	location, err := LatestRiderLocation(ctx, db, *order.RiderID)
+	if err != nil || location == nil {
+		return nil, err
+	}
+
+	return EstimateOrderETA(ctx, db, order, location)
+}
+
+// EstimateOrderETA works out the ETA of an order from a given rider fix, using straight-line
+// distances stretched by roadDistanceFactor and the average rider speed.
+func EstimateOrderETA(ctx context.Context, db *mongo.Database, order *data.Order, location *data.RiderLocation) (*OrderETA, error) {
+
+	if order.DeliveryMapLocation == nil {
+		return nil, nil
+	}
+
+	deliveryCoordinates, err := ParseMapLocation(*order.DeliveryMapLocation)
+	if err != nil {
+		return nil, nil
+	}
+
+	riderCoordinates := Coordinates{Lat: location.Location.Lat(), Lng: location.Location.Lng()}
+	eta := OrderETA{
+		RiderLocation:     riderCoordinates,
+		LocationUpdatedAt: location.RecordedAt,
+	}
+
+	switch order.CurrentProgressStatus() {
+	case data.OrderAcceptedByRider, data.RiderAtVendor:
+		var store data.Store
+		if err := db.Collection(STORE).FindOne(ctx, bson.M{"_id": order.StoreID}).Decode(&store); err != nil {
+			return nil, err
+		}
+		if store.MapLocation == nil {
+			return nil, nil
+		}
+		storeCoordinates, err := ParseMapLocation(*store.MapLocation)
+		if err != nil {
+			return nil, nil
+		}
+
+		toStoreKm := 0.0
+		if order.CurrentProgressStatus() == data.OrderAcceptedByRider {
+			toStoreKm = roadKm(riderCoordinates, *storeCoordinates)
+		}
+		toStoreMinutes := travelMinutes(toStoreKm)
+
+		eta.ToStoreKm = &toStoreKm
+		eta.ToStoreMinutes = &toStoreMinutes
+		eta.ToCustomerKm = toStoreKm + roadKm(*storeCoordinates, *deliveryCoordinates)
+	case data.RiderOnHisWay:
+		eta.ToCustomerKm = roadKm(riderCoordinates, *deliveryCoordinates)
+	case data.RiderAtUserLocation:
+		eta.ToCustomerKm = 0
+	default:
+		return nil, nil
+	}
+
+	eta.ToCustomerKm = roundKm(eta.ToCustomerKm)
+	eta.ToCustomerMinutes = travelMinutes(eta.ToCustomerKm)
+
+	return &eta, nil
+}
+
+func roadKm(from Coordinates, to Coordinates) float64 {
+	return roundKm(DistanceInKm(from, to) * roadDistanceFactor)
+}
+
+func roundKm(km float64) float64 {
+	return math.Round(km*100) / 100
+}
+
+func travelMinutes(km float64) int {
+	return int(math.Ceil(km / riderAverageSpeedKmh() * 60))
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"useboi-boi/backend/internal/data"
+)
+
+const (
+	DefaultStoreTimezone   = "Africa/Lagos"
+	StoreClosureDateLayout = "2006-01-02"
+)
+
+var storeTimeLayouts = []string{"15:04", "15:04:05", "3:04 PM", "3:04PM", "3 PM", "3PM"}
+
+// StoreLocation returns the timezone a store's opening hours are written in.
+func StoreLocation(store *data.Store) (*time.Location, error) {
+	timezone := store.Timezone
+	if len(timezone) == 0 {
+		timezone = DefaultStoreTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store timezone %q", timezone)
+	}
+
+	return location, nil
+}
+
+// IsStoreOpenAt reports whether a store takes orders at t, going by its available days,
+// opening and closing times and holiday closures. A store with no hours set is always open.
+func IsStoreOpenAt(store *data.Store, t time.Time) (bool, error) {
+
+	location, err := StoreLocation(store)
+	if err != nil {
+		return false, err
+	}
+
+	opening, closing, err := storeHours(store)
+	if err != nil {
+		return false, err
+	}
+
+	local := t.In(location)
+	sinceMidnight := local.Sub(startOfDay(local))
+
+	if closing > opening || opening == closing {
+		if !isStoreOpenOnDay(store, local) {
+			return false, nil
+		}
+		if opening == closing {
+			return true, nil
+		}
+		return sinceMidnight >= opening && sinceMidnight < closing, nil
+	}
+
+	// Hours run past midnight, so the early morning belongs to the previous day's shift.
+	if sinceMidnight >= opening {
+		return isStoreOpenOnDay(store, local), nil
+	}
+	if sinceMidnight < closing {
+		return isStoreOpenOnDay(store, local.AddDate(0, 0, -1)), nil
+	}
+
+	return false, nil
+}
+
+// NextStoreOpening returns when a store next opens after t, or nil if it is open at t
+// or has no opening day within the next year.
+func NextStoreOpening(store *data.Store, t time.Time) (*time.Time, error) {
+
+	isOpen, err := IsStoreOpenAt(store, t)
+	if err != nil {
+		return nil, err
+	}
+	if isOpen {
+		return nil, nil
+	}
+
+	location, err := StoreLocation(store)
+	if err != nil {
+		return nil, err
+	}
+
+	opening, _, err := storeHours(store)
+	if err != nil {
+		return nil, err
+	}
+
+	local := t.In(location)
+	for days := 0; days <= 366; days++ {
+		day := startOfDay(local.AddDate(0, 0, days))
+		if !isStoreOpenOnDay(store, day) {
+			continue
+		}
+
+		opensAt := day.Add(opening)
+		if opensAt.After(t) {
+			return &opensAt, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ValidateStoreClosure checks that a closure has well formed dates in the right order.
+func ValidateStoreClosure(closure *data.StoreClosure) error {
+	start, err := time.Parse(StoreClosureDateLayout, closure.StartDate)
+	if err != nil {
+		return fmt.Errorf("startDate must be in the format YYYY-MM-DD")
+	}
+
+	end, err := time.Parse(StoreClosureDateLayout, closure.EndDate)
+	if err != nil {
+		return fmt.Errorf("endDate must be in the format YYYY-MM-DD")
+	}
+
+	if end.Before(start) {
+		return fmt.Errorf("endDate cannot be before startDate")
+	}
+
+	return nil
+}
+
+func storeHours(store *data.Store) (time.Duration, time.Duration, error) {
+	if len(strings.TrimSpace(store.OpeningTime)) == 0 || len(strings.TrimSpace(store.ClosingTime)) == 0 {
+		return 0, 0, nil
+	}
+
+	opening, err := parseStoreTime(store.OpeningTime)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	closing, err := parseStoreTime(store.ClosingTime)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return opening, closing, nil
+}
+
+func parseStoreTime(value string) (time.Duration, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	for _, layout := range storeTimeLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err == nil {
+			return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid store time %q", value)
+}
+
+func isStoreOpenOnDay(store *data.Store, day time.Time) bool {
+	date := day.Format(StoreClosureDateLayout)
+	for _, closure := range store.Closures {
+		if date >= closure.StartDate && date <= closure.EndDate {
+			return false
+		}
+	}
+
+	if len(store.AvailableDays) == 0 {
+		return true
+	}
+
+	weekday := strings.ToLower(day.Weekday().String())
+	for _, availableDay := range store.AvailableDays {
+		availableDay = strings.ToLower(strings.TrimSpace(availableDay))
+		if len(availableDay) >= 3 && strings.HasPrefix(weekday, availableDay[:3]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
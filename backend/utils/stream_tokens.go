@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// StreamTokenTTL is how long a stream token can be used to open an order stream.
+const StreamTokenTTL = 60 * time.Second
+
+const streamTokenPurpose = "stream"
+
+// GenerateStreamToken issues a short-lived token that opens the live stream of one order for a
+// user. Browser EventSource can't set the Authorization header, so the stream takes this token
+// in its URL instead of the login JWT, which would otherwise end up in access logs.
+func GenerateStreamToken(userId string, orderId string) (string, time.Time, error) {
+
+	expiresAt := time.Now().Add(StreamTokenTTL)
+
+	claims := jwt.MapClaims{
+		"userId":  userId,
+		"orderId": orderId,
+		"purpose": streamTokenPurpose,
+		"iat":     time.Now().Unix(),
+		"exp":     expiresAt.Unix(),
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("JWT_SIGNING_KEY")))
+	return token, expiresAt, err
+}
+
+// ParseStreamToken checks a token from GenerateStreamToken and returns the user it was issued to.
+// It fails for expired tokens, login tokens and tokens issued for another order.
+func ParseStreamToken(tokenString string, orderId string) (string, error) {
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("invalid signing method")
+		}
+		return []byte(os.Getenv("JWT_SIGNING_KEY")), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", errors.New("invalid token")
+	}
+
+	if purpose, _ := claims["purpose"].(string); purpose != streamTokenPurpose {
+		return "", errors.New("not a stream token")
+	}
+
+	if tokenOrderId, _ := claims["orderId"].(string); tokenOrderId != orderId {
+		return "", errors.New("token was issued for another order")
+	}
+
+	userId, ok := claims["userId"].(string)
+	if !ok {
+		return "", errors.New("invalid token")
+	}
+
+	return userId, nil
+}
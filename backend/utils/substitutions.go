@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"useboi-boi/backend/internal/data"
+
+	"firebase.google.com/go/messaging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureSubstitutionIndexes creates the indexes substitutions are looked up by. The partial unique
+// index keeps an order to one pending substitution at a time.
+func EnsureSubstitutionIndexes(ctx context.Context, db *mongo.Database) error {
+
+	_, err := db.Collection(SUBSTITUTION).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "orderId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "orderId", Value: 1}},
+			Options: options.Index().
+				SetName("orderId_pending").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"status": data.SubstitutionPending}),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expiresAt", Value: 1}}},
+	})
+	return err
+}
+
+// SendSubstitutionNotificationToCustomer asks the customer to approve or reject the changes the
+// store wants to make to their order.
+func SendSubstitutionNotificationToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, substitution *data.Substitution) {
+
+	body := "Some items on your order are out of stock. Review the store's suggested changes in the app"
+	if substitution.PriceDifference > 0 {
+		body = fmt.Sprintf("Some items on your order are out of stock. The suggested changes cost ₦%s more", formatAmount(substitution.PriceDifference))
+	} else if substitution.PriceDifference < 0 {
+		body = fmt.Sprintf("Some items on your order are out of stock. The suggested changes cost ₦%s less", formatAmount(-substitution.PriceDifference))
+	}
+
+	sendSubstitutionNotification(ctx, db, fcm, []primitive.ObjectID{substitution.CustomerID}, substitution, "The Store Needs Your Approval", body)
+}
+
+// SendSubstitutionExpiredNotificationToCustomer tells the customer what was done with the store's
+// changes they didn't answer in time.
+func SendSubstitutionExpiredNotificationToCustomer(ctx context.Context, db *mongo.Database, fcm *messaging.Client, substitution *data.Substitution) {
+
+	body := "We went ahead with the store's suggested changes to your order"
+	if substitution.Status == data.SubstitutionRejected {
+		body = "The out-of-stock items have been taken off your order"
+	}
+	if substitution.SettledAmount != nil && *substitution.SettledAmount < 0 {
+		body += fmt.Sprintf(" and ₦%s has been refunded to your wallet", formatAmount(-*substitution.SettledAmount))
+	} else if substitution.SettledAmount != nil && *substitution.SettledAmount > 0 {
+		body += fmt.Sprintf(" and ₦%s has been taken from your wallet", formatAmount(*substitution.SettledAmount))
+	}
+
+	sendSubstitutionNotification(ctx, db, fcm, []primitive.ObjectID{substitution.CustomerID}, substitution, "Your Order Has Been Updated", body)
+}
+
+// SendSubstitutionAnsweredNotificationToMerchant tells the store's merchants whether their changes
+// to an order were approved, so they know what to pack.
+func SendSubstitutionAnsweredNotificationToMerchant(ctx context.Context, db *mongo.Database, fcm *messaging.Client, substitution *data.Substitution) {
+
+	merchantIds, err := db.Collection(USER).Distinct(ctx, "_id", bson.M{"type": "merchant", "storeId": substitution.StoreID})
+	if err != nil {
+		slog.Info("error", "error getting store merchants for notification", err.Error())
+		return
+	}
+
+	recipients := []primitive.ObjectID{}
+	for _, merchantId := range merchantIds {
+		if id, ok := merchantId.(primitive.ObjectID); ok {
+			recipients = append(recipients, id)
+		}
+	}
+
+	title := "Your Changes Were Approved"
+	body := "Go ahead with the changes you suggested"
+	if substitution.Status == data.SubstitutionRejected {
+		title = "Your Changes Were Rejected"
+		body = "Leave the affected items off the order"
+	}
+	if substitution.RespondedBy != nil && *substitution.RespondedBy == data.ActorSystem {
+		body = "The customer didn't answer in time. " + body
+	}
+
+	sendSubstitutionNotification(ctx, db, fcm, recipients, substitution, title, body)
+}
+
+func sendSubstitutionNotification(ctx context.Context, db *mongo.Database, fcm *messaging.Client, recipients []primitive.ObjectID, substitution *data.Substitution, title string, body string) {
+
+	deviceTokenCollection := db.Collection(DEVICE_TOKEN)
+
+	cursor, err := deviceTokenCollection.Find(ctx, bson.M{"userId": bson.M{"$in": recipients}})
+	if err != nil {
+		slog.Info("error", "error sending notification", err.Error())
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var deviceTokens []data.DeviceToken
+	if err = cursor.All(ctx, &deviceTokens); err != nil {
+		slog.Info("error", "error decoding documents:", err.Error())
+		return
+	}
+
+	for _, token := range deviceTokens {
+		message := &messaging.Message{
+			Token: token.Token,
+			Notification: &messaging.Notification{
+				Title: title,
+				Body:  body,
+			},
+			Data: map[string]string{
+				"orderId":        substitution.OrderID.Hex(),
+				"substitutionId": substitution.ID.Hex(),
+			},
+		}
+
+		SendNotification(fcm, message, func() {
+			deviceTokenCollection.DeleteOne(ctx, bson.M{"_id": token.ID})
+		})
+	}
+
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"os"
 	"reflect"
+	"strconv"
 	"time"
 )
 
@@ -104,3 +107,16 @@ func Average(numbers []int) float64 {
 
     return float64(sum) / float64(len(numbers))
 }
+
+func RoundToKobo(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// GetEnvInt reads an integer setting from the environment, falling back when it is unset or invalid.
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}